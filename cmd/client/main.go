@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/internal/fsutil"
+	"github.com/ogrok/gotunnel/pkg/auth"
 	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/ogrok/gotunnel/pkg/users"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
@@ -32,6 +43,55 @@ type Config struct {
 	AuthToken  string `yaml:"auth_token" json:"auth_token"`
 	UseTLS     bool   `yaml:"use_tls" json:"use_tls"`
 	SkipVerify bool   `yaml:"skip_verify" json:"skip_verify"`
+	// LegacyAuth sends the token in the connection URL, for servers that
+	// can't authenticate clients by challenge
+	LegacyAuth bool `yaml:"legacy_auth" json:"legacy_auth"`
+	// BearerAuth sends the token in the Authorization header, for servers
+	// checking tokens with a backend that can't verify challenges
+	BearerAuth bool `yaml:"bearer_auth" json:"bearer_auth"`
+	// Username authenticates with a password, which is given as the token
+	Username string `yaml:"username" json:"username"`
+	// IdentityFile is an Ed25519 key answering auth challenges instead of
+	// the token, for servers listing it in their authorized keys
+	IdentityFile string `yaml:"identity_file" json:"identity_file"`
+
+	// CertFile and KeyFile authenticate the client through mutual TLS
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// CAFile is trusted instead of the system roots to verify the server
+	CAFile string `yaml:"ca_file" json:"ca_file"`
+	// Pins are SHA-256 fingerprints of the server certificate or public key
+	Pins []string `yaml:"pins" json:"pins"`
+
+	// Routes send HTTP requests to different local services by path
+	Routes []tunnel.Route `yaml:"routes" json:"routes"`
+
+	// Dir serves a local directory from the client instead of a local service
+	Dir        string `yaml:"dir" json:"dir"`
+	DirListing bool   `yaml:"dir_listing" json:"dir_listing"`
+
+	// LocalHTTPS connects to the local service over TLS. The Local* TLS
+	// options apply to it and to routes with an https:// upstream.
+	LocalHTTPS      bool   `yaml:"local_https" json:"local_https"`
+	LocalServerName string `yaml:"local_server_name" json:"local_server_name"`
+	LocalCAFile     string `yaml:"local_ca_file" json:"local_ca_file"`
+	LocalSkipVerify bool   `yaml:"local_skip_verify" json:"local_skip_verify"`
+
+	// AllowHTTP serves the tunnel over plain HTTP too instead of redirecting to HTTPS
+	AllowHTTP bool `yaml:"allow_http" json:"allow_http"`
+	// HSTS asks the server to send Strict-Transport-Security headers
+	HSTS bool `yaml:"hsts" json:"hsts"`
+
+	// HostHeader replaces the Host header sent to the local service:
+	// "rewrite" uses the local address, any other value is used as is
+	HostHeader string `yaml:"host_header" json:"host_header"`
+	// ErrorPages is a directory with templates overriding the error pages
+	// the client sends itself, like the server's --error-pages
+	ErrorPages string `yaml:"error_pages" json:"error_pages"`
+
+	// tokenFile is the configuration file the auth token was read from,
+	// which is updated when the server rotates the token
+	tokenFile string
 }
 
 func main() {
@@ -47,28 +107,63 @@ func main() {
 				Usage:    "Tunnel server address (e.g., tunnel.example.com)",
 			},
 			&cli.StringFlag{
-				Name:     "subdomain",
-				Aliases:  []string{"d"},
-				Required: true,
-				Usage:    "Subdomain for the tunnel (e.g., myapp)",
+				Name:    "subdomain",
+				Aliases: []string{"d"},
+				Usage:   "Subdomain for the tunnel (e.g., myapp); assigned by the server if omitted",
 			},
 			&cli.IntFlag{
-				Name:     "local-port",
-				Aliases:  []string{"p"},
-				Required: true,
-				Usage:    "Local port to forward",
+				Name:    "local-port",
+				Aliases: []string{"p"},
+				Usage:   "Local port to forward",
 			},
 			&cli.StringFlag{
 				Name:    "local-host",
 				Value:   "localhost",
 				Usage:   "Local host to forward",
 			},
+			&cli.StringSliceFlag{
+				Name:    "route",
+				Aliases: []string{"r"},
+				Usage:   "Route HTTP paths to a local service (e.g., /api/*=localhost:8080 or /api/*=localhost:8080,strip)",
+			},
+			&cli.StringFlag{
+				Name:    "dir",
+				Usage:   "Serve files from this directory instead of a local service",
+			},
+			&cli.BoolFlag{
+				Name:    "dir-listing",
+				Usage:   "Show listings for directories without an index.html (with --dir)",
+			},
+			&cli.StringFlag{
+				Name:    "host-header",
+				Usage:   "Host header sent to the local service (\"rewrite\" for the local address, or any value)",
+			},
+			&cli.StringFlag{
+				Name:    "error-pages",
+				Usage:   "Directory with HTML templates overriding the error pages sent by the client (local_refused.html, no_route.html)",
+			},
 			&cli.StringFlag{
 				Name:     "token",
 				Aliases:  []string{"t"},
-				Required: true,
 				Usage:    "Authentication token",
 			},
+			&cli.StringFlag{
+				Name:    "user",
+				Usage:   "Username for servers authenticating with passwords; --token is the password",
+			},
+			&cli.StringFlag{
+				Name:    "identity",
+				Aliases: []string{"i"},
+				Usage:   "Ed25519 identity key to authenticate with instead of a token (see 'og auth keygen')",
+			},
+			&cli.BoolFlag{
+				Name:    "bearer-auth",
+				Usage:   "Send the token in the Authorization header instead of answering an auth challenge",
+			},
+			&cli.BoolFlag{
+				Name:    "legacy-auth",
+				Usage:   "Send the token in the connection URL instead of answering an auth challenge, for older servers",
+			},
 			&cli.BoolFlag{
 				Name:    "tls",
 				Value:   true,
@@ -78,6 +173,46 @@ func main() {
 				Name:    "skip-verify",
 				Usage:   "Skip TLS certificate verification",
 			},
+			&cli.StringFlag{
+				Name:    "cert",
+				Usage:   "Client certificate file for mutual TLS authentication",
+			},
+			&cli.StringFlag{
+				Name:    "key",
+				Usage:   "Client certificate key file",
+			},
+			&cli.StringFlag{
+				Name:    "ca",
+				Usage:   "CA bundle to verify the server certificate with",
+			},
+			&cli.StringSliceFlag{
+				Name:    "pin",
+				Usage:   "Trust only a server certificate with this SHA-256 fingerprint, or a public key pinned as sha256/<base64> (can be repeated)",
+			},
+			&cli.BoolFlag{
+				Name:    "local-https",
+				Usage:   "Connect to the local service over HTTPS",
+			},
+			&cli.StringFlag{
+				Name:    "local-sni",
+				Usage:   "Server name sent to and verified for HTTPS upstreams (default: upstream host)",
+			},
+			&cli.StringFlag{
+				Name:    "local-ca",
+				Usage:   "CA bundle to verify HTTPS upstreams with",
+			},
+			&cli.BoolFlag{
+				Name:    "local-skip-verify",
+				Usage:   "Skip certificate verification of HTTPS upstreams",
+			},
+			&cli.BoolFlag{
+				Name:    "allow-http",
+				Usage:   "Serve the tunnel over plain HTTP too instead of redirecting visitors to HTTPS",
+			},
+			&cli.BoolFlag{
+				Name:    "hsts",
+				Usage:   "Send Strict-Transport-Security headers to visitors",
+			},
 			&cli.StringFlag{
 				Name:    "config",
 				Aliases: []string{"c"},
@@ -158,6 +293,9 @@ func loadConfig(c *cli.Context) (*Config, error) {
 		if err := yaml.Unmarshal(data, config); err != nil {
 			return nil, fmt.Errorf("failed to parse config file: %w", err)
 		}
+		if config.AuthToken != "" {
+			config.tokenFile = configFile
+		}
 	}
 
 	// Override with command line flags
@@ -175,6 +313,19 @@ func loadConfig(c *cli.Context) (*Config, error) {
 	}
 	if c.IsSet("token") {
 		config.AuthToken = c.String("token")
+		config.tokenFile = ""
+	}
+	if c.IsSet("user") {
+		config.Username = c.String("user")
+	}
+	if c.IsSet("identity") {
+		config.IdentityFile = c.String("identity")
+	}
+	if c.IsSet("bearer-auth") {
+		config.BearerAuth = c.Bool("bearer-auth")
+	}
+	if c.IsSet("legacy-auth") {
+		config.LegacyAuth = c.Bool("legacy-auth")
 	}
 	if c.IsSet("tls") {
 		config.UseTLS = c.Bool("tls")
@@ -182,19 +333,74 @@ func loadConfig(c *cli.Context) (*Config, error) {
 	if c.IsSet("skip-verify") {
 		config.SkipVerify = c.Bool("skip-verify")
 	}
+	if c.IsSet("cert") {
+		config.CertFile = c.String("cert")
+	}
+	if c.IsSet("key") {
+		config.KeyFile = c.String("key")
+	}
+	if c.IsSet("ca") {
+		config.CAFile = c.String("ca")
+	}
+	if c.IsSet("local-https") {
+		config.LocalHTTPS = c.Bool("local-https")
+	}
+	if c.IsSet("local-sni") {
+		config.LocalServerName = c.String("local-sni")
+	}
+	if c.IsSet("local-ca") {
+		config.LocalCAFile = c.String("local-ca")
+	}
+	if c.IsSet("local-skip-verify") {
+		config.LocalSkipVerify = c.Bool("local-skip-verify")
+	}
+	if c.IsSet("allow-http") {
+		config.AllowHTTP = c.Bool("allow-http")
+	}
+	if c.IsSet("hsts") {
+		config.HSTS = c.Bool("hsts")
+	}
+	if c.IsSet("pin") {
+		config.Pins = c.StringSlice("pin")
+	}
+	if c.IsSet("route") {
+		config.Routes = nil
+		for _, spec := range c.StringSlice("route") {
+			route, err := tunnel.ParseRoute(spec)
+			if err != nil {
+				return nil, err
+			}
+			config.Routes = append(config.Routes, route)
+		}
+	}
+	if c.IsSet("dir") {
+		config.Dir = c.String("dir")
+	}
+	if c.IsSet("host-header") {
+		config.HostHeader = c.String("host-header")
+	}
+	if c.IsSet("dir-listing") {
+		config.DirListing = c.Bool("dir-listing")
+	}
+	if c.IsSet("error-pages") {
+		config.ErrorPages = c.String("error-pages")
+	}
+	if config.LocalHost == "" {
+		config.LocalHost = "localhost"
+	}
 
 	// Validate required fields
 	if config.ServerAddr == "" {
 		return nil, fmt.Errorf("server address is required")
 	}
-	if config.Subdomain == "" {
-		return nil, fmt.Errorf("subdomain is required")
+	if config.Dir != "" && config.LocalPort != 0 {
+		return nil, fmt.Errorf("local port and dir are mutually exclusive")
 	}
-	if config.LocalPort == 0 {
-		return nil, fmt.Errorf("local port is required")
+	if config.LocalPort == 0 && config.Dir == "" && len(config.Routes) == 0 {
+		return nil, fmt.Errorf("local port, dir or at least one route is required")
 	}
-	if config.AuthToken == "" {
-		return nil, fmt.Errorf("auth token is required")
+	if config.AuthToken == "" && config.IdentityFile == "" && config.CertFile == "" {
+		return nil, fmt.Errorf("auth token, identity key or client certificate is required")
 	}
 
 	return config, nil
@@ -202,21 +408,82 @@ func loadConfig(c *cli.Context) (*Config, error) {
 
 // Client represents the tunnel client
 type Client struct {
-	config *Config
-	logger *logrus.Logger
-	conn   *websocket.Conn
+	config      *Config
+	logger      *logrus.Logger
+	conn        *websocket.Conn
+	routes      *tunnel.RouteTable
+	errorPages  *tunnel.ErrorPages
+	upstreamTLS *tls.Config
+	identity    ssh.Signer
+	publicURL   string
 }
 
 // NewClient creates a new tunnel client
 func NewClient(config *Config, logger *logrus.Logger) *Client {
 	return &Client{
-		config: config,
-		logger: logger,
+		config:     config,
+		logger:     logger,
+		errorPages: tunnel.DefaultErrorPages(),
 	}
 }
 
 // Start starts the client
 func (c *Client) Start(ctx context.Context) error {
+	// Serve the static directory in-process and use it as the local service
+	if c.config.Dir != "" {
+		listener, err := tunnel.ServeStatic(c.config.Dir, c.config.DirListing)
+		if err != nil {
+			return fmt.Errorf("failed to serve %s: %w", c.config.Dir, err)
+		}
+		defer listener.Close()
+
+		addr := listener.Addr().(*net.TCPAddr)
+		c.config.LocalHost = addr.IP.String()
+		c.config.LocalPort = addr.Port
+		c.logger.WithField("dir", c.config.Dir).Info("Serving static files")
+	}
+
+	// Prepare TLS for local services that only speak HTTPS
+	upstreamTLS, err := tunnel.NewClientTLSConfig(tunnel.ClientTLSOptions{
+		SkipVerify: c.config.LocalSkipVerify,
+		CAFile:     c.config.LocalCAFile,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid upstream TLS options: %w", err)
+	}
+	upstreamTLS.ServerName = c.config.LocalServerName
+	c.upstreamTLS = upstreamTLS
+
+	// Load the identity key answering auth challenges
+	if c.config.IdentityFile != "" {
+		identity, err := auth.LoadIdentity(c.config.IdentityFile)
+		if err != nil {
+			return err
+		}
+		c.identity = identity
+	}
+
+	// Load custom templates for the errors reported by the client, which
+	// the server's error pages don't cover
+	if c.config.ErrorPages != "" {
+		errorPages, err := tunnel.LoadErrorPages(c.config.ErrorPages)
+		if err != nil {
+			return fmt.Errorf("failed to load error pages: %w", err)
+		}
+		c.errorPages = errorPages
+	}
+
+	// Build the route table, falling back to the local port for other paths
+	routes := append([]tunnel.Route{}, c.config.Routes...)
+	if c.config.LocalPort != 0 {
+		routes = append(routes, tunnel.Route{Path: "/*", Upstream: c.localUpstream()})
+	}
+	table, err := tunnel.NewRouteTable(routes)
+	if err != nil {
+		return fmt.Errorf("invalid routes: %w", err)
+	}
+	c.routes = table
+
 	// Connect to tunnel server
 	if err := c.connect(ctx); err != nil {
 		return fmt.Errorf("failed to connect to tunnel server: %w", err)
@@ -237,14 +504,38 @@ func (c *Client) connect(ctx context.Context) error {
 		scheme = "ws"
 	}
 
+	query := url.Values{
+		"subdomain":  []string{c.config.Subdomain},
+		"allow_http": []string{strconv.FormatBool(c.config.AllowHTTP)},
+		"hsts":       []string{strconv.FormatBool(c.config.HSTS)},
+		"type":       []string{"http"},
+	}
+	// Prove possession of the token rather than sending it, unless the
+	// server is too old to ask for the proof. Passwords, user API keys and
+	// JWTs have to be shown to the server and go in the Authorization header.
+	// Identity keys are always proven by challenge.
+	header := http.Header{}
+	if c.config.IdentityFile != "" {
+		query.Set("auth", "challenge")
+	} else if c.config.AuthToken != "" {
+		switch {
+		case c.config.Username != "":
+			credentials := base64.StdEncoding.EncodeToString([]byte(c.config.Username + ":" + c.config.AuthToken))
+			header.Set("Authorization", "Basic "+credentials)
+		case c.config.LegacyAuth:
+			query.Set("token", c.config.AuthToken)
+		case c.config.BearerAuth || users.IsUserCredential(c.config.AuthToken):
+			header.Set("Authorization", "Bearer "+c.config.AuthToken)
+		default:
+			query.Set("auth", "challenge")
+		}
+	}
+
 	u := url.URL{
-		Scheme: scheme,
-		Host:   c.config.ServerAddr,
-		Path:   "/tunnel",
-		RawQuery: url.Values{
-			"subdomain": []string{c.config.Subdomain},
-			"token":     []string{c.config.AuthToken},
-		}.Encode(),
+		Scheme:   scheme,
+		Host:     c.config.ServerAddr,
+		Path:     "/tunnel",
+		RawQuery: query.Encode(),
 	}
 
 	c.logger.WithField("url", u.String()).Debug("Connecting to tunnel server")
@@ -256,19 +547,102 @@ func (c *Client) connect(ctx context.Context) error {
 
 	// Add TLS configuration if needed
 	if c.config.UseTLS {
-		dialer.TLSClientConfig = tunnel.CreateClientTLSConfig(c.config.SkipVerify)
+		tlsConfig, err := tunnel.NewClientTLSConfig(tunnel.ClientTLSOptions{
+			SkipVerify: c.config.SkipVerify,
+			CAFile:     c.config.CAFile,
+			Pins:       c.config.Pins,
+			CertFile:   c.config.CertFile,
+			KeyFile:    c.config.KeyFile,
+		})
+		if err != nil {
+			return err
+		}
+		dialer.TLSClientConfig = tlsConfig
 	}
 
 	// Connect
-	conn, _, err := dialer.DialContext(ctx, u.String(), nil)
+	conn, _, err := dialer.DialContext(ctx, u.String(), header)
+	if errors.Is(err, tunnel.ErrPinMismatch) {
+		return fmt.Errorf("refusing to connect, the server may be impersonated: %w", err)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to establish WebSocket connection: %w", err)
 	}
 
+	// Wait for the server to accept or reject the tunnel, answering its
+	// auth challenge first if it sends one
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to read handshake response: %w", err)
+	}
+	var challenge tunnel.AuthChallenge
+	if json.Unmarshal(message, &challenge) == nil && challenge.Type == tunnel.MessageTypeChallenge {
+		if err := c.answerChallenge(conn, u, challenge); err != nil {
+			conn.Close()
+			return err
+		}
+		if _, message, err = conn.ReadMessage(); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to read handshake response: %w", err)
+		}
+	}
+
+	var response tunnel.HandshakeResponse
+	if err := json.Unmarshal(message, &response); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid handshake response: %w", err)
+	}
+	if !response.Success {
+		conn.Close()
+		return fmt.Errorf("tunnel rejected by server: %s", response.Error)
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"tunnel_id": response.TunnelID,
+		"subdomain": response.Subdomain,
+		"url":       response.URL,
+	}).Info("Tunnel registered")
+	c.config.Subdomain = response.Subdomain
+	c.publicURL = response.URL
+
 	c.conn = conn
 	return nil
 }
 
+// answerChallenge signs the server's nonce and the parameters of the
+// connection with the identity key, or the key derived from the auth token
+func (c *Client) answerChallenge(conn *websocket.Conn, u url.URL, challenge tunnel.AuthChallenge) error {
+	params := tunnel.ChallengeParams(u.Host, u.Query())
+
+	var response tunnel.AuthResponse
+	switch {
+	case c.identity != nil:
+		signature, err := auth.SignChallengeWithKey(c.identity, challenge.Nonce, params)
+		if err != nil {
+			return err
+		}
+		response = tunnel.AuthResponse{
+			Method:    auth.ChallengeMethodEd25519,
+			KeyID:     auth.KeyFingerprint(c.identity.PublicKey()),
+			Signature: signature,
+		}
+	case c.config.AuthToken != "":
+		key := auth.TokenKey(c.config.AuthToken)
+		response = tunnel.AuthResponse{
+			Method:    auth.ChallengeMethodToken,
+			KeyID:     auth.TokenKeyID(auth.TokenPublicKey(c.config.AuthToken)),
+			Signature: auth.SignChallenge(key, challenge.Nonce, params),
+		}
+	default:
+		return fmt.Errorf("server requires an auth token")
+	}
+	if err := conn.WriteJSON(response); err != nil {
+		return fmt.Errorf("failed to answer auth challenge: %w", err)
+	}
+	return nil
+}
+
 // forwardTraffic forwards traffic between local service and tunnel server
 func (c *Client) forwardTraffic(ctx context.Context) error {
 	for {
@@ -277,7 +651,7 @@ func (c *Client) forwardTraffic(ctx context.Context) error {
 			return ctx.Err()
 		default:
 			// Read message from tunnel server
-			_, message, err := c.conn.ReadMessage()
+			messageType, message, err := c.conn.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 					return fmt.Errorf("unexpected WebSocket close: %w", err)
@@ -285,6 +659,12 @@ func (c *Client) forwardTraffic(ctx context.Context) error {
 				return fmt.Errorf("failed to read message from tunnel: %w", err)
 			}
 
+			// Tunnel traffic is binary, control messages are JSON text
+			if messageType == websocket.TextMessage {
+				c.handleControlMessage(message)
+				continue
+			}
+
 			// Forward message to local service
 			if err := c.forwardToLocal(message); err != nil {
 				c.logger.WithError(err).Error("Failed to forward to local service")
@@ -294,13 +674,115 @@ func (c *Client) forwardTraffic(ctx context.Context) error {
 	}
 }
 
+// handleControlMessage handles a control message sent by the server
+func (c *Client) handleControlMessage(message []byte) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(message, &header); err != nil {
+		c.logger.WithError(err).Warn("Invalid control message")
+		return
+	}
+
+	switch header.Type {
+	case tunnel.MessageTypeTokenRotated:
+		var rotated tunnel.TokenRotated
+		if err := json.Unmarshal(message, &rotated); err != nil {
+			c.logger.WithError(err).Warn("Invalid token rotation")
+			return
+		}
+		c.rotateToken(rotated)
+	default:
+		c.logger.WithField("type", header.Type).Debug("Ignoring unknown control message")
+	}
+}
+
+// rotateToken switches to the token the server rotated the current one to
+// and saves it to the configuration file it was read from
+func (c *Client) rotateToken(rotated tunnel.TokenRotated) {
+	c.config.AuthToken = rotated.Token
+	entry := c.logger.WithFields(logrus.Fields{
+		"expires_at":          rotated.ExpiresAt.Format(time.RFC3339),
+		"previous_expires_at": rotated.PreviousExpiresAt.Format(time.RFC3339),
+	})
+
+	if c.config.tokenFile == "" {
+		entry.Warn("Auth token rotated by the server, pass the new token with --token before the old one expires")
+		return
+	}
+	if err := saveConfigToken(c.config.tokenFile, rotated.Token); err != nil {
+		entry.WithError(err).Error("Auth token rotated by the server, but saving it failed")
+		return
+	}
+	entry.WithField("config", c.config.tokenFile).Info("Auth token rotated by the server and saved")
+}
+
+// saveConfigToken replaces the auth token in a configuration file, keeping
+// the rest of the file including comments
+func saveConfigToken(path, token string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a YAML mapping", path)
+	}
+
+	mapping := doc.Content[0]
+	found := false
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "auth_token" {
+			mapping.Content[i+1].SetString(token)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s has no auth_token", path)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	// Replace the file in one step so a crash can't leave it truncated
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(path, buf.Bytes(), info.Mode().Perm())
+}
+
 // forwardToLocal forwards data to the local service
 func (c *Client) forwardToLocal(data []byte) error {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		// Not HTTP: pass the bytes to the default local service unchanged
+		if c.config.LocalPort == 0 {
+			return fmt.Errorf("no local port configured for non-HTTP traffic")
+		}
+		return c.forwardRaw(c.localUpstream(), data)
+	}
+
+	return c.forwardHTTP(req, data)
+}
+
+// forwardRaw writes non-HTTP data to the local service at upstream and
+// sends its reply back through the tunnel as is
+func (c *Client) forwardRaw(upstream string, data []byte) error {
 	// Connect to local service
-	localAddr := fmt.Sprintf("%s:%d", c.config.LocalHost, c.config.LocalPort)
-	conn, err := net.DialTimeout("tcp", localAddr, 10*time.Second)
+	conn, err := c.dialLocal(upstream, data)
 	if err != nil {
-		return fmt.Errorf("failed to connect to local service: %w", err)
+		return err
 	}
 	defer conn.Close()
 
@@ -329,6 +811,235 @@ func (c *Client) forwardToLocal(data []byte) error {
 	return nil
 }
 
+// forwardHTTP sends an HTTP request to the local service picked by the
+// route table, stripping the route prefix and rewriting the Host header
+// when configured
+func (c *Client) forwardHTTP(req *http.Request, data []byte) error {
+	route, path, ok := c.routes.Match(req.URL.Path)
+	if !ok {
+		c.sendErrorPage(data, tunnel.ErrorPageNoRoute)
+		return fmt.Errorf("no route for path %s", req.URL.Path)
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"route":    route.Path,
+		"upstream": route.Upstream,
+		"path":     path,
+	}).Debug("Routed request")
+
+	if path == req.URL.Path && c.config.HostHeader == "" {
+		return c.forwardRequest(route.Upstream, req, data, data)
+	}
+
+	req.URL.Path = path
+	req.URL.RawPath = ""
+	if c.config.HostHeader == "" {
+		encoded, err := tunnel.EncodeRequest(req)
+		if err != nil {
+			return err
+		}
+		return c.forwardRequest(route.Upstream, req, encoded, data)
+	}
+
+	return c.forwardWithHost(route.Upstream, req, data)
+}
+
+// forwardRequest writes the encoded request req to the local service at
+// upstream and streams the whole response back through the tunnel
+func (c *Client) forwardRequest(upstream string, req *http.Request, encoded, data []byte) error {
+	conn, err := c.dialLocal(upstream, data)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(encoded); err != nil {
+		return fmt.Errorf("failed to write to local service: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("failed to read from local service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	n, err := c.sendResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"bytes_sent":     len(encoded),
+		"bytes_received": n,
+	}).Debug("Forwarded traffic")
+
+	return nil
+}
+
+// sendResponse streams resp through the tunnel and returns its size
+func (c *Client) sendResponse(resp *http.Response) (int64, error) {
+	w := &tunnelWriter{conn: c.conn}
+	buf := bufio.NewWriterSize(w, responseChunkSize)
+	if err := resp.Write(buf); err != nil {
+		return w.written, fmt.Errorf("failed to send response through tunnel: %w", err)
+	}
+	if err := buf.Flush(); err != nil {
+		return w.written, fmt.Errorf("failed to send response through tunnel: %w", err)
+	}
+	return w.written, nil
+}
+
+// responseChunkSize bounds the tunnel messages responses are split into,
+// so each fits the buffer the server reads them with
+const responseChunkSize = 16 * 1024
+
+// tunnelWriter sends what is written to it through the tunnel as binary
+// messages of at most responseChunkSize bytes
+type tunnelWriter struct {
+	conn    *websocket.Conn
+	written int64
+}
+
+func (w *tunnelWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), responseChunkSize)]
+		if err := w.conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		w.written += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// forwardWithHost sends req to upstream with its Host header rewritten and
+// points redirects in the response back at the public host
+func (c *Client) forwardWithHost(upstream string, req *http.Request, data []byte) error {
+	host := c.config.HostHeader
+	if host == tunnel.HostHeaderRewrite {
+		host, _ = tunnel.SplitUpstream(upstream)
+	}
+	publicScheme := c.publicScheme(req)
+	publicHost := tunnel.RewriteHost(req, host)
+
+	encoded, err := tunnel.EncodeRequest(req)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.dialLocal(upstream, data)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(encoded); err != nil {
+		return fmt.Errorf("failed to write to local service: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("failed to read from local service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	tunnel.RewriteLocation(resp.Header, host, publicScheme, publicHost)
+
+	n, err := c.sendResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"host":           host,
+		"bytes_sent":     len(encoded),
+		"bytes_received": n,
+	}).Debug("Forwarded traffic")
+
+	return nil
+}
+
+// dialLocal connects to the local service at upstream, wrapping the
+// connection in TLS for https:// upstreams, and answers the visitor with an
+// error page when it is unreachable
+func (c *Client) dialLocal(upstream string, data []byte) (net.Conn, error) {
+	addr, useTLS := tunnel.SplitUpstream(upstream)
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		c.sendErrorPage(data, tunnel.ErrorPageLocalRefused)
+		return nil, fmt.Errorf("%w: %v", tunnel.ErrLocalServiceUnavailable, err)
+	}
+	if !useTLS {
+		return conn, nil
+	}
+
+	config := c.upstreamTLS.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		c.sendErrorPage(data, tunnel.ErrorPageLocalRefused)
+		return nil, fmt.Errorf("%w: TLS handshake with %s failed: %v", tunnel.ErrLocalServiceUnavailable, addr, err)
+	}
+	return tlsConn, nil
+}
+
+// publicScheme returns the scheme visitors used to reach the tunnel
+func (c *Client) publicScheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if u, err := url.Parse(c.publicURL); err == nil && u.Scheme != "" {
+		return u.Scheme
+	}
+	if c.config.UseTLS {
+		return "https"
+	}
+	return "http"
+}
+
+// localAddr returns the address of the default local service
+func (c *Client) localAddr() string {
+	return net.JoinHostPort(c.config.LocalHost, strconv.Itoa(c.config.LocalPort))
+}
+
+// localUpstream returns the default local service as a route upstream
+func (c *Client) localUpstream() string {
+	if c.config.LocalHTTPS {
+		return "https://" + c.localAddr()
+	}
+	return c.localAddr()
+}
+
+// sendErrorPage answers an HTTP request received through the tunnel with
+// one of the error pages, so visitors are told what went wrong
+func (c *Client) sendErrorPage(data []byte, kind tunnel.ErrorPageKind) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		// Not an HTTP request; raw TCP visitors just see the connection close
+		return
+	}
+
+	page := tunnel.NewErrorPageData(kind, req.Host, c.config.Subdomain)
+	resp := c.errorPages.Response(req, page)
+
+	var buf bytes.Buffer
+	if err := resp.Write(&buf); err != nil {
+		c.logger.WithError(err).Debug("Failed to encode error page")
+		return
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		c.logger.WithError(err).Debug("Failed to send error page through tunnel")
+	}
+}
+
 // handleIncomingRequest handles incoming HTTP requests from the tunnel server
 func (c *Client) handleIncomingRequest(req *http.Request) (*http.Response, error) {
 	// Create HTTP client
@@ -366,6 +1077,6 @@ func (c *Client) handleIncomingRequest(req *http.Request) (*http.Response, error
 
 // createLocalListener creates a local listener for testing
 func (c *Client) createLocalListener() (net.Listener, error) {
-	localAddr := fmt.Sprintf("%s:%d", c.config.LocalHost, c.config.LocalPort)
+	localAddr := net.JoinHostPort(c.config.LocalHost, strconv.Itoa(c.config.LocalPort))
 	return net.Listen("tcp", localAddr)
 } 
\ No newline at end of file
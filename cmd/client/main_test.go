@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestClient creates a client whose tunnel connection ends in a test
+// server. What the client sends through the tunnel can be read from the
+// returned reader.
+func newTestClient(t *testing.T, config *Config) (*Client, io.Reader) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// Fail reads instead of hanging when a response comes back incomplete
+	received, sent := io.Pipe()
+	timer := time.AfterFunc(10*time.Second, func() {
+		sent.CloseWithError(errors.New("timed out waiting for the tunnel"))
+	})
+	t.Cleanup(func() { timer.Stop() })
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				sent.CloseWithError(err)
+				return
+			}
+			sent.Write(message)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the test server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := NewClient(config, logger)
+	c.conn = conn
+	routes, err := tunnel.NewRouteTable([]tunnel.Route{{Path: "/*", Upstream: c.localUpstream()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.routes = routes
+	return c, received
+}
+
+// serveTestDir serves dir like --dir and returns the config pointing at it
+func serveTestDir(t *testing.T, dir string) *Config {
+	t.Helper()
+	listener, err := tunnel.ServeStatic(dir, false)
+	if err != nil {
+		t.Fatalf("ServeStatic failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	addr := listener.Addr().(*net.TCPAddr)
+	return &Config{LocalHost: addr.IP.String(), LocalPort: addr.Port, Subdomain: "demo"}
+}
+
+func TestForwardToLocal_LargeStaticFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	if err := os.WriteFile(filepath.Join(dir, "big.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, received := newTestClient(t, serveTestDir(t, dir))
+	responses := bufio.NewReader(received)
+
+	// Like the client's read loop, forward one request at a time
+	done := make(chan struct{})
+	close(done)
+	forward := func(request string) *http.Response {
+		t.Helper()
+		<-done
+		done = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			if err := c.forwardToLocal([]byte(request)); err != nil {
+				t.Errorf("forwardToLocal failed: %v", err)
+			}
+		}(done)
+		resp, err := http.ReadResponse(responses, nil)
+		if err != nil {
+			t.Fatalf("failed to read the forwarded response: %v", err)
+		}
+		return resp
+	}
+
+	resp := forward("GET /big.txt HTTP/1.1\r\nHost: demo.example.test\r\n\r\n")
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("expected all %d bytes, got %s with %d bytes", len(content), resp.Status, len(body))
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("expected a text/plain content type, got %q", got)
+	}
+
+	resp = forward("GET /big.txt HTTP/1.1\r\nHost: demo.example.test\r\nRange: bytes=60000-60009\r\n\r\n")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[60000:60010]) {
+		t.Errorf("expected the requested range, got %s %q", resp.Status, body)
+	}
+}
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestForwardToLocal_CustomErrorPage(t *testing.T) {
+	dir := t.TempDir()
+	page := `<h1>{{.Title}}</h1><p>Start the app behind {{.Host}}</p>`
+	if err := os.WriteFile(filepath.Join(dir, "local_refused.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := closedPort(t)
+	c, received := newTestClient(t, &Config{
+		ServerAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		LocalHost:  "127.0.0.1",
+		LocalPort:  port,
+		Subdomain:  "demo",
+		ErrorPages: dir,
+	})
+
+	// The templates are loaded before connecting, which fails here
+	if err := c.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Fatalf("expected the connection to fail, got %v", err)
+	}
+
+	go c.forwardToLocal([]byte("GET / HTTP/1.1\r\nHost: demo.example.test\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(received), nil)
+	if err != nil {
+		t.Fatalf("failed to read the error page: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	want := "<h1>Local service unavailable</h1><p>Start the app behind demo.example.test</p>"
+	if resp.StatusCode != http.StatusBadGateway || string(body) != want {
+		t.Errorf("expected the custom page, got %s %q", resp.Status, body)
+	}
+}
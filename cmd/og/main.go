@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"strings"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"syscall"
 
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
 	"github.com/urfave/cli/v2"
 )
 
@@ -26,7 +30,7 @@ func main() {
 					{
 						Name:  "http",
 						Usage: "Tunnel HTTP traffic",
-						Flags: []cli.Flag{
+						Flags: append([]cli.Flag{
 							&cli.StringFlag{
 								Name:    "subdomain",
 								Aliases: []string{"s"},
@@ -49,25 +53,48 @@ func main() {
 								Aliases: []string{"t"},
 								Usage:   "Authentication token",
 							},
-						},
+							&cli.StringFlag{
+								Name:    "identity",
+								Aliases: []string{"i"},
+								Usage:   "Ed25519 identity key to authenticate with (default: the key from 'og auth keygen', if any)",
+							},
+							&cli.StringFlag{
+								Name:    "dir",
+								Aliases: []string{"d"},
+								Usage:   "Serve files from this directory instead of a local port",
+							},
+							&cli.BoolFlag{
+								Name:  "dir-listing",
+								Usage: "Show listings for directories without an index.html",
+							},
+						}, clientTLSFlags()...),
 						Action: func(c *cli.Context) error {
+							subdomain := c.String("subdomain")
+							server := c.String("server")
+							token := c.String("token")
+							identity := identityFile(c)
+
+							if dir := c.String("dir"); dir != "" {
+								if c.NArg() > 0 {
+									return fmt.Errorf("port and --dir are mutually exclusive")
+								}
+								return startStaticTunnel(dir, c.Bool("dir-listing"), subdomain, server, token, identity, clientTLSOptions(c))
+							}
+
 							if c.NArg() < 1 {
 								return fmt.Errorf("port is required")
 							}
 
 							port := c.Args().Get(0)
-							subdomain := c.String("subdomain")
 							host := c.String("host")
-							server := c.String("server")
-							token := c.String("token")
 
-							return startHTTPTunnel(port, subdomain, host, server, token)
+							return startHTTPTunnel(port, subdomain, host, server, token, identity, clientTLSOptions(c))
 						},
 					},
 					{
 						Name:  "tcp",
 						Usage: "Tunnel TCP traffic",
-						Flags: []cli.Flag{
+						Flags: append([]cli.Flag{
 							&cli.StringFlag{
 								Name:    "subdomain",
 								Aliases: []string{"s"},
@@ -90,7 +117,12 @@ func main() {
 								Aliases: []string{"t"},
 								Usage:   "Authentication token",
 							},
-						},
+							&cli.StringFlag{
+								Name:    "identity",
+								Aliases: []string{"i"},
+								Usage:   "Ed25519 identity key to authenticate with (default: the key from 'og auth keygen', if any)",
+							},
+						}, clientTLSFlags()...),
 						Action: func(c *cli.Context) error {
 							if c.NArg() < 1 {
 								return fmt.Errorf("port is required")
@@ -102,7 +134,7 @@ func main() {
 							server := c.String("server")
 							token := c.String("token")
 
-							return startTCPTunnel(port, subdomain, host, server, token)
+							return startTCPTunnel(port, subdomain, host, server, token, identityFile(c), clientTLSOptions(c))
 						},
 					},
 				},
@@ -127,6 +159,30 @@ func main() {
 							return login(server)
 						},
 					},
+					{
+						Name:  "keygen",
+						Usage: "Generate an Ed25519 identity key for servers to authorize",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Private key file (default: ~/.gotunnel/id_ed25519)",
+							},
+							&cli.StringFlag{
+								Name:    "comment",
+								Aliases: []string{"C"},
+								Usage:   "Key comment, which servers use as the user name (default: user@host)",
+							},
+							&cli.BoolFlag{
+								Name:    "force",
+								Aliases: []string{"f"},
+								Usage:   "Overwrite an existing key",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							return generateIdentity(c.String("output"), c.String("comment"), c.Bool("force"))
+						},
+					},
 					{
 						Name:  "logout",
 						Usage: "Logout from GoTunnel",
@@ -154,7 +210,7 @@ func main() {
 				Name:  "version",
 				Usage: "Show version information",
 				Action: func(c *cli.Context) error {
-					fmt.Printf("og version %s\n", app.Version)
+					fmt.Printf("og version %s\n", c.App.Version)
 					return nil
 				},
 			},
@@ -174,7 +230,7 @@ func main() {
 	}
 }
 
-func startHTTPTunnel(port, subdomain, host, server, token string) error {
+func startHTTPTunnel(port, subdomain, host, server, token, identity string, tlsOptions tunnel.ClientTLSOptions) error {
 	fmt.Printf("🚀 Starting HTTP tunnel to %s:%s\n", host, port)
 	
 	if subdomain != "" {
@@ -187,7 +243,7 @@ func startHTTPTunnel(port, subdomain, host, server, token string) error {
 	fmt.Printf("⏳ Connecting...\n")
 
 	// Create tunnel client
-	client := NewTunnelClient(server, token)
+	client := NewTunnelClient(server, token, identity, tlsOptions)
 	
 	// Start tunnel
 	ctx, cancel := context.WithCancel(context.Background())
@@ -212,7 +268,53 @@ func startHTTPTunnel(port, subdomain, host, server, token string) error {
 	return nil
 }
 
-func startTCPTunnel(port, subdomain, host, server, token string) error {
+func startStaticTunnel(dir string, listing bool, subdomain, server, token, identity string, tlsOptions tunnel.ClientTLSOptions) error {
+	fmt.Printf("🚀 Starting HTTP tunnel serving %s\n", dir)
+
+	if subdomain != "" {
+		fmt.Printf("📍 Subdomain: %s\n", subdomain)
+	} else {
+		fmt.Printf("📍 Subdomain: auto-assigned\n")
+	}
+
+	fmt.Printf("🌐 Server: %s\n", server)
+	fmt.Printf("⏳ Connecting...\n")
+
+	// Serve the directory from this process
+	listener, err := tunnel.ServeStatic(dir, listing)
+	if err != nil {
+		return fmt.Errorf("failed to serve %s: %w", dir, err)
+	}
+	defer listener.Close()
+
+	// Create tunnel client
+	client := NewTunnelClient(server, token, identity, tlsOptions)
+
+	// Start tunnel
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		fmt.Println("\n🛑 Shutting down tunnel...")
+		cancel()
+	}()
+
+	// Tunnel to the in-process file server like any local service
+	addr := listener.Addr().(*net.TCPAddr)
+	err = client.StartHTTPTunnel(ctx, addr.IP.String(), strconv.Itoa(addr.Port), subdomain)
+	if err != nil {
+		return fmt.Errorf("failed to start tunnel: %w", err)
+	}
+
+	return nil
+}
+
+func startTCPTunnel(port, subdomain, host, server, token, identity string, tlsOptions tunnel.ClientTLSOptions) error {
 	fmt.Printf("🚀 Starting TCP tunnel to %s:%s\n", host, port)
 	
 	if subdomain != "" {
@@ -225,7 +327,7 @@ func startTCPTunnel(port, subdomain, host, server, token string) error {
 	fmt.Printf("⏳ Connecting...\n")
 
 	// Create tunnel client
-	client := NewTunnelClient(server, token)
+	client := NewTunnelClient(server, token, identity, tlsOptions)
 	
 	// Start tunnel
 	ctx, cancel := context.WithCancel(context.Background())
@@ -338,17 +440,132 @@ func showStatus() error {
 	return nil
 }
 
+// defaultIdentityFile returns where 'og auth keygen' stores the identity key
+func defaultIdentityFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".gotunnel", "id_ed25519"), nil
+}
+
+// identityFile returns the identity key given with --identity, or the
+// generated key when there is one
+func identityFile(c *cli.Context) string {
+	if c.IsSet("identity") {
+		return c.String("identity")
+	}
+	path, err := defaultIdentityFile()
+	if err != nil {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// generateIdentity writes a new identity key to path and its public key
+// next to it, and prints the line to add to a server's authorized keys
+func generateIdentity(path, comment string, force bool) error {
+	if path == "" {
+		var err error
+		if path, err = defaultIdentityFile(); err != nil {
+			return err
+		}
+	}
+	if comment == "" {
+		comment = defaultKeyComment()
+	}
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+
+	privateKey, publicKey, err := auth.GenerateIdentity(comment)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(path, privateKey, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := os.WriteFile(path+".pub", publicKey, 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+
+	signer, err := auth.LoadIdentity(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🔑 Identity key saved to %s\n", path)
+	fmt.Printf("🆔 Fingerprint: %s\n", auth.KeyFingerprint(signer.PublicKey()))
+	fmt.Println("Ask the server operator to add this line to the server's authorized keys:")
+	fmt.Print(string(publicKey))
+	return nil
+}
+
+// defaultKeyComment returns user@host, like ssh-keygen
+func defaultKeyComment() string {
+	comment := "og"
+	if u, err := user.Current(); err == nil {
+		comment = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		comment += "@" + host
+	}
+	return comment
+}
+
+// clientTLSFlags returns the flags controlling how the server certificate
+// is verified and which client certificate is presented for mutual TLS
+func clientTLSFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "ca",
+			Usage: "CA bundle to verify the server certificate with",
+		},
+		&cli.StringSliceFlag{
+			Name:  "pin",
+			Usage: "Trust only a server certificate with this SHA-256 fingerprint, or a public key pinned as sha256/<base64>",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "Client certificate file for mutual TLS authentication",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "Client certificate key file",
+		},
+	}
+}
+
+// clientTLSOptions reads the flags added by clientTLSFlags
+func clientTLSOptions(c *cli.Context) tunnel.ClientTLSOptions {
+	return tunnel.ClientTLSOptions{
+		CAFile:   c.String("ca"),
+		Pins:     c.StringSlice("pin"),
+		CertFile: c.String("cert"),
+		KeyFile:  c.String("key"),
+	}
+}
+
 // TunnelClient represents a tunnel client
 type TunnelClient struct {
-	server string
-	token  string
+	server     string
+	token      string
+	identity   string
+	tlsOptions tunnel.ClientTLSOptions
 }
 
 // NewTunnelClient creates a new tunnel client
-func NewTunnelClient(server, token string) *TunnelClient {
+func NewTunnelClient(server, token, identity string, tlsOptions tunnel.ClientTLSOptions) *TunnelClient {
 	return &TunnelClient{
-		server: server,
-		token:  token,
+		server:     server,
+		token:      token,
+		identity:   identity,
+		tlsOptions: tlsOptions,
 	}
 }
 
@@ -356,6 +573,14 @@ func NewTunnelClient(server, token string) *TunnelClient {
 func (tc *TunnelClient) StartHTTPTunnel(ctx context.Context, host, port, subdomain string) error {
 	// Implementation would connect to the tunnel server
 	// and establish the tunnel connection
+	if _, err := tunnel.NewClientTLSConfig(tc.tlsOptions); err != nil {
+		return err
+	}
+	if tc.identity != "" {
+		if _, err := auth.LoadIdentity(tc.identity); err != nil {
+			return err
+		}
+	}
 	
 	fmt.Printf("✅ Tunnel established!\n")
 	fmt.Printf("🌐 Public URL: https://%s.tunnel.gotunnel.com\n", subdomain)
@@ -371,6 +596,14 @@ func (tc *TunnelClient) StartHTTPTunnel(ctx context.Context, host, port, subdoma
 func (tc *TunnelClient) StartTCPTunnel(ctx context.Context, host, port, subdomain string) error {
 	// Implementation would connect to the tunnel server
 	// and establish the tunnel connection
+	if _, err := tunnel.NewClientTLSConfig(tc.tlsOptions); err != nil {
+		return err
+	}
+	if tc.identity != "" {
+		if _, err := auth.LoadIdentity(tc.identity); err != nil {
+			return err
+		}
+	}
 	
 	fmt.Printf("✅ Tunnel established!\n")
 	fmt.Printf("🌐 Public URL: tcp://%s.tunnel.gotunnel.com\n", subdomain)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ogrok/gotunnel/pkg/certs"
+)
+
+// newACMEManager creates the certificate manager from the server configuration
+func (s *Server) newACMEManager() (*certs.ACMEManager, error) {
+	config := certs.ACMEConfig{
+		Email:        s.config.ACMEEmail,
+		DirectoryURL: s.config.ACMEDirectory,
+		CacheDir:     s.config.ACMECacheDir,
+		BaseDomain:   s.config.Domain,
+		Domains:      s.config.ACMEDomains,
+		HostPolicy:   s.acmeHostPolicy,
+	}
+
+	if s.config.ACMEDNSHook != "" {
+		config.DNSProvider = &certs.ExecDNSProvider{Command: s.config.ACMEDNSHook}
+	}
+
+	if s.config.ACMECAFile != "" {
+		pool, err := loadCertPool(s.config.ACMECAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return certs.NewACMEManager(config, s.logger)
+}
+
+// acmeHostPolicy allows certificates for subdomains that have a tunnel or a
+// reservation, so visitors can't make the server request certificates for
+// arbitrary names
+func (s *Server) acmeHostPolicy(_ context.Context, host string) error {
+	host = strings.ToLower(host)
+	suffix := "." + strings.ToLower(s.config.Domain)
+	subdomain := strings.TrimSuffix(host, suffix)
+	if subdomain == host || subdomain == "" || strings.Contains(subdomain, ".") {
+		return fmt.Errorf("acme: host %q is not below %s", host, s.config.Domain)
+	}
+
+	if _, ok := s.handler.TunnelManager().GetTunnel(subdomain); ok {
+		return nil
+	}
+	if _, ok := s.reservations.Get(subdomain); ok {
+		return nil
+	}
+	return fmt.Errorf("acme: no tunnel for %q", host)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/sirupsen/logrus"
+)
+
+// createTokenRequest is the body of POST /admin/tokens
+type createTokenRequest struct {
+	Name string `json:"name"`
+	// ExpiresIn is a duration such as "720h"; empty uses defaultTokenExpiration
+	ExpiresIn string           `json:"expires_in"`
+	Scopes    auth.TokenScopes `json:"scopes"`
+}
+
+// createdToken is a token together with its value, which is only shown
+// once, when the token is created
+type createdToken struct {
+	*auth.Token
+	Value string `json:"token"`
+}
+
+// rotateTokenRequest is the body of POST /admin/tokens/{ref}/rotate
+type rotateTokenRequest struct {
+	// Overlap is a duration such as "1h" the old token stays valid for;
+	// empty uses defaultRotationOverlap
+	Overlap string `json:"overlap"`
+}
+
+// rotatedToken is the successor of a rotated token, together with its value
+type rotatedToken struct {
+	createdToken
+	PreviousID        string    `json:"previous_id"`
+	PreviousExpiresAt time.Time `json:"previous_expires_at"`
+	// Notified counts the connected clients sent the new token
+	Notified int `json:"notified"`
+}
+
+// tokenInfo is a token as returned by the admin API
+type tokenInfo struct {
+	*auth.Token
+	Status string `json:"status"`
+}
+
+// createAdminHandler creates the handler of the admin API. Every request
+// has to carry the admin token as a bearer token.
+func (s *Server) createAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tokens", s.handleListTokens)
+	mux.HandleFunc("POST /admin/tokens", s.handleCreateToken)
+	mux.HandleFunc("GET /admin/tokens/{ref}", s.handleInspectToken)
+	mux.HandleFunc("DELETE /admin/tokens/{ref}", s.handleRevokeToken)
+	mux.HandleFunc("POST /admin/tokens/{ref}/rotate", s.handleRotateToken)
+	mux.HandleFunc("GET /admin/lockouts", s.handleListLockouts)
+	mux.HandleFunc("DELETE /admin/lockouts", s.handleClearLockouts)
+	mux.HandleFunc("DELETE /admin/lockouts/{key...}", s.handleClearLockout)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gotunnel-admin"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleListTokens lists all tokens, including revoked and expired ones
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.tokens.AllTokens()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	infos := make([]tokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		infos = append(infos, tokenInfo{Token: token, Status: tokenStatus(token)})
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleCreateToken creates a token and returns it with its value
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req createTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	expiration := defaultTokenExpiration
+	if req.ExpiresIn != "" {
+		var err error
+		expiration, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiration <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid expires_in")
+			return
+		}
+	}
+
+	token, err := s.tokens.CreateToken(req.Name, expiration, req.Scopes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"token": shortTokenID(token.ID),
+		"name":  token.Name,
+	}).Info("Token created")
+	writeJSON(w, http.StatusCreated, createdToken{Token: token, Value: token.Value})
+}
+
+// handleInspectToken returns a token by ID, ID prefix or name
+func (s *Server) handleInspectToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.findAdminToken(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, tokenInfo{Token: token, Status: tokenStatus(token)})
+}
+
+// handleRevokeToken revokes a token and immediately disconnects its tunnels
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.findAdminToken(w, r)
+	if !ok {
+		return
+	}
+	if err := s.tokens.RevokeTokenID(token.ID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.logger.WithField("token", shortTokenID(token.ID)).Info("Token revoked")
+	s.checkTokenTunnels()
+
+	token.Active = false
+	writeJSON(w, http.StatusOK, tokenInfo{Token: token, Status: tokenStatus(token)})
+}
+
+// handleRotateToken replaces a token by a successor and sends it to the
+// clients of tunnels opened with the old token, now and when they connect
+// with it until it expires
+func (s *Server) handleRotateToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.findAdminToken(w, r)
+	if !ok {
+		return
+	}
+
+	req := rotateTokenRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+	}
+	overlap := defaultRotationOverlap
+	if req.Overlap != "" {
+		var err error
+		overlap, err = time.ParseDuration(req.Overlap)
+		if err != nil || overlap < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid overlap")
+			return
+		}
+	}
+
+	successor, old, err := s.tokens.RotateToken(token.ID, overlap)
+	if errors.Is(err, auth.ErrNotRotatable) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.rememberRotation(old, successor)
+	notified := s.pushRotatedToken(old, successor)
+	s.logger.WithFields(logrus.Fields{
+		"token":     shortTokenID(old.ID),
+		"successor": shortTokenID(successor.ID),
+		"notified":  notified,
+	}).Info("Token rotated")
+	writeJSON(w, http.StatusOK, rotatedToken{
+		createdToken:      createdToken{Token: successor, Value: successor.Value},
+		PreviousID:        old.ID,
+		PreviousExpiresAt: old.ExpiresAt,
+		Notified:          notified,
+	})
+}
+
+// handleListLockouts lists the IP addresses and identities currently
+// locked out after failed authentication attempts
+func (s *Server) handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts := []auth.Lockout{}
+	for _, tracker := range []*auth.LockoutTracker{s.ipLockouts, s.idLockouts} {
+		if tracker != nil {
+			lockouts = append(lockouts, tracker.Locked()...)
+		}
+	}
+	writeJSON(w, http.StatusOK, lockouts)
+}
+
+// handleClearLockouts lifts all lockouts
+func (s *Server) handleClearLockouts(w http.ResponseWriter, r *http.Request) {
+	cleared := 0
+	for _, tracker := range []*auth.LockoutTracker{s.ipLockouts, s.idLockouts} {
+		if tracker != nil {
+			cleared += tracker.ClearAll()
+		}
+	}
+
+	s.logger.WithField("cleared", cleared).Info("Lockouts cleared")
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": cleared})
+}
+
+// handleClearLockout lifts the lockout of one source, such as
+// "ip:192.0.2.1" or "identity:alice"
+func (s *Server) handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	tracker := s.lockoutTracker(key)
+	if tracker == nil || !tracker.Clear(key) {
+		writeJSONError(w, http.StatusNotFound, "no failed attempts recorded for "+key)
+		return
+	}
+
+	s.logger.WithField("source", key).Info("Lockout cleared")
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": 1})
+}
+
+// findAdminToken resolves the token referenced in the request path,
+// answering the request itself when there is none
+func (s *Server) findAdminToken(w http.ResponseWriter, r *http.Request) (*auth.Token, bool) {
+	token, err := s.tokens.FindToken(r.PathValue("ref"))
+	switch {
+	case errors.Is(err, auth.ErrTokenNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	case errors.Is(err, auth.ErrAmbiguousToken):
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return nil, false
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return token, true
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ogrok/gotunnel/pkg/auth"
+)
+
+// testAdminToken is the admin token of test servers
+const testAdminToken = "admin-secret"
+
+// newAdminTestServer creates a test server and its admin API handler
+func newAdminTestServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	s := newTestServer(t)
+	s.config.AdminToken = testAdminToken
+	return s, s.createAdminHandler()
+}
+
+// adminCall sends a request to the admin API, with in as JSON body unless
+// nil, decodes the response into out unless nil and returns its status
+func adminCall(t *testing.T, handler http.Handler, method, path string, in, out interface{}) int {
+	t.Helper()
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &body)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if out != nil && w.Code < http.StatusBadRequest {
+		if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: invalid response: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+// createTestToken creates a token through the token manager of s
+func createTestToken(t *testing.T, s *Server, name string) *auth.Token {
+	t.Helper()
+	token, err := s.tokens.CreateToken(name, time.Hour, auth.TokenScopes{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAdminAPI_RequiresAdminToken(t *testing.T) {
+	_, handler := newAdminTestServer(t)
+	for _, header := range []string{"", "Bearer wrong", testAdminToken} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/tokens", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: expected 401 with a challenge, got %d", header, w.Code)
+		}
+	}
+}
+
+func TestAdminAPI_ListTokens(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	active := createTestToken(t, s, "ci")
+	revoked := createTestToken(t, s, "old")
+	if err := s.tokens.RevokeTokenID(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []tokenInfo
+	if code := adminCall(t, handler, http.MethodGet, "/admin/tokens", nil, &tokens); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	status := make(map[string]string)
+	for _, token := range tokens {
+		status[token.ID] = token.Status
+	}
+	if len(tokens) != 2 || status[active.ID] != "active" || status[revoked.ID] != "revoked" {
+		t.Errorf("expected an active and a revoked token, got %v", status)
+	}
+}
+
+func TestAdminAPI_CreateToken(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+
+	var created createdToken
+	req := createTokenRequest{Name: "ci", ExpiresIn: "2h", Scopes: auth.TokenScopes{Subdomains: []string{"ci-*"}}}
+	if code := adminCall(t, handler, http.MethodPost, "/admin/tokens", req, &created); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	token, ok := s.tokens.ValidateToken(created.Value)
+	if !ok || token.ID != created.ID || token.Name != "ci" || len(token.Scopes.Subdomains) != 1 {
+		t.Fatalf("returned value doesn't authenticate the created token: %+v", token)
+	}
+	if until := time.Until(token.ExpiresAt); until < time.Hour || until > 2*time.Hour {
+		t.Errorf("expected the token to expire in 2h, expires in %s", until)
+	}
+
+	if code := adminCall(t, handler, http.MethodPost, "/admin/tokens", createTokenRequest{ExpiresIn: "-1h"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative expiration, got %d", code)
+	}
+}
+
+func TestAdminAPI_InspectToken(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	token := createTestToken(t, s, "ci")
+
+	for _, ref := range []string{token.ID, token.ID[:8], "ci"} {
+		var info tokenInfo
+		if code := adminCall(t, handler, http.MethodGet, "/admin/tokens/"+ref, nil, &info); code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", ref, code)
+		}
+		if info.ID != token.ID || info.Status != "active" {
+			t.Errorf("%s: expected the active token, got %+v", ref, info)
+		}
+	}
+	if code := adminCall(t, handler, http.MethodGet, "/admin/tokens/missing", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown token, got %d", code)
+	}
+}
+
+func TestAdminAPI_RevokeToken(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	token := createTestToken(t, s, "ci")
+
+	var info tokenInfo
+	if code := adminCall(t, handler, http.MethodDelete, "/admin/tokens/"+token.ID, nil, &info); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if info.Status != "revoked" {
+		t.Errorf("expected the token to be reported revoked, got %q", info.Status)
+	}
+	if _, ok := s.tokens.ValidateToken(token.Value); ok {
+		t.Error("revoked token still authenticates")
+	}
+}
+
+func TestAdminAPI_RotateToken(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	token := createTestToken(t, s, "ci")
+
+	var rotated rotatedToken
+	path := "/admin/tokens/" + token.ID + "/rotate"
+	if code := adminCall(t, handler, http.MethodPost, path, rotateTokenRequest{Overlap: "5m"}, &rotated); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if rotated.PreviousID != token.ID || rotated.Notified != 0 {
+		t.Errorf("unexpected rotation result: %+v", rotated)
+	}
+	if time.Until(rotated.PreviousExpiresAt) > 5*time.Minute {
+		t.Errorf("expected the old token to expire within the overlap, expires %s", rotated.PreviousExpiresAt)
+	}
+	successor, ok := s.tokens.ValidateToken(rotated.Value)
+	if !ok || successor.OwnerName() != token.OwnerName() {
+		t.Fatalf("successor doesn't authenticate as the same owner: %+v", successor)
+	}
+
+	if code := adminCall(t, handler, http.MethodPost, path, nil, nil); code != http.StatusConflict {
+		t.Errorf("expected 409 rotating a rotated token, got %d", code)
+	}
+}
+
+func TestAdminAPI_ListLockouts(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	s.ipLockouts = auth.NewLockoutTracker(auth.LockoutPolicy{Threshold: 1, Duration: time.Minute})
+	s.ipLockouts.Fail("ip:192.0.2.1")
+
+	var lockouts []auth.Lockout
+	if code := adminCall(t, handler, http.MethodGet, "/admin/lockouts", nil, &lockouts); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(lockouts) != 1 || lockouts[0].Key != "ip:192.0.2.1" || lockouts[0].Until.IsZero() {
+		t.Errorf("expected the locked out address, got %+v", lockouts)
+	}
+}
+
+func TestAdminAPI_ClearLockouts(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	policy := auth.LockoutPolicy{Threshold: 1, Duration: time.Minute}
+	s.ipLockouts = auth.NewLockoutTracker(policy)
+	s.idLockouts = auth.NewLockoutTracker(policy)
+	s.ipLockouts.Fail("ip:192.0.2.1")
+	s.idLockouts.Fail("identity:alice")
+
+	var result map[string]int
+	if code := adminCall(t, handler, http.MethodDelete, "/admin/lockouts", nil, &result); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if result["cleared"] != 2 || len(s.ipLockouts.Locked())+len(s.idLockouts.Locked()) != 0 {
+		t.Errorf("expected both lockouts to be cleared, got %v", result)
+	}
+}
+
+func TestAdminAPI_ClearLockout(t *testing.T) {
+	s, handler := newAdminTestServer(t)
+	s.idLockouts = auth.NewLockoutTracker(auth.LockoutPolicy{Threshold: 1, Duration: time.Minute})
+	s.idLockouts.Fail("identity:alice")
+	s.idLockouts.Fail("identity:bob")
+
+	if code := adminCall(t, handler, http.MethodDelete, "/admin/lockouts/identity:alice", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if locked := s.idLockouts.Locked(); len(locked) != 1 || locked[0].Key != "identity:bob" {
+		t.Errorf("expected only bob to stay locked out, got %+v", locked)
+	}
+	if code := adminCall(t, handler, http.MethodDelete, "/admin/lockouts/ip:192.0.2.1", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a source without failures, got %d", code)
+	}
+}
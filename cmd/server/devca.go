@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ogrok/gotunnel/pkg/certs"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultDevCADir is where the development CA is stored by default
+const defaultDevCADir = "dev-ca"
+
+// devCACommand returns the commands managing the development CA
+func devCACommand() *cli.Command {
+	dirFlag := &cli.StringFlag{
+		Name:  "dev-ca-dir",
+		Value: defaultDevCADir,
+		Usage: "Directory storing the development CA",
+	}
+
+	return &cli.Command{
+		Name:  "dev-ca",
+		Usage: "Manage the local development CA",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "export",
+				Usage: "Print or save the root certificate so clients and browsers can trust it",
+				Flags: []cli.Flag{
+					dirFlag,
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Write the certificate to this file instead of stdout",
+					},
+					&cli.StringFlag{
+						Name:  "domain",
+						Usage: "Base domain, used when the CA has to be created first",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					ca, err := certs.LoadOrCreateDevCA(c.String("dev-ca-dir"), c.String("domain"))
+					if err != nil {
+						return err
+					}
+
+					output := c.String("output")
+					if output == "" {
+						_, err := os.Stdout.Write(ca.CertificatePEM())
+						return err
+					}
+					if err := os.WriteFile(output, ca.CertificatePEM(), 0644); err != nil {
+						return fmt.Errorf("failed to write certificate: %w", err)
+					}
+					fmt.Printf("Wrote development CA certificate to %s\n", output)
+					return nil
+				},
+			},
+		},
+	}
+}
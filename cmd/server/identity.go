@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/ogrok/gotunnel/pkg/users"
+	"github.com/sirupsen/logrus"
+)
+
+// tokenCheckInterval is how often open tunnels are checked against their tokens
+const tokenCheckInterval = 30 * time.Second
+
+// errTokenNotProven rejects tokens sent to a server requiring challenges
+var errTokenNotProven = errors.New("tokens have to be proven by auth challenge instead of being sent, upgrade the client or drop --bearer-auth and --legacy-auth")
+
+// challengeTimeout is how long a client has to answer an auth challenge
+const challengeTimeout = 10 * time.Second
+
+// clientIdentity describes who opened a tunnel
+type clientIdentity struct {
+	// Owner binds reservations and live tunnels to the client
+	Owner string
+	// Cert is set for clients authenticated by a client certificate
+	Cert *auth.CertIdentity
+	// Auth is set for clients authenticated by the server's Authenticator
+	Auth *auth.Identity
+	// User is set for clients authenticated by a user API key or JWT
+	User *users.User
+}
+
+// scopes returns the limits of the client's token, none for other identities
+func (c *clientIdentity) scopes() auth.TokenScopes {
+	if c.Auth == nil {
+		return auth.TokenScopes{}
+	}
+	return c.Auth.Scopes
+}
+
+// userAccounts resolves the user accounts of API keys and JWTs, as
+// *users.UserManager does. The account has to be active.
+type userAccounts interface {
+	AuthenticateCredential(credential string) (*users.User, error)
+}
+
+// newAuthenticator combines the tokens of simple with the authentication
+// backends enabled in config. Backends are asked in order: generated and
+// allowed tokens, the static token file, htpasswd, then the webhook.
+func newAuthenticator(config *tunnel.ServerConfig, simple *auth.SimpleAuth) (auth.Authenticator, error) {
+	chain := auth.Chain{simple.Authenticator()}
+
+	if config.StaticTokensFile != "" {
+		tokens, err := auth.LoadStaticTokens(config.StaticTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		static, err := auth.NewStaticTokenAuth(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static tokens: %w", err)
+		}
+		chain = append(chain, static)
+	}
+
+	if config.HtpasswdFile != "" {
+		htpasswd, err := auth.NewHtpasswdAuth(config.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, htpasswd)
+	}
+
+	if config.AuthWebhookURL != "" {
+		chain = append(chain, auth.NewWebhookAuth(config.AuthWebhookURL, config.AuthWebhookSecret))
+	}
+
+	return chain, nil
+}
+
+// authenticateTunnel identifies the owner of a tunnel connection. A client
+// certificate verified during the TLS handshake takes precedence over the
+// auth token; when client certificates are required the token is ignored.
+// Clients asking for challenge authentication prove they hold their token
+// over conn instead of sending it. The username or key the client claims is
+// recorded in attempt.
+func (s *Server) authenticateTunnel(r *http.Request, conn *websocket.Conn, attempt *authAttempt) (*clientIdentity, error) {
+	if cert := s.tunnelClientCert(r); cert != nil && s.clientCerts != nil {
+		identity, err := s.clientCerts.Identify(cert)
+		if err != nil {
+			return nil, err
+		}
+		return &clientIdentity{Owner: auth.CertOwner(identity), Cert: identity}, nil
+	}
+	if s.config.RequireClientCert {
+		return nil, fmt.Errorf("a client certificate is required")
+	}
+
+	creds := auth.Credentials{RemoteIP: remoteIP(r)}
+
+	// Passwords and credentials that can't be proven by challenge, such as
+	// user API keys and JWTs, come in the Authorization header. With
+	// RequireChallengeAuth these are the only credentials accepted there:
+	// tokens, sent as bearer or as a password without username, have to be
+	// proven by challenge.
+	if username, password, ok := r.BasicAuth(); ok {
+		if username == "" && s.config.RequireChallengeAuth {
+			return nil, errTokenNotProven
+		}
+		creds.Username, creds.Secret = username, password
+		attempt.Identity = username
+		return s.authenticateCredentials(r, creds)
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if s.users != nil && users.IsUserCredential(bearer) {
+			identity, err := s.authenticateUser(bearer)
+			// A tunnel token may happen to start like an API key
+			if err == nil || errors.Is(err, users.ErrUserInactive) {
+				return identity, err
+			}
+		}
+		if s.config.RequireChallengeAuth {
+			return nil, errTokenNotProven
+		}
+		creds.Secret = bearer
+		return s.authenticateCredentials(r, creds)
+	}
+
+	if r.URL.Query().Get("auth") == "challenge" {
+		return s.challengeTunnel(r, conn)
+	}
+	if s.config.RequireChallengeAuth {
+		return nil, errTokenNotProven
+	}
+
+	authToken := r.URL.Query().Get("token")
+	if authToken == "" {
+		return nil, fmt.Errorf("auth token is required")
+	}
+	if s.users != nil && users.IsUserCredential(authToken) {
+		return s.authenticateUser(authToken)
+	}
+	creds.Secret = authToken
+	return s.authenticateCredentials(r, creds)
+}
+
+// authenticateCredentials checks credentials with the server's Authenticator
+func (s *Server) authenticateCredentials(r *http.Request, creds auth.Credentials) (*clientIdentity, error) {
+	identity, err := s.authenticator.Authenticate(r.Context(), creds)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		s.logger.WithError(err).WithField("username", creds.Username).Debug("Credentials rejected")
+		return nil, credentialError("invalid auth token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &clientIdentity{Owner: identity.Name, Auth: identity}, nil
+}
+
+// authenticateUser resolves the user account of an API key or JWT
+func (s *Server) authenticateUser(credential string) (*clientIdentity, error) {
+	user, err := s.users.AuthenticateCredential(credential)
+	if errors.Is(err, users.ErrUserInactive) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, credentialError("invalid user credentials")
+	}
+	return &clientIdentity{Owner: user.Owner(), User: user}, nil
+}
+
+// challengeTunnel sends the client a nonce and verifies the signature it
+// answers with over the nonce and the parameters of the connection. Clients
+// sign with the key of their token, or with an identity key listed in the
+// authorized keys file.
+func (s *Server) challengeTunnel(r *http.Request, conn *websocket.Conn) (*clientIdentity, error) {
+	challenger, _ := s.authenticator.(auth.ChallengeAuthenticator)
+	if challenger == nil && s.keys == nil {
+		return nil, fmt.Errorf("challenge authentication is not supported, send the token in the Authorization header")
+	}
+
+	nonce, err := auth.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteJSON(tunnel.AuthChallenge{Type: tunnel.MessageTypeChallenge, Nonce: nonce}); err != nil {
+		return nil, fmt.Errorf("failed to send auth challenge: %w", err)
+	}
+
+	var response tunnel.AuthResponse
+	conn.SetReadDeadline(time.Now().Add(challengeTimeout))
+	if err := conn.ReadJSON(&response); err != nil {
+		return nil, fmt.Errorf("failed to read challenge response: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	params := tunnel.ChallengeParams(r.Host, r.URL.Query())
+	var identity *auth.Identity
+	switch {
+	case response.Method == auth.ChallengeMethodToken && challenger != nil:
+		identity, err = challenger.AuthenticateChallenge(response.KeyID, nonce, params, response.Signature)
+		if errors.Is(err, auth.ErrInvalidProof) {
+			return nil, credentialError("invalid auth token")
+		}
+	case response.Method == auth.ChallengeMethodEd25519 && s.keys != nil:
+		identity, err = s.keys.AuthenticateKey(response.KeyID, nonce, params, response.Signature)
+		if errors.Is(err, auth.ErrInvalidProof) {
+			return nil, credentialError(fmt.Sprintf("identity key %s is not authorized", response.KeyID))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported challenge method %q", response.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &clientIdentity{Owner: identity.Name, Auth: identity}, nil
+}
+
+// registerTunnel checks t against the permissions of the client's identity
+// or the tunnel limit of its user, and adds it to the tunnel manager
+func (s *Server) registerTunnel(t *tunnel.Tunnel, identity *clientIdentity, ip net.IP) error {
+	s.registerMu.Lock()
+	defer s.registerMu.Unlock()
+
+	if id := identity.Auth; id != nil {
+		err := id.Authorize(auth.TunnelRequest{
+			Subdomain:   t.Subdomain,
+			Type:        t.Type,
+			RemoteIP:    ip,
+			OpenTunnels: s.countOwnerTunnels(identity.Owner, t.Subdomain),
+		})
+		if err != nil {
+			return err
+		}
+
+		if id.Token != nil {
+			t.TokenID = id.Token.ID
+		}
+		if limit := id.Scopes.MaxBandwidth; limit > 0 {
+			meter, ok := s.bandwidth[identity.Owner]
+			if !ok {
+				meter = tunnel.NewBandwidthMeter(limit)
+				s.bandwidth[identity.Owner] = meter
+			}
+			t.Bandwidth = meter
+		}
+	}
+
+	if user := identity.User; user != nil {
+		if user.MaxTunnels > 0 && s.countOwnerTunnels(identity.Owner, t.Subdomain) >= user.MaxTunnels {
+			return fmt.Errorf("%w (%d allowed)", users.ErrTooManyTunnels, user.MaxTunnels)
+		}
+		t.UserID = user.ID
+	}
+
+	return s.handler.RegisterTunnel(t)
+}
+
+// countOwnerTunnels counts the open tunnels of an owner, not counting one
+// on subdomain, which a new tunnel of the same owner replaces
+func (s *Server) countOwnerTunnels(owner, subdomain string) int {
+	count := 0
+	for _, t := range s.handler.TunnelManager().ListTunnels() {
+		if t.Owner == owner && t.Subdomain != subdomain && !t.IsClosed() {
+			count++
+		}
+	}
+	return count
+}
+
+// enforceTokens closes tunnels whose token expired, was revoked or deleted
+// while they were open
+func (s *Server) enforceTokens(ctx context.Context) {
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkTokenTunnels()
+		}
+	}
+}
+
+// checkTokenTunnels closes every tunnel whose token is no longer valid
+func (s *Server) checkTokenTunnels() {
+	for _, t := range s.handler.TunnelManager().ListTunnels() {
+		tokenID := t.CurrentTokenID()
+		if tokenID == "" {
+			continue
+		}
+
+		reason := ""
+		token, err := s.tokens.GetToken(tokenID)
+		switch {
+		case errors.Is(err, auth.ErrTokenNotFound):
+			reason = "token deleted"
+		case err != nil:
+			// Keep tunnels open while the store is unavailable
+			s.logger.WithError(err).Warn("Failed to check tunnel token")
+			continue
+		case !token.Active:
+			reason = "token revoked"
+		case time.Now().After(token.ExpiresAt):
+			reason = "token expired"
+		default:
+			continue
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"subdomain": t.Subdomain,
+			"owner":     t.Owner,
+			"reason":    reason,
+		}).Info("Disconnecting tunnel")
+		t.Close()
+	}
+}
+
+// pendingRotation is a token rotation still to be sent to clients
+// connecting with the old token
+type pendingRotation struct {
+	successorID string
+	message     tunnel.TokenRotated
+}
+
+// rotationMessage tells a client its token was rotated to successor
+func rotationMessage(old, successor *auth.Token) tunnel.TokenRotated {
+	return tunnel.TokenRotated{
+		Type:              tunnel.MessageTypeTokenRotated,
+		Token:             successor.Value,
+		ExpiresAt:         successor.ExpiresAt,
+		PreviousExpiresAt: old.ExpiresAt,
+	}
+}
+
+// rememberRotation keeps the successor of old until old expires, so
+// clients connecting with old in the meantime are sent it as well
+func (s *Server) rememberRotation(old, successor *auth.Token) {
+	s.rotationsMu.Lock()
+	defer s.rotationsMu.Unlock()
+
+	now := time.Now()
+	for id, rotation := range s.rotations {
+		if now.After(rotation.message.PreviousExpiresAt) {
+			delete(s.rotations, id)
+		}
+	}
+	s.rotations[old.ID] = pendingRotation{
+		successorID: successor.ID,
+		message:     rotationMessage(old, successor),
+	}
+}
+
+// sendPendingRotation sends the client of a new tunnel the successor of
+// its token when the token was rotated through the admin API, and binds
+// the tunnel to the successor
+func (s *Server) sendPendingRotation(t *tunnel.Tunnel) {
+	tokenID := t.CurrentTokenID()
+	if tokenID == "" {
+		return
+	}
+	s.rotationsMu.Lock()
+	rotation, ok := s.rotations[tokenID]
+	s.rotationsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	// The successor may have been revoked since
+	successor, err := s.tokens.GetToken(rotation.successorID)
+	if err != nil || !successor.Active || time.Now().After(successor.ExpiresAt) {
+		return
+	}
+	if err := t.SendControl(rotation.message); err != nil {
+		s.logger.WithError(err).WithField("subdomain", t.Subdomain).Warn("Failed to send rotated token")
+		return
+	}
+	t.UpdateTokenID(successor.ID)
+	s.logger.WithFields(logrus.Fields{
+		"subdomain": t.Subdomain,
+		"token":     shortTokenID(tokenID),
+		"successor": shortTokenID(successor.ID),
+	}).Info("Sent rotated token to client connecting with the old one")
+}
+
+// pushRotatedToken sends the successor of a rotated token to the clients
+// of tunnels opened with it, and binds their tunnels to the successor so
+// they stay open when the old token expires. It returns how many clients
+// were notified.
+func (s *Server) pushRotatedToken(old, successor *auth.Token) int {
+	message := rotationMessage(old, successor)
+
+	notified := 0
+	for _, t := range s.handler.TunnelManager().ListTunnels() {
+		if t.CurrentTokenID() != old.ID || t.IsClosed() {
+			continue
+		}
+		if err := t.SendControl(message); err != nil {
+			s.logger.WithError(err).WithField("subdomain", t.Subdomain).Warn("Failed to send rotated token")
+			continue
+		}
+		t.UpdateTokenID(successor.ID)
+		notified++
+	}
+	return notified
+}
+
+// remoteIP returns the IP address a request came from
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/ogrok/gotunnel/pkg/users"
+)
+
+// testUsers are user accounts by API key, checked like users.UserManager
+type testUsers map[string]*users.User
+
+func (u testUsers) AuthenticateCredential(credential string) (*users.User, error) {
+	user, ok := u[credential]
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+	if user.Status != "active" {
+		return nil, fmt.Errorf("%w: %s", users.ErrUserInactive, user.Status)
+	}
+	return user, nil
+}
+
+func TestTunnelAuth_InactiveUserRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.users = testUsers{
+		"gt_alice": {Username: "alice", Status: "active"},
+		"gt_bob":   {Username: "bob", Status: "suspended"},
+	}
+	url := startTestServer(t, s)
+
+	_, response := dialTunnel(t, websocket.DefaultDialer, url+"?subdomain=alice", bearerHeader("gt_alice"))
+	if !response.Success {
+		t.Fatalf("active user rejected: %s", response.Error)
+	}
+
+	// Suspended users are rejected whichever way they send their API key
+	for _, dial := range []struct {
+		query  string
+		bearer string
+	}{
+		{query: "?subdomain=bob", bearer: "gt_bob"},
+		{query: "?subdomain=bob&token=gt_bob"},
+	} {
+		var header http.Header
+		if dial.bearer != "" {
+			header = bearerHeader(dial.bearer)
+		}
+		_, response := dialTunnel(t, websocket.DefaultDialer, url+dial.query, header)
+		if response.Success || !strings.Contains(response.Error, users.ErrUserInactive.Error()) {
+			t.Errorf("%s: expected the suspended user to be rejected, got %+v", dial.query, response)
+		}
+	}
+	if _, ok := s.handler.TunnelManager().GetTunnel("bob"); ok {
+		t.Error("tunnel of a suspended user was registered")
+	}
+}
+
+func TestRotateToken_SentToClientsOfOldToken(t *testing.T) {
+	s, admin := newAdminTestServer(t)
+	token := createTestToken(t, s, "ci")
+	url := startTestServer(t, s)
+
+	readRotation := func(conn *websocket.Conn) tunnel.TokenRotated {
+		t.Helper()
+		var message tunnel.TokenRotated
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("failed to read the rotated token: %v", err)
+		}
+		return message
+	}
+
+	connected, response := dialTunnel(t, websocket.DefaultDialer, url+"?subdomain=connected", bearerHeader(token.Value))
+	if !response.Success {
+		t.Fatalf("tunnel rejected: %s", response.Error)
+	}
+
+	var rotated rotatedToken
+	if code := adminCall(t, admin, http.MethodPost, "/admin/tokens/"+token.ID+"/rotate", nil, &rotated); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if rotated.Notified != 1 {
+		t.Errorf("expected the connected client to be notified, got %d", rotated.Notified)
+	}
+	if message := readRotation(connected); message.Type != tunnel.MessageTypeTokenRotated || message.Token != rotated.Value {
+		t.Errorf("connected client wasn't sent the successor: %+v", message)
+	}
+
+	// A client still using the old token during the overlap gets it when
+	// it connects
+	late, response := dialTunnel(t, websocket.DefaultDialer, url+"?subdomain=late", bearerHeader(token.Value))
+	if !response.Success {
+		t.Fatalf("old token rejected during the overlap: %s", response.Error)
+	}
+	if message := readRotation(late); message.Token != rotated.Value {
+		t.Errorf("client connecting with the old token wasn't sent the successor: %+v", message)
+	}
+
+	for _, subdomain := range []string{"connected", "late"} {
+		if tun, ok := s.handler.TunnelManager().GetTunnel(subdomain); !ok || tun.CurrentTokenID() != rotated.ID {
+			t.Errorf("tunnel %s isn't bound to the successor", subdomain)
+		}
+	}
+}
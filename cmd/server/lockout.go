@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// Prefixes of lockout keys, telling IP addresses from claimed identities
+const (
+	ipLockoutPrefix       = "ip:"
+	identityLockoutPrefix = "identity:"
+)
+
+// credentialError rejects credentials that were checked and found invalid.
+// Only these count as failed attempts towards a lockout; errors of the
+// server or of a backend don't.
+type credentialError string
+
+func (e credentialError) Error() string {
+	return string(e)
+}
+
+// authAttempt records what a client claimed to be while authenticating
+type authAttempt struct {
+	// Identity is the username the client claimed with a password, if any.
+	// Only passwords can be guessed, so key IDs and certificates aren't
+	// recorded: locking them out would only let anyone knowing a public key
+	// lock out its holder.
+	Identity string
+}
+
+// newLockoutTracker creates a tracker locking out sources after threshold
+// failures, or returns nil when threshold is zero
+func newLockoutTracker(config *tunnel.ServerConfig, threshold int) *auth.LockoutTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	return auth.NewLockoutTracker(auth.LockoutPolicy{
+		Threshold:   threshold,
+		Duration:    config.LockoutDuration,
+		MaxDuration: config.LockoutMaxDuration,
+	})
+}
+
+// authenticateClient authenticates a tunnel client like authenticateTunnel,
+// rejecting IP addresses and usernames locked out after too many failed
+// attempts. A locked out username is rejected even with the right password,
+// so guessing can't go on from other addresses.
+func (s *Server) authenticateClient(r *http.Request, conn *websocket.Conn) (*clientIdentity, error) {
+	keys := []string{ipLockoutPrefix + remoteIP(r).String()}
+	if err := s.checkLockout(keys[0]); err != nil {
+		return nil, err
+	}
+
+	attempt := &authAttempt{}
+	identity, err := s.authenticateTunnel(r, conn, attempt)
+	if attempt.Identity != "" {
+		key := identityLockoutPrefix + attempt.Identity
+		if err := s.checkLockout(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	var rejected credentialError
+	if errors.As(err, &rejected) {
+		for _, key := range keys {
+			s.recordAuthFailure(key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if tracker := s.lockoutTracker(key); tracker != nil {
+			tracker.Succeed(key)
+		}
+	}
+	return identity, nil
+}
+
+// lockoutTracker returns the tracker of a lockout key, nil when disabled
+func (s *Server) lockoutTracker(key string) *auth.LockoutTracker {
+	switch {
+	case strings.HasPrefix(key, ipLockoutPrefix):
+		return s.ipLockouts
+	case strings.HasPrefix(key, identityLockoutPrefix):
+		return s.idLockouts
+	default:
+		return nil
+	}
+}
+
+// checkLockout returns an error when key is locked out
+func (s *Server) checkLockout(key string) error {
+	tracker := s.lockoutTracker(key)
+	if tracker == nil {
+		return nil
+	}
+	until, locked := tracker.Check(key)
+	if !locked {
+		return nil
+	}
+	retry := time.Until(until).Round(time.Second)
+	return fmt.Errorf("too many failed authentication attempts, try again in %s", retry)
+}
+
+// recordAuthFailure counts a failed attempt of key and logs when it locks
+// the source out
+func (s *Server) recordAuthFailure(key string) {
+	tracker := s.lockoutTracker(key)
+	if tracker == nil {
+		return
+	}
+	lockout, locked := tracker.Fail(key)
+	if !locked {
+		return
+	}
+	s.logger.WithFields(logrus.Fields{
+		"source":   key,
+		"lockouts": lockout.Lockouts,
+		"until":    lockout.Until.Format(time.RFC3339),
+	}).Warn("Locked out authentication source after repeated failures")
+}
+
+// lockoutCommand returns the admin commands listing and lifting lockouts.
+// Lockouts are kept in the memory of the running server, so the commands
+// go through its admin API.
+func lockoutCommand() *cli.Command {
+	return &cli.Command{
+		Name:    "lockout",
+		Aliases: []string{"lockouts"},
+		Usage:   "Manage sources locked out after failed authentication attempts",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List locked out IP addresses and identities",
+				Flags: adminFlags(),
+				Action: func(c *cli.Context) error {
+					var lockouts []auth.Lockout
+					if err := adminRequest(c, http.MethodGet, "/admin/lockouts", nil, &lockouts); err != nil {
+						return err
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "SOURCE\tLOCKOUTS\tLAST FAILURE\tUNTIL")
+					for _, lockout := range lockouts {
+						fmt.Fprintf(w, "%s\t%d\t%s\t%s\n",
+							lockout.Key,
+							lockout.Lockouts,
+							lockout.LastFailure.Format(time.RFC3339),
+							lockout.Until.Format(time.RFC3339),
+						)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "clear",
+				Usage:     "Lift the lockout of a source, or of all sources with --all",
+				ArgsUsage: "<ip:address|identity:name>",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "Lift all lockouts",
+					},
+				}, adminFlags()...),
+				Action: func(c *cli.Context) error {
+					path := "/admin/lockouts"
+					switch {
+					case c.Bool("all") && c.NArg() > 0:
+						return fmt.Errorf("a source and --all are mutually exclusive")
+					case c.NArg() > 0:
+						path += "/" + url.PathEscape(c.Args().Get(0))
+					case !c.Bool("all"):
+						return fmt.Errorf("a source or --all is required")
+					}
+
+					var result struct {
+						Cleared int `json:"cleared"`
+					}
+					if err := adminRequest(c, http.MethodDelete, path, nil, &result); err != nil {
+						return err
+					}
+					fmt.Printf("Cleared %d lockout(s)\n", result.Cleared)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// adminFlags returns the flags of commands going through the admin API of
+// a running server
+func adminFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "admin-addr",
+			Value: "127.0.0.1:9090",
+			Usage: "Address of the server's admin API",
+		},
+		&cli.StringFlag{
+			Name:    "admin-token",
+			EnvVars: []string{"GOTUNNEL_ADMIN_TOKEN"},
+			Usage:   "Bearer token of the admin API",
+		},
+	}
+}
+
+// adminRequest calls the admin API given on the command line, sending in
+// as JSON body unless nil, and decodes its JSON response into out
+func adminRequest(c *cli.Context, method, path string, in, out interface{}) error {
+	if c.String("admin-token") == "" {
+		return fmt.Errorf("--admin-token is required")
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(c.Context, method, "http://"+c.String("admin-addr")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.String("admin-token"))
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("admin API: %s", apiErr.Error)
+		}
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
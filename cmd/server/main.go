@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/certs"
 	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/ogrok/gotunnel/pkg/users"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"github.com/gorilla/websocket"
@@ -46,21 +55,197 @@ func main() {
 				Aliases: []string{"k"},
 				Usage:   "TLS private key file",
 			},
+			&cli.StringSliceFlag{
+				Name:    "cert-pair",
+				Usage:   "Additional certificate as cert.pem=key.pem, selected by SNI (can be repeated)",
+			},
 			&cli.BoolFlag{
 				Name:    "tls",
 				Value:   true,
 				Usage:   "Enable TLS",
 			},
+			&cli.StringFlag{
+				Name:    "domain",
+				Usage:   "Base domain tunnels are served under (e.g., tunnel.example.com)",
+			},
 			&cli.StringSliceFlag{
 				Name:    "allowed-tokens",
 				Usage:   "Allowed authentication tokens",
 			},
+			&cli.StringFlag{
+				Name:    "token-file",
+				Usage:   "File persisting generated tokens (hashes only)",
+			},
+			&cli.StringFlag{
+				Name:    "token-database",
+				Usage:   "PostgreSQL URL persisting generated tokens, instead of --token-file",
+			},
+			&cli.BoolFlag{
+				Name:    "require-challenge",
+				Usage:   "Reject clients sending their token instead of proving they hold it; passwords, user API keys and JWTs are still accepted",
+			},
+			&cli.StringFlag{
+				Name:    "static-tokens",
+				Usage:   "YAML file listing accepted tokens with their scopes",
+			},
+			&cli.StringFlag{
+				Name:    "htpasswd",
+				Usage:   "htpasswd file of usernames and bcrypt passwords clients may authenticate with",
+			},
+			&cli.StringFlag{
+				Name:    "authorized-keys",
+				Usage:   "authorized_keys file of Ed25519 identity keys clients may authenticate with, with user= and subdomains= options",
+			},
+			&cli.StringFlag{
+				Name:    "auth-webhook",
+				Usage:   "URL of an HTTP service deciding whether to accept credentials",
+			},
+			&cli.StringFlag{
+				Name:    "auth-webhook-secret",
+				EnvVars: []string{"GOTUNNEL_AUTH_WEBHOOK_SECRET"},
+				Usage:   "Bearer token sent to the authentication webhook",
+			},
+			&cli.StringFlag{
+				Name:    "users-database",
+				Usage:   "PostgreSQL URL of user accounts whose API keys and JWTs can open tunnels",
+			},
+			&cli.StringFlag{
+				Name:    "jwt-secret",
+				EnvVars: []string{"GOTUNNEL_JWT_SECRET"},
+				Usage:   "Secret verifying user JWTs",
+			},
+			&cli.StringFlag{
+				Name:    "reservations",
+				Usage:   "File storing subdomain reservations",
+			},
+			&cli.BoolFlag{
+				Name:    "reserve-on-claim",
+				Usage:   "Reserve a subdomain for the first owner that opens a tunnel on it",
+			},
+			&cli.StringSliceFlag{
+				Name:    "reserved-subdomains",
+				Value:   cli.NewStringSlice(tunnel.DefaultReservedSubdomains...),
+				Usage:   "Subdomains that are never handed out to tunnels",
+			},
+			&cli.StringSliceFlag{
+				Name:    "subdomain-blocklist",
+				Usage:   "Regular expressions of subdomains to reject",
+			},
+			&cli.StringSliceFlag{
+				Name:    "subdomain-namespace",
+				Usage:   "Restrict an owner to subdomains under a prefix (owner=prefix)",
+			},
+			&cli.StringFlag{
+				Name:    "error-pages",
+				Usage:   "Directory with HTML templates overriding the error pages (e.g. tunnel_offline.html)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "trusted-proxies",
+				Usage:   "CIDRs whose X-Forwarded-*/Forwarded headers are kept and appended to instead of stripped",
+			},
+			&cli.BoolFlag{
+				Name:    "acme",
+				Usage:   "Obtain and renew TLS certificates automatically through ACME",
+			},
+			&cli.StringFlag{
+				Name:    "acme-email",
+				Usage:   "Contact email of the ACME account",
+			},
+			&cli.StringFlag{
+				Name:    "acme-directory",
+				Usage:   "ACME directory URL (default: Let's Encrypt)",
+			},
+			&cli.StringFlag{
+				Name:    "acme-cache",
+				Value:   "acme-cache",
+				Usage:   "Directory storing ACME account keys and certificates",
+			},
+			&cli.StringSliceFlag{
+				Name:    "acme-domains",
+				Usage:   "Custom domains certificates may be issued for",
+			},
+			&cli.StringFlag{
+				Name:    "acme-dns-hook",
+				Usage:   "Command called as '<hook> present|cleanup <fqdn> <value>' to solve DNS-01 challenges for a wildcard certificate",
+			},
+			&cli.StringFlag{
+				Name:    "acme-ca-file",
+				Usage:   "PEM bundle to trust when talking to the ACME directory, e.g. of a local test server",
+			},
+			&cli.BoolFlag{
+				Name:    "dev-ca",
+				Usage:   "Issue certificates from a local development CA (see 'dev-ca export')",
+			},
+			&cli.StringFlag{
+				Name:    "dev-ca-dir",
+				Value:   defaultDevCADir,
+				Usage:   "Directory storing the development CA",
+			},
+			&cli.StringSliceFlag{
+				Name:    "dev-ca-names",
+				Usage:   "Further names the development CA may issue certificates for",
+			},
+			&cli.StringFlag{
+				Name:    "client-ca",
+				Usage:   "CA bundle verifying client certificates presented by tunnel clients",
+			},
+			&cli.BoolFlag{
+				Name:    "require-client-cert",
+				Usage:   "Only accept tunnel clients presenting a certificate signed by --client-ca",
+			},
+			&cli.StringFlag{
+				Name:    "client-cert-map",
+				Usage:   "YAML file mapping client certificate subjects or SANs to identities and allowed subdomains",
+			},
+			&cli.StringSliceFlag{
+				Name:    "visitor-ca",
+				Usage:   "Require visitors of a subdomain to present a client certificate, as subdomain=ca.pem (can be repeated)",
+			},
+			&cli.IntFlag{
+				Name:    "lockout-ip-threshold",
+				Value:   20,
+				Usage:   "Failed authentication attempts from an IP address before it is locked out (0 disables)",
+			},
+			&cli.IntFlag{
+				Name:    "lockout-identity-threshold",
+				Value:   5,
+				Usage:   "Failed password attempts for a username before it is locked out (0 disables)",
+			},
+			&cli.DurationFlag{
+				Name:    "lockout-duration",
+				Value:   time.Minute,
+				Usage:   "Duration of the first lockout; each further lockout of the same source doubles it",
+			},
+			&cli.DurationFlag{
+				Name:    "lockout-max-duration",
+				Value:   time.Hour,
+				Usage:   "Maximum lockout duration",
+			},
+			&cli.StringFlag{
+				Name:    "admin-addr",
+				Usage:   "Address of the admin API managing tokens and lockouts, e.g. 127.0.0.1:9090 (disabled when empty)",
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				EnvVars: []string{"GOTUNNEL_ADMIN_TOKEN"},
+				Usage:   "Bearer token required by the admin API",
+			},
+			&cli.IntFlag{
+				Name:    "http-port",
+				Usage:   "Port of the plain HTTP listener answering ACME HTTP-01 challenges and redirecting to HTTPS (0 disables it)",
+			},
 			&cli.StringFlag{
 				Name:    "log-level",
 				Value:   "info",
 				Usage:   "Log level (debug, info, warn, error)",
 			},
 		},
+		Commands: []*cli.Command{
+			reservationCommand(),
+			devCACommand(),
+			tokenCommand(),
+			lockoutCommand(),
+		},
 		Action: runServer,
 	}
 
@@ -88,7 +273,11 @@ func runServer(c *cli.Context) error {
 	handler := tunnel.NewHandler(tunnelManager, logger)
 
 	// Create authentication handler
-	authHandler := auth.NewSimpleAuth()
+	tokenStore, err := openTokenStore(c.String("token-file"), c.String("token-database"))
+	if err != nil {
+		return err
+	}
+	authHandler := auth.NewSimpleAuthWithStore(tokenStore)
 	for _, token := range c.StringSlice("allowed-tokens") {
 		authHandler.AddAllowedToken(token)
 	}
@@ -99,9 +288,169 @@ func runServer(c *cli.Context) error {
 	config.UseTLS = c.Bool("tls")
 	config.TLSCertFile = c.String("cert")
 	config.TLSKeyFile = c.String("key")
+	config.TLSCertPairs = c.StringSlice("cert-pair")
+	config.Domain = c.String("domain")
+	config.ReservationsFile = c.String("reservations")
+	config.ReserveOnClaim = c.Bool("reserve-on-claim")
+	config.ReservedSubdomains = c.StringSlice("reserved-subdomains")
+	config.SubdomainBlocklist = c.StringSlice("subdomain-blocklist")
+	config.TrustedProxies = c.StringSlice("trusted-proxies")
+	config.UseACME = c.Bool("acme")
+	config.ACMEEmail = c.String("acme-email")
+	config.ACMEDirectory = c.String("acme-directory")
+	config.ACMECacheDir = c.String("acme-cache")
+	config.ACMEDomains = c.StringSlice("acme-domains")
+	config.ACMEDNSHook = c.String("acme-dns-hook")
+	config.ACMECAFile = c.String("acme-ca-file")
+	config.HTTPPort = c.Int("http-port")
+	config.UseDevCA = c.Bool("dev-ca")
+	config.DevCADir = c.String("dev-ca-dir")
+	config.DevCANames = c.StringSlice("dev-ca-names")
+	config.ClientCAFile = c.String("client-ca")
+	config.RequireClientCert = c.Bool("require-client-cert")
+	config.ClientCertMapFile = c.String("client-cert-map")
+	config.RequireChallengeAuth = c.Bool("require-challenge")
+	config.StaticTokensFile = c.String("static-tokens")
+	config.HtpasswdFile = c.String("htpasswd")
+	config.AuthWebhookURL = c.String("auth-webhook")
+	config.AuthWebhookSecret = c.String("auth-webhook-secret")
+	config.AuthorizedKeysFile = c.String("authorized-keys")
+	config.UsersDatabase = c.String("users-database")
+	config.JWTSecret = c.String("jwt-secret")
+	config.IPLockoutThreshold = c.Int("lockout-ip-threshold")
+	config.IdentityLockoutThreshold = c.Int("lockout-identity-threshold")
+	config.LockoutDuration = c.Duration("lockout-duration")
+	config.LockoutMaxDuration = c.Duration("lockout-max-duration")
+	if config.LockoutDuration <= 0 && (config.IPLockoutThreshold > 0 || config.IdentityLockoutThreshold > 0) {
+		return fmt.Errorf("--lockout-duration must be positive")
+	}
+	config.AdminAddr = c.String("admin-addr")
+	config.AdminToken = c.String("admin-token")
+	if config.AdminAddr != "" && config.AdminToken == "" {
+		return fmt.Errorf("--admin-addr needs --admin-token")
+	}
+	if config.RequireClientCert && config.ClientCAFile == "" {
+		return fmt.Errorf("--require-client-cert needs --client-ca")
+	}
+	config.VisitorCAs = make(map[string]string)
+	for _, entry := range c.StringSlice("visitor-ca") {
+		idx := strings.Index(entry, "=")
+		if idx <= 0 || idx == len(entry)-1 {
+			return fmt.Errorf("invalid visitor CA %q, expected subdomain=ca.pem", entry)
+		}
+		config.VisitorCAs[strings.ToLower(entry[:idx])] = entry[idx+1:]
+	}
+	if config.UseACME && config.UseDevCA {
+		return fmt.Errorf("--acme and --dev-ca cannot be used together")
+	}
+	config.SubdomainNamespaces = make(map[string]string)
+	for _, entry := range c.StringSlice("subdomain-namespace") {
+		idx := strings.LastIndex(entry, "=")
+		if idx <= 0 || idx == len(entry)-1 {
+			return fmt.Errorf("invalid subdomain namespace %q, expected owner=prefix", entry)
+		}
+		config.SubdomainNamespaces[entry[:idx]] = entry[idx+1:]
+	}
+
+	subdomains, err := tunnel.NewSubdomainPolicy(config.ReservedSubdomains, config.SubdomainBlocklist, config.SubdomainNamespaces)
+	if err != nil {
+		return fmt.Errorf("invalid subdomain policy: %w", err)
+	}
+
+	// Check credentials with the generated tokens and configured backends
+	authenticator, err := newAuthenticator(config, authHandler)
+	if err != nil {
+		return err
+	}
 
 	// Create server
-	server := NewServer(config, handler, authHandler, logger)
+	server := NewServer(config, handler, authenticator, authHandler.TokenManager(), logger)
+
+	// Load persistent subdomain reservations
+	if config.ReservationsFile != "" {
+		reservations, err := tunnel.LoadReservationStore(config.ReservationsFile)
+		if err != nil {
+			return fmt.Errorf("failed to load reservations: %w", err)
+		}
+		server.reservations = reservations
+	}
+	server.subdomains = subdomains
+
+	// Decide whose forwarding headers can be trusted
+	forwarded, err := tunnel.NewForwardedHeaders(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	server.forwarded = forwarded
+
+	// Load operator error page templates
+	if dir := c.String("error-pages"); dir != "" {
+		errorPages, err := tunnel.LoadErrorPages(dir)
+		if err != nil {
+			return fmt.Errorf("failed to load error pages: %w", err)
+		}
+		server.errorPages = errorPages
+	}
+
+	// Set up automatic certificates
+	if config.UseACME {
+		acmeManager, err := server.newACMEManager()
+		if err != nil {
+			return fmt.Errorf("failed to set up ACME: %w", err)
+		}
+		server.acme = acmeManager
+	}
+
+	// Set up the development CA
+	if config.UseDevCA {
+		devCA, err := certs.LoadOrCreateDevCA(config.DevCADir, config.Domain, config.DevCANames...)
+		if err != nil {
+			return err
+		}
+		server.devCA = devCA
+		logger.WithField("ca", filepath.Join(config.DevCADir, "ca.crt")).Warn("Serving certificates from the development CA, do not use in production")
+	}
+
+	// Let user accounts open tunnels with their API keys and JWTs
+	if config.UsersDatabase != "" {
+		userManager, err := users.NewUserManager(config.UsersDatabase, config.JWTSecret)
+		if err != nil {
+			return err
+		}
+		server.users = userManager
+	}
+
+	// Let clients authenticate with identity keys
+	if config.AuthorizedKeysFile != "" {
+		keys, err := auth.NewAuthorizedKeysAuth(config.AuthorizedKeysFile)
+		if err != nil {
+			return err
+		}
+		server.keys = keys
+	}
+
+	// Set up client certificate authentication
+	if config.ClientCAFile != "" {
+		server.clientCAs, err = loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		var mappings []auth.CertMapping
+		if config.ClientCertMapFile != "" {
+			mappings, err = auth.LoadCertMappings(config.ClientCertMapFile)
+			if err != nil {
+				return err
+			}
+		}
+		server.clientCerts = auth.NewClientCertAuth(mappings)
+	}
+
+	// Load the CAs of tunnels that require visitor certificates
+	visitorCAs, err := loadVisitorCAs(config.VisitorCAs)
+	if err != nil {
+		return err
+	}
+	server.visitorCAs = visitorCAs
 
 	// Start server
 	logger.WithFields(logrus.Fields{
@@ -127,20 +476,57 @@ func runServer(c *cli.Context) error {
 
 // Server represents the tunnel server
 type Server struct {
-	config      *tunnel.ServerConfig
-	handler     *tunnel.Handler
-	authHandler *auth.SimpleAuth
-	logger      *logrus.Logger
-	httpServer  *http.Server
+	config        *tunnel.ServerConfig
+	handler       *tunnel.Handler
+	// authenticator checks the credentials of tunnel clients
+	authenticator auth.Authenticator
+	// tokens manages the generated tokens of the admin API and commands
+	tokens        *auth.TokenManager
+	reservations  *tunnel.ReservationStore
+	subdomains    *tunnel.SubdomainPolicy
+	errorPages    *tunnel.ErrorPages
+	forwarded     *tunnel.ForwardedHeaders
+	acme          *certs.ACMEManager
+	certificates  *certs.Store
+	devCA         *certs.DevCA
+	// clientCAs and clientCerts verify and identify the certificates of
+	// tunnel clients; nil without a client CA
+	clientCAs     *x509.CertPool
+	clientCerts   *auth.ClientCertAuth
+	keys          *auth.AuthorizedKeysAuth
+	// ipLockouts and idLockouts lock out IP addresses and claimed
+	// identities after failed authentication attempts; nil when disabled
+	ipLockouts    *auth.LockoutTracker
+	idLockouts    *auth.LockoutTracker
+	users         userAccounts
+	visitorCAs    map[string]*x509.CertPool
+	registerMu    sync.Mutex
+	bandwidth     map[string]*tunnel.BandwidthMeter
+	// rotations holds the rotations made through the admin API by the ID
+	// of the old token, for clients still connecting with it. Token values
+	// aren't stored, so these only live in memory.
+	rotationsMu   sync.Mutex
+	rotations     map[string]pendingRotation
+	logger        *logrus.Logger
+	httpServer    *http.Server
 }
 
 // NewServer creates a new tunnel server
-func NewServer(config *tunnel.ServerConfig, handler *tunnel.Handler, authHandler *auth.SimpleAuth, logger *logrus.Logger) *Server {
+func NewServer(config *tunnel.ServerConfig, handler *tunnel.Handler, authenticator auth.Authenticator, tokens *auth.TokenManager, logger *logrus.Logger) *Server {
 	return &Server{
-		config:      config,
-		handler:     handler,
-		authHandler: authHandler,
-		logger:      logger,
+		config:        config,
+		handler:       handler,
+		authenticator: authenticator,
+		tokens:        tokens,
+		reservations:  tunnel.NewReservationStore(),
+		subdomains:    tunnel.DefaultSubdomainPolicy(),
+		errorPages:    tunnel.DefaultErrorPages(),
+		forwarded:     &tunnel.ForwardedHeaders{},
+		bandwidth:     make(map[string]*tunnel.BandwidthMeter),
+		rotations:     make(map[string]pendingRotation),
+		ipLockouts:    newLockoutTracker(config, config.IPLockoutThreshold),
+		idLockouts:    newLockoutTracker(config, config.IdentityLockoutThreshold),
+		logger:        logger,
 	}
 }
 
@@ -169,6 +555,48 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 	}()
 
+	// Start plain HTTP listener for ACME challenges and redirects
+	var challengeServer *http.Server
+	if s.config.HTTPPort > 0 {
+		challengeServer = &http.Server{
+			Addr:         fmt.Sprintf(":%d", s.config.HTTPPort),
+			Handler:      s.createPlainHTTPHandler(),
+			ReadTimeout:  s.config.ReadTimeout,
+			WriteTimeout: s.config.WriteTimeout,
+		}
+		go func() {
+			s.logger.WithField("address", challengeServer.Addr).Info("HTTP listener started")
+			if err := challengeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.WithError(err).Error("HTTP listener error")
+			}
+		}()
+	}
+
+	// Start the admin API
+	var adminServer *http.Server
+	if s.config.AdminAddr != "" {
+		adminServer = &http.Server{
+			Addr:         s.config.AdminAddr,
+			Handler:      s.createAdminHandler(),
+			ReadTimeout:  s.config.ReadTimeout,
+			WriteTimeout: s.config.WriteTimeout,
+		}
+		go func() {
+			s.logger.WithField("address", adminServer.Addr).Info("Admin API started")
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.WithError(err).Error("Admin API error")
+			}
+		}()
+	}
+
+	if s.acme != nil {
+		go s.acme.RenewLoop(ctx)
+	}
+	if s.certificates != nil {
+		go s.watchCertificates(ctx)
+	}
+	go s.enforceTokens(ctx)
+
 	// Wait for context cancellation
 	<-ctx.Done()
 
@@ -179,6 +607,16 @@ func (s *Server) Start(ctx context.Context) error {
 	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
 		s.logger.WithError(err).Error("Error during server shutdown")
 	}
+	if challengeServer != nil {
+		if err := challengeServer.Shutdown(shutdownCtx); err != nil {
+			s.logger.WithError(err).Error("Error during HTTP listener shutdown")
+		}
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			s.logger.WithError(err).Error("Error during admin API shutdown")
+		}
+	}
 
 	s.logger.Info("Server stopped")
 	return nil
@@ -188,12 +626,8 @@ func (s *Server) Start(ctx context.Context) error {
 func (s *Server) createListener() (net.Listener, error) {
 	addr := fmt.Sprintf(":%d", s.config.Port)
 
-	if s.config.UseTLS {
-		if s.config.TLSCertFile == "" || s.config.TLSKeyFile == "" {
-			return nil, fmt.Errorf("TLS certificate and key files are required when TLS is enabled")
-		}
-
-		tlsConfig, err := tunnel.CreateTLSConfig(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if s.tlsEnabled() {
+		tlsConfig, err := s.createTLSConfig()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create TLS config: %w", err)
 		}
@@ -232,46 +666,185 @@ func (s *Server) handleTunnelConnection(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Get subdomain from query parameter
+	// Get subdomain from query parameter; an empty one is assigned below
 	subdomain := r.URL.Query().Get("subdomain")
-	if subdomain == "" {
-		s.logger.Error("No subdomain provided")
-		conn.Close()
+
+	// Authenticate the client by its certificate or auth token
+	identity, err := s.authenticateClient(r, conn)
+	if err != nil {
+		s.logger.WithError(err).WithField("subdomain", subdomain).Error("Tunnel authentication failed")
+		s.rejectTunnel(conn, err.Error())
 		return
 	}
+	owner := identity.Owner
 
-	// Get auth token from query parameter
-	authToken := r.URL.Query().Get("token")
-	if authToken == "" {
-		s.logger.Error("No auth token provided")
-		conn.Close()
+	// Certificate identities may be limited to some subdomains
+	if identity.Cert != nil && len(identity.Cert.Subdomains) > 0 && subdomain == "" {
+		s.rejectTunnel(conn, "a subdomain is required for this client certificate")
 		return
 	}
 
-	// Validate auth token
-	if !s.authHandler.Authenticate(authToken) {
-		s.logger.WithField("subdomain", subdomain).Error("Invalid auth token")
-		conn.Close()
+	// Resolve the subdomain the tunnel will be served on
+	subdomain, err = s.resolveSubdomain(subdomain, owner, identity.scopes())
+	if err != nil {
+		s.logger.WithError(err).WithField("owner", owner).Warn("Rejected subdomain claim")
+		s.rejectTunnel(conn, err.Error())
 		return
 	}
+	if identity.Cert != nil && !identity.Cert.AllowsSubdomain(subdomain) {
+		s.logger.WithFields(logrus.Fields{"owner": owner, "subdomain": subdomain}).Warn("Subdomain not allowed for client certificate")
+		s.rejectTunnel(conn, fmt.Sprintf("%s: %v", subdomain, tunnel.ErrSubdomainNotAllowed))
+		return
+	}
+
+	tunnelType := r.URL.Query().Get("type")
+	if tunnelType == "" {
+		tunnelType = "http"
+	}
 
 	// Create tunnel
-	tunnel := &tunnel.Tunnel{
+	clientConn := &WebSocketConn{conn: conn}
+	t := &tunnel.Tunnel{
 		ID:         generateID(),
 		Subdomain:  subdomain,
-		ClientConn: &WebSocketConn{conn: conn},
+		Owner:      owner,
+		ClientConn: clientConn,
 		CreatedAt:  time.Now(),
 		LastSeen:   time.Now(),
+		AllowHTTP:  queryBool(r, "allow_http"),
+		HSTS:       queryBool(r, "hsts"),
+		Type:       tunnelType,
 	}
 
+	// Visitors may reach the tunnel as soon as it is registered, so their
+	// requests are held back until the client got the handshake response
+	clientConn.writeMu.Lock()
+
+	// Check the token scopes and register under the same lock, so
+	// concurrent connections can't exceed the token's tunnel limit
+	if err := s.registerTunnel(t, identity, remoteIP(r)); err != nil {
+		clientConn.writeMu.Unlock()
+		s.logger.WithError(err).WithFields(logrus.Fields{"owner": owner, "subdomain": subdomain}).Warn("Failed to register tunnel")
+		s.rejectTunnel(conn, fmt.Sprintf("%s: %v", subdomain, err))
+		return
+	}
+
+	err = conn.WriteJSON(tunnel.HandshakeResponse{
+		Success:   true,
+		TunnelID:  t.ID,
+		Subdomain: t.Subdomain,
+		URL:       s.config.PublicURL(t.Subdomain),
+	})
+	clientConn.writeMu.Unlock()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to send handshake response")
+		s.handler.TunnelManager().DetachTunnel(t)
+		t.Close()
+		return
+	}
+
+	// Only reserve once the client is connected, so a failed handshake
+	// leaves no reservation behind
+	if s.config.ReserveOnClaim {
+		if err := s.reservations.Reserve(subdomain, owner); err != nil {
+			s.logger.WithError(err).WithField("subdomain", subdomain).Error("Failed to reserve subdomain")
+		}
+	}
+	s.sendPendingRotation(t)
+
 	// Handle tunnel in background
 	go func() {
-		if err := s.handler.HandleTunnel(context.Background(), tunnel); err != nil {
+		if err := s.handler.HandleTunnel(context.Background(), t); err != nil {
 			s.logger.WithError(err).Error("Tunnel handler error")
 		}
 	}()
 }
 
+// resolveSubdomain normalizes the requested subdomain, or assigns a random
+// one within scopes when none was requested, and checks it against the
+// subdomain policy and the reservations of other owners
+func (s *Server) resolveSubdomain(requested, owner string, scopes auth.TokenScopes) (string, error) {
+	if requested == "" {
+		generated, err := s.generateSubdomain(owner, scopes)
+		if err != nil {
+			return "", err
+		}
+		requested = generated
+	}
+
+	subdomain, err := s.subdomains.Normalize(requested, owner)
+	if err != nil {
+		return "", err
+	}
+
+	// An explicit reservation lets its owner use reserved or blocklisted names
+	if r, reserved := s.reservations.Get(subdomain); reserved {
+		if r.Owner != owner {
+			return "", fmt.Errorf("%s: %w", subdomain, tunnel.ErrSubdomainReserved)
+		}
+		return subdomain, nil
+	}
+
+	if err := s.subdomains.Allowed(subdomain); err != nil {
+		return "", err
+	}
+	return subdomain, nil
+}
+
+// generateSubdomain assigns a random free subdomain. Tokens limited to some
+// subdomains get one matching their patterns: a plain name as it is, or
+// the prefix of a pattern ending in "*" followed by a random name.
+func (s *Server) generateSubdomain(owner string, scopes auth.TokenScopes) (string, error) {
+	available := func(name string) bool {
+		name, err := s.subdomains.Normalize(name, owner)
+		return err == nil && s.subdomains.Allowed(name) == nil && s.subdomainAvailable(name) && scopes.AllowsSubdomain(name)
+	}
+	if len(scopes.Subdomains) == 0 {
+		generated, err := tunnel.GenerateAvailableSubdomain(available)
+		if err != nil {
+			return "", fmt.Errorf("failed to assign a subdomain: %w", err)
+		}
+		return generated, nil
+	}
+
+	for _, pattern := range scopes.Subdomains {
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if strings.ContainsAny(prefix, `*?[\`) {
+			continue
+		}
+		if !wildcard {
+			if available(prefix) {
+				return prefix, nil
+			}
+			continue
+		}
+		generated, err := tunnel.GenerateAvailableSubdomain(func(name string) bool {
+			return available(prefix + name)
+		})
+		if err == nil {
+			return prefix + generated, nil
+		}
+	}
+	return "", fmt.Errorf("no free subdomain matches %s, request one with --subdomain", strings.Join(scopes.Subdomains, ", "))
+}
+
+// subdomainAvailable reports whether a subdomain is neither reserved nor in use
+func (s *Server) subdomainAvailable(subdomain string) bool {
+	if _, reserved := s.reservations.Get(subdomain); reserved {
+		return false
+	}
+	_, active := s.handler.TunnelManager().GetTunnel(subdomain)
+	return !active
+}
+
+// rejectTunnel reports a failed handshake to the client and closes the connection
+func (s *Server) rejectTunnel(conn *websocket.Conn, reason string) {
+	if err := conn.WriteJSON(tunnel.HandshakeResponse{Error: reason}); err != nil {
+		s.logger.WithError(err).Debug("Failed to send handshake rejection")
+	}
+	conn.Close()
+}
+
 // handleIncomingRequest handles incoming HTTP requests
 func (s *Server) handleIncomingRequest(w http.ResponseWriter, r *http.Request) {
 	// Extract subdomain from Host header
@@ -281,9 +854,9 @@ func (s *Server) handleIncomingRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse subdomain from host
-	subdomain := s.extractSubdomain(host)
+	subdomain := s.extractSubdomain(strings.ToLower(host))
 	if subdomain == "" {
-		http.Error(w, "Invalid subdomain", http.StatusBadRequest)
+		s.errorPages.Render(w, r, tunnel.NewErrorPageData(tunnel.ErrorPageUnknownTunnel, host, ""))
 		return
 	}
 
@@ -293,6 +866,20 @@ func (s *Server) handleIncomingRequest(w http.ResponseWriter, r *http.Request) {
 		"path":      r.URL.Path,
 	}).Info("Handling incoming request")
 
+	// Tell the local app who the visitor is
+	s.forwarded.Apply(r)
+
+	t, found := s.handler.TunnelManager().GetTunnel(subdomain)
+	if found && t.HSTS && r.TLS != nil {
+		w.Header().Set("Strict-Transport-Security", hstsHeader)
+	}
+
+	// Some tunnels only accept visitors with a verified client certificate
+	if !s.checkVisitorCert(r, subdomain) {
+		s.errorPages.Render(w, r, tunnel.NewErrorPageData(tunnel.ErrorPageClientCertRequired, host, subdomain))
+		return
+	}
+
 	// Create a connection to handle the request
 	conn := &HTTPConn{
 		request:  r,
@@ -300,10 +887,24 @@ func (s *Server) handleIncomingRequest(w http.ResponseWriter, r *http.Request) {
 		done:     make(chan struct{}),
 	}
 
+	// Tunnels whose token caps bandwidth are metered and paused when over it
+	if found && t.Bandwidth != nil {
+		if t.Bandwidth.Exceeded() {
+			s.renderTunnelError(w, r, host, subdomain, tunnel.ErrOverQuota)
+			return
+		}
+		conn.meter = t.Bandwidth
+	}
+
 	// Handle the request
 	if err := s.handler.HandleHTTPRequest(r.Context(), subdomain, conn); err != nil {
 		s.logger.WithError(err).Error("Failed to handle HTTP request")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		if conn.wrote {
+			// Part of the response was sent, so the visitor can only be
+			// cut off, e.g. when the tunnel went over its bandwidth limit
+			panic(http.ErrAbortHandler)
+		}
+		s.renderTunnelError(w, r, host, subdomain, err)
 		return
 	}
 
@@ -311,6 +912,40 @@ func (s *Server) handleIncomingRequest(w http.ResponseWriter, r *http.Request) {
 	<-conn.done
 }
 
+// renderTunnelError answers a visitor whose request could not be forwarded
+// with the error page matching the failure
+func (s *Server) renderTunnelError(w http.ResponseWriter, r *http.Request, host, subdomain string, err error) {
+	kind := tunnel.ErrorPageTunnelOffline
+	var netErr net.Error
+	switch {
+	case errors.Is(err, tunnel.ErrTunnelNotFound):
+		// Subdomains that had a tunnel or are reserved are offline, not unknown
+		_, seen := s.handler.TunnelManager().LastSeen(subdomain)
+		_, reserved := s.reservations.Get(subdomain)
+		if !seen && !reserved {
+			kind = tunnel.ErrorPageUnknownTunnel
+		}
+	case errors.Is(err, tunnel.ErrOverQuota):
+		kind = tunnel.ErrorPageOverQuota
+	case errors.Is(err, tunnel.ErrLocalServiceUnavailable):
+		kind = tunnel.ErrorPageLocalRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		kind = tunnel.ErrorPageTunnelTimeout
+	}
+
+	data := tunnel.NewErrorPageData(kind, host, subdomain)
+	if kind == tunnel.ErrorPageTunnelOffline || kind == tunnel.ErrorPageTunnelTimeout {
+		if t, exists := s.handler.TunnelManager().GetTunnel(subdomain); exists {
+			lastSeen := t.LastSeenAt()
+			data.LastSeen = &lastSeen
+		} else if lastSeen, seen := s.handler.TunnelManager().LastSeen(subdomain); seen {
+			data.LastSeen = &lastSeen
+		}
+	}
+
+	s.errorPages.Render(w, r, data)
+}
+
 // extractSubdomain extracts subdomain from host
 func (s *Server) extractSubdomain(host string) string {
 	// Remove port if present
@@ -328,6 +963,12 @@ func (s *Server) extractSubdomain(host string) string {
 	return parts[0]
 }
 
+// queryBool parses a boolean query parameter, treating invalid values as false
+func queryBool(r *http.Request, name string) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(name))
+	return err == nil && value
+}
+
 // generateID generates a unique ID
 func generateID() string {
 	return time.Now().Format("20060102150405") + "-" + randomString(8)
@@ -346,6 +987,9 @@ func randomString(length int) string {
 // WebSocketConn wraps WebSocket connection to implement net.Conn
 type WebSocketConn struct {
 	conn *websocket.Conn
+	// writeMu serializes tunnel traffic and control messages, as the
+	// connection supports one writer at a time
+	writeMu sync.Mutex
 }
 
 func (w *WebSocketConn) Read(b []byte) (n int, err error) {
@@ -358,6 +1002,8 @@ func (w *WebSocketConn) Read(b []byte) (n int, err error) {
 }
 
 func (w *WebSocketConn) Write(b []byte) (n int, err error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
 	err = w.conn.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
 		return 0, err
@@ -365,6 +1011,14 @@ func (w *WebSocketConn) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// SendControl sends msg as a JSON text message, which clients tell apart
+// from the binary tunnel traffic
+func (w *WebSocketConn) SendControl(msg interface{}) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.conn.WriteJSON(msg)
+}
+
 func (w *WebSocketConn) Close() error {
 	return w.conn.Close()
 }
@@ -393,19 +1047,42 @@ func (w *WebSocketConn) SetWriteDeadline(t time.Time) error {
 type HTTPConn struct {
 	request  *http.Request
 	response http.ResponseWriter
+	reader   io.Reader
+	// meter counts the traffic of the request, which is cut off with
+	// ErrOverQuota once the tunnel goes over its bandwidth limit
+	meter    *tunnel.BandwidthMeter
+	// wrote is set once part of the response was sent
+	wrote    bool
 	done     chan struct{}
 }
 
 func (h *HTTPConn) Read(b []byte) (n int, err error) {
-	// For HTTP, we don't read from the connection
-	return 0, nil
+	if h.meter.Exceeded() {
+		return 0, tunnel.ErrOverQuota
+	}
+	// Serialize the request on first read so it can be sent through the tunnel
+	if h.reader == nil {
+		data, err := tunnel.EncodeRequest(h.request)
+		if err != nil {
+			return 0, err
+		}
+		h.reader = bytes.NewReader(data)
+	}
+	n, err = h.reader.Read(b)
+	h.meter.Add(n)
+	return n, err
 }
 
 func (h *HTTPConn) Write(b []byte) (n int, err error) {
+	if h.meter.Exceeded() {
+		return 0, tunnel.ErrOverQuota
+	}
 	_, err = h.response.Write(b)
 	if err != nil {
 		return 0, err
 	}
+	h.wrote = true
+	h.meter.Add(len(b))
 	return len(b), nil
 }
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+// testDomain is the domain tunnels of test servers are served on
+const testDomain = "example.test"
+
+// newTestServer creates a server accepting the tokens of its token manager
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	config := tunnel.DefaultServerConfig()
+	config.Domain = testDomain
+	handler := tunnel.NewHandler(tunnel.NewTunnelManager(), logger)
+	simple := auth.NewSimpleAuth()
+	authenticator, err := newAuthenticator(config, simple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(config, handler, authenticator, simple.TokenManager(), logger)
+}
+
+// startTestServer serves s over plain HTTP and returns the URL of its
+// tunnel endpoint
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	server := httptest.NewServer(s.createHTTPHandler())
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/tunnel"
+}
+
+// dialTunnel opens a tunnel connection to url and reads the handshake
+// response. The connection is closed when the test ends.
+func dialTunnel(t *testing.T, dialer *websocket.Dialer, url string, header http.Header) (*websocket.Conn, tunnel.HandshakeResponse) {
+	t.Helper()
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var response tunnel.HandshakeResponse
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&response); err != nil {
+		t.Fatalf("failed to read handshake response: %v", err)
+	}
+	return conn, response
+}
+
+// bearerHeader returns the header sending token as bearer token
+func bearerHeader(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestHTTPConn_CutsOffOverQuota(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	conn := &HTTPConn{
+		request:  httptest.NewRequest(http.MethodGet, "/", nil),
+		response: recorder,
+		meter:    tunnel.NewBandwidthMeter(1),
+		done:     make(chan struct{}),
+	}
+
+	// A minute at 1 B/s allows 60 bytes; the write going over is still sent
+	chunk := bytes.Repeat([]byte("x"), 50)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	if _, err := conn.Write(chunk); !errors.Is(err, tunnel.ErrOverQuota) {
+		t.Fatalf("expected ErrOverQuota once over the limit, got %v", err)
+	}
+	if recorder.Body.Len() != 100 || !conn.wrote {
+		t.Errorf("expected 100 bytes sent before the cut-off, got %d", recorder.Body.Len())
+	}
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, tunnel.ErrOverQuota) {
+		t.Errorf("expected reads to stop as well, got %v", err)
+	}
+}
+
+func TestResolveSubdomain_Scoped(t *testing.T) {
+	s := newTestServer(t)
+	resolve := func(patterns ...string) (string, error) {
+		return s.resolveSubdomain("", "token:test", auth.TokenScopes{Subdomains: patterns})
+	}
+
+	name, err := resolve("ci-*")
+	if err != nil || !strings.HasPrefix(name, "ci-") || tunnel.ValidateSubdomain(name) != nil {
+		t.Errorf("expected a random name starting with ci-, got %q, %v", name, err)
+	}
+	if name, err := resolve("demo"); err != nil || name != "demo" {
+		t.Errorf("expected the only allowed name, got %q, %v", name, err)
+	}
+	if _, err := resolve("c?"); err == nil || !strings.Contains(err.Error(), "--subdomain") {
+		t.Errorf("expected a subdomain to be required, got %v", err)
+	}
+	if name, err := resolve(); err != nil || name == "" {
+		t.Errorf("expected a random name without scopes, got %q, %v", name, err)
+	}
+}
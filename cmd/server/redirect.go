@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hstsHeader is sent for tunnels that enable HSTS
+const hstsHeader = "max-age=31536000"
+
+// createPlainHTTPHandler creates the handler of the plain HTTP listener. It
+// answers ACME HTTP-01 challenges, serves tunnels that allow plain HTTP and
+// redirects everything else to HTTPS.
+func (s *Server) createPlainHTTPHandler() http.Handler {
+	if !s.tlsEnabled() {
+		// Without TLS there is nothing to redirect to
+		return s.createHTTPHandler()
+	}
+
+	handler := http.HandlerFunc(s.handlePlainHTTP)
+	if s.acme != nil {
+		return s.acme.HTTPHandler(handler)
+	}
+	return handler
+}
+
+// handlePlainHTTP serves a request received over plain HTTP
+func (s *Server) handlePlainHTTP(w http.ResponseWriter, r *http.Request) {
+	subdomain := s.extractSubdomain(strings.ToLower(r.Host))
+	if t, ok := s.handler.TunnelManager().GetTunnel(subdomain); ok && t.AllowHTTP {
+		s.handleIncomingRequest(w, r)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if s.config.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.config.Port))
+	}
+
+	// 308 keeps the method and body of non-idempotent requests
+	status := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
+
+// tlsEnabled reports whether the main listener serves TLS
+func (s *Server) tlsEnabled() bool {
+	return s.config.UseTLS || s.acme != nil || s.devCA != nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/urfave/cli/v2"
+)
+
+// reservationCommand returns the admin commands managing subdomain reservations
+func reservationCommand() *cli.Command {
+	fileFlag := &cli.StringFlag{
+		Name:     "reservations",
+		Aliases:  []string{"f"},
+		Required: true,
+		Usage:    "File storing subdomain reservations",
+	}
+	ownerFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "owner",
+			Usage: "Owner name (e.g. token:<fingerprint>)",
+		},
+		&cli.StringFlag{
+			Name:  "token",
+			Usage: "Bind to the owner of this authentication token",
+		},
+	}
+
+	return &cli.Command{
+		Name:    "reservation",
+		Aliases: []string{"reservations"},
+		Usage:   "Manage subdomain reservations",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List reserved subdomains",
+				Flags: []cli.Flag{fileFlag},
+				Action: func(c *cli.Context) error {
+					store, err := tunnel.LoadReservationStore(c.String("reservations"))
+					if err != nil {
+						return err
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "SUBDOMAIN\tOWNER\tCREATED")
+					for _, r := range store.List() {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", r.Subdomain, r.Owner, r.CreatedAt.Format(time.RFC3339))
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "reserve",
+				Usage:     "Reserve a subdomain for an owner",
+				ArgsUsage: "<subdomain>",
+				Flags:     append([]cli.Flag{fileFlag}, ownerFlags...),
+				Action: func(c *cli.Context) error {
+					subdomain, owner, err := reservationArgs(c)
+					if err != nil {
+						return err
+					}
+					store, err := tunnel.LoadReservationStore(c.String("reservations"))
+					if err != nil {
+						return err
+					}
+					if err := store.Reserve(subdomain, owner); err != nil {
+						return fmt.Errorf("failed to reserve %s: %w", subdomain, err)
+					}
+					fmt.Printf("Reserved %s for %s\n", subdomain, owner)
+					return nil
+				},
+			},
+			{
+				Name:      "release",
+				Usage:     "Release a reserved subdomain",
+				ArgsUsage: "<subdomain>",
+				Flags:     []cli.Flag{fileFlag},
+				Action: func(c *cli.Context) error {
+					subdomain, err := subdomainArg(c)
+					if err != nil {
+						return err
+					}
+					store, err := tunnel.LoadReservationStore(c.String("reservations"))
+					if err != nil {
+						return err
+					}
+					if err := store.Release(subdomain); err != nil {
+						return fmt.Errorf("failed to release %s: %w", subdomain, err)
+					}
+					fmt.Printf("Released %s\n", subdomain)
+					return nil
+				},
+			},
+			{
+				Name:      "transfer",
+				Usage:     "Transfer a reserved subdomain to another owner",
+				ArgsUsage: "<subdomain>",
+				Flags:     append([]cli.Flag{fileFlag}, ownerFlags...),
+				Action: func(c *cli.Context) error {
+					subdomain, owner, err := reservationArgs(c)
+					if err != nil {
+						return err
+					}
+					store, err := tunnel.LoadReservationStore(c.String("reservations"))
+					if err != nil {
+						return err
+					}
+					if err := store.Transfer(subdomain, owner); err != nil {
+						return fmt.Errorf("failed to transfer %s: %w", subdomain, err)
+					}
+					fmt.Printf("Transferred %s to %s\n", subdomain, owner)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// subdomainArg reads the subdomain argument in the lowercase form tunnels
+// are looked up by
+func subdomainArg(c *cli.Context) (string, error) {
+	if c.NArg() < 1 {
+		return "", fmt.Errorf("subdomain is required")
+	}
+	subdomain := strings.ToLower(c.Args().Get(0))
+	if err := tunnel.ValidateSubdomain(subdomain); err != nil {
+		return "", err
+	}
+	return subdomain, nil
+}
+
+// reservationArgs reads the subdomain argument and resolves the owner from
+// either --owner or --token
+func reservationArgs(c *cli.Context) (string, string, error) {
+	subdomain, err := subdomainArg(c)
+	if err != nil {
+		return "", "", err
+	}
+
+	owner := c.String("owner")
+	if token := c.String("token"); token != "" {
+		if owner != "" {
+			return "", "", fmt.Errorf("--owner and --token are mutually exclusive")
+		}
+		owner = auth.TokenOwner(token)
+	}
+	if owner == "" {
+		return "", "", fmt.Errorf("--owner or --token is required")
+	}
+
+	return subdomain, owner, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+	"github.com/urfave/cli/v2"
+)
+
+func TestReservationCommand_NormalizesSubdomain(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reservations.json")
+	app := &cli.App{Commands: []*cli.Command{reservationCommand()}, Writer: io.Discard}
+	reserve := func(subdomain string) error {
+		return app.Run([]string{"gotunnel-server", "reservation", "reserve", "--reservations", file, "--owner", "alice", subdomain})
+	}
+
+	if err := reserve("MyApp"); err != nil {
+		t.Fatalf("reserve failed: %v", err)
+	}
+	store, err := tunnel.LoadReservationStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := store.Get("myapp"); !ok || r.Owner != "alice" {
+		t.Errorf("expected myapp to be reserved for alice, got %+v", r)
+	}
+
+	for _, invalid := range []string{"my_app", "app-", "app.example"} {
+		if err := reserve(invalid); !errors.Is(err, tunnel.ErrInvalidSubdomain) {
+			t.Errorf("expected %q to be rejected as invalid, got %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ogrok/gotunnel/pkg/certs"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+)
+
+// certificateCheckInterval is how often certificate files are checked for changes
+const certificateCheckInterval = 30 * time.Second
+
+// createTLSConfig creates the TLS configuration of the main listener.
+// Certificates loaded from files are selected by SNI and take precedence
+// over ACME or the development CA.
+func (s *Server) createTLSConfig() (*tls.Config, error) {
+	var pairs []certs.KeyPair
+	if s.config.TLSCertFile != "" || s.config.TLSKeyFile != "" {
+		if s.config.TLSCertFile == "" || s.config.TLSKeyFile == "" {
+			return nil, fmt.Errorf("both a TLS certificate and key file are required")
+		}
+		pairs = append(pairs, certs.KeyPair{CertFile: s.config.TLSCertFile, KeyFile: s.config.TLSKeyFile})
+	}
+	for _, value := range s.config.TLSCertPairs {
+		pair, err := certs.ParseKeyPair(value)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if len(pairs) > 0 {
+		store, err := certs.NewStore(pairs, s.logger)
+		if err != nil {
+			return nil, err
+		}
+		s.certificates = store
+	}
+
+	// Certificates issued on demand cover every name the files don't
+	var tlsConfig *tls.Config
+	switch {
+	case s.acme != nil:
+		tlsConfig = s.acme.TLSConfig()
+	case s.devCA != nil:
+		tlsConfig = s.devCA.TLSConfig()
+	}
+
+	switch {
+	case tlsConfig != nil && s.certificates != nil:
+		getCertificate := tlsConfig.GetCertificate
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, ok := s.certificates.Lookup(hello.ServerName); ok {
+				return cert, nil
+			}
+			return getCertificate(hello)
+		}
+	case s.certificates != nil:
+		tlsConfig = s.certificates.TLSConfig()
+	case tlsConfig == nil:
+		return nil, fmt.Errorf("TLS certificate and key files are required when TLS is enabled")
+	}
+
+	// Visitors share the listener with tunnel clients, so certificates are
+	// only verified when given and required in the tunnel endpoint itself
+	if s.clientCAs != nil {
+		tlsConfig.ClientCAs = s.clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if len(s.visitorCAs) > 0 {
+		tlsConfig.GetConfigForClient = s.visitorTLSConfig(tlsConfig)
+	}
+
+	return tlsConfig, nil
+}
+
+// visitorTLSConfig returns a GetConfigForClient callback that requests a
+// client certificate from visitors of subdomains with a visitor CA
+func (s *Server) visitorTLSConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		subdomain := s.extractSubdomain(strings.ToLower(hello.ServerName))
+		pool, ok := s.visitorCAs[subdomain]
+		if !ok {
+			// Use the base configuration
+			return nil, nil
+		}
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		return config, nil
+	}
+}
+
+// loadVisitorCAs loads the CA bundles of tunnels that require visitor certificates
+func loadVisitorCAs(files map[string]string) (map[string]*x509.CertPool, error) {
+	pools := make(map[string]*x509.CertPool, len(files))
+	for subdomain, file := range files {
+		pool, err := loadCertPool(file)
+		if err != nil {
+			return nil, fmt.Errorf("visitor CA of %s: %w", subdomain, err)
+		}
+		pools[subdomain] = pool
+	}
+	return pools, nil
+}
+
+// checkVisitorCert reports whether a request may reach subdomain. Tunnels
+// with a visitor CA require a certificate verified against it, whose
+// subject is then passed on to the local app.
+func (s *Server) checkVisitorCert(r *http.Request, subdomain string) bool {
+	pool, ok := s.visitorCAs[subdomain]
+	if !ok {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	// Verify again: a visitor could reuse a connection made for another
+	// host, or present a certificate of the tunnel client CA
+	cert, err := verifyPeerCertificate(r.TLS, pool)
+	if err != nil {
+		s.logger.WithError(err).WithField("subdomain", subdomain).Warn("Rejected visitor certificate")
+		return false
+	}
+
+	r.Header.Set(tunnel.ClientCertSubjectHeader, cert.Subject.String())
+	return true
+}
+
+// tunnelClientCert returns the certificate a tunnel client presented, when
+// it was issued by the client CA. Connections to subdomains with a visitor
+// CA were verified against that CA during the handshake instead, so a
+// visitor certificate must not be taken for a tunnel client's.
+func (s *Server) tunnelClientCert(r *http.Request) *x509.Certificate {
+	if s.clientCAs == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert, err := verifyPeerCertificate(r.TLS, s.clientCAs)
+	if err != nil {
+		s.logger.WithError(err).Debug("Ignoring client certificate not issued by the client CA")
+		return nil
+	}
+	return cert
+}
+
+// verifyPeerCertificate verifies the certificate presented on a connection
+// for client authentication against pool, and returns it
+func verifyPeerCertificate(state *tls.ConnectionState, pool *x509.CertPool) (*x509.Certificate, error) {
+	cert := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return cert, err
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// watchCertificates reloads certificates when their files change or the
+// server receives SIGHUP, without dropping connected tunnels
+func (s *Server) watchCertificates(ctx context.Context) {
+	go s.certificates.Watch(ctx, certificateCheckInterval)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := s.certificates.Reload(); err != nil {
+				s.logger.WithError(err).Error("Failed to reload certificates, keeping previous ones")
+				continue
+			}
+			s.logger.Info("Reloaded TLS certificates after SIGHUP")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/ogrok/gotunnel/pkg/certs"
+	"github.com/ogrok/gotunnel/pkg/tunnel"
+)
+
+// testCA issues client certificates in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	cert, key := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	return &testCA{cert: cert, key: key}
+}
+
+// pool returns a pool trusting the CA
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue creates a client certificate for name
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	cert, key := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, ca.key)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+// newTestCertificate signs template with parent, or self-signs it
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// startTLSServer serves s over TLS with certificates of a development CA
+func startTLSServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	devCA, err := certs.LoadOrCreateDevCA(t.TempDir(), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.devCA = devCA
+	tlsConfig, err := s.createTLSConfig()
+	if err != nil {
+		t.Fatalf("createTLSConfig failed: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(s.createHTTPHandler())
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTunnelAuth_VisitorCertificateRejected(t *testing.T) {
+	clientCA := newTestCA(t, "client CA")
+	visitorCA := newTestCA(t, "visitor CA")
+
+	s := newTestServer(t)
+	s.config.RequireClientCert = true
+	s.clientCAs = clientCA.pool()
+	s.clientCerts = auth.NewClientCertAuth(nil)
+	s.visitorCAs = map[string]*x509.CertPool{"app": visitorCA.pool()}
+	server := startTLSServer(t, s)
+	url := "wss://" + server.Listener.Addr().String() + "/tunnel?subdomain="
+
+	dial := func(host string, cert tls.Certificate, subdomain string) tunnel.HandshakeResponse {
+		dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{
+			ServerName:         host,
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		}}
+		_, response := dialTunnel(t, dialer, url+subdomain, nil)
+		return response
+	}
+
+	response := dial("tunnel."+testDomain, clientCA.issue(t, "alice"), "alice")
+	if !response.Success {
+		t.Fatalf("client certificate rejected: %s", response.Error)
+	}
+
+	// The handshake on the visitor host verified the certificate against
+	// the visitor CA only
+	response = dial("app."+testDomain, visitorCA.issue(t, "mallory"), "mallory")
+	if response.Success || !strings.Contains(response.Error, "client certificate is required") {
+		t.Fatalf("visitor certificate opened a tunnel: %+v", response)
+	}
+	if _, ok := s.handler.TunnelManager().GetTunnel("mallory"); ok {
+		t.Error("tunnel of a visitor certificate was registered")
+	}
+}
+
+func TestCheckVisitorCert(t *testing.T) {
+	clientCA := newTestCA(t, "client CA")
+	visitorCA := newTestCA(t, "visitor CA")
+
+	s := newTestServer(t)
+	s.clientCAs = clientCA.pool()
+	s.visitorCAs = map[string]*x509.CertPool{"app": visitorCA.pool()}
+
+	request := func(cert *tls.Certificate) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "https://app."+testDomain+"/", nil)
+		r.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			r.TLS.PeerCertificates = []*x509.Certificate{cert.Leaf}
+		}
+		return r
+	}
+
+	visitor := visitorCA.issue(t, "visitor")
+	r := request(&visitor)
+	if !s.checkVisitorCert(r, "app") {
+		t.Fatal("visitor certificate rejected")
+	}
+	if got := r.Header.Get(tunnel.ClientCertSubjectHeader); got != "CN=visitor" {
+		t.Errorf("expected the visitor's subject to be passed on, got %q", got)
+	}
+
+	client := clientCA.issue(t, "alice")
+	if s.checkVisitorCert(request(&client), "app") {
+		t.Error("certificate of the tunnel client CA accepted from a visitor")
+	}
+	if s.checkVisitorCert(request(nil), "app") {
+		t.Error("visitor without certificate accepted")
+	}
+	if !s.checkVisitorCert(request(nil), "other") {
+		t.Error("visitor of a subdomain without visitor CA rejected")
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ogrok/gotunnel/pkg/auth"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultTokenExpiration is how long created tokens are valid by default
+const defaultTokenExpiration = 30 * 24 * time.Hour
+
+// defaultRotationOverlap is how long a rotated token stays valid by default
+const defaultRotationOverlap = 24 * time.Hour
+
+// openTokenStore opens the store of generated tokens: a PostgreSQL
+// database, a file, or memory when neither is configured
+func openTokenStore(file, dbURL string) (auth.TokenStore, error) {
+	switch {
+	case file != "" && dbURL != "":
+		return nil, fmt.Errorf("--token-file and --token-database are mutually exclusive")
+	case dbURL != "":
+		store, err := auth.NewPostgresTokenStore(dbURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open token database: %w", err)
+		}
+		return store, nil
+	case file != "":
+		store, err := auth.NewFileTokenStore(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open token file: %w", err)
+		}
+		return store, nil
+	default:
+		return auth.NewMemoryTokenStore(), nil
+	}
+}
+
+// tokenCommand returns the admin commands managing generated tokens. They
+// work on the store directly; a running server disconnects tunnels of
+// revoked tokens within tokenCheckInterval. Only rotate can go through the
+// admin API instead, so the server sends the new token to its clients.
+func tokenCommand() *cli.Command {
+	storeFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "token-file",
+			Usage: "File persisting generated tokens",
+		},
+		&cli.StringFlag{
+			Name:  "token-database",
+			Usage: "PostgreSQL URL persisting generated tokens",
+		},
+	}
+
+	return &cli.Command{
+		Name:    "token",
+		Aliases: []string{"tokens"},
+		Usage:   "Manage authentication tokens",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create a token and print its value",
+				Flags: append(append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "What or who the token is for",
+					},
+					&cli.DurationFlag{
+						Name:  "expires",
+						Value: defaultTokenExpiration,
+						Usage: "How long the token is valid",
+					},
+				}, tokenScopeFlags()...), storeFlags...),
+				Action: func(c *cli.Context) error {
+					tokens, err := openTokenManager(c)
+					if err != nil {
+						return err
+					}
+					if c.Duration("expires") <= 0 {
+						return fmt.Errorf("--expires must be positive")
+					}
+					token, err := tokens.CreateToken(c.String("name"), c.Duration("expires"), tokenScopes(c))
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("Created token %s, expiring %s\n", shortTokenID(token.ID), token.ExpiresAt.Format(time.RFC3339))
+					fmt.Printf("Token: %s\n", token.Value)
+					fmt.Println("The token is not stored and cannot be shown again.")
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List tokens",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Include revoked and expired tokens",
+					},
+				}, storeFlags...),
+				Action: func(c *cli.Context) error {
+					tokens, err := openTokenManager(c)
+					if err != nil {
+						return err
+					}
+					list, err := tokens.AllTokens()
+					if err != nil {
+						return err
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "ID\tNAME\tSTATUS\tCREATED\tEXPIRES\tLAST USED\tSCOPES")
+					for _, token := range list {
+						status := tokenStatus(token)
+						if (status == "revoked" || status == "expired") && !c.Bool("all") {
+							continue
+						}
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+							shortTokenID(token.ID),
+							orDash(token.Name),
+							status,
+							token.CreatedAt.Format(time.RFC3339),
+							token.ExpiresAt.Format(time.RFC3339),
+							formatLastUsed(token.LastUsed),
+							describeScopes(token.Scopes),
+						)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "Show the details of a token",
+				ArgsUsage: "<id|id-prefix|name>",
+				Flags:     storeFlags,
+				Action: func(c *cli.Context) error {
+					token, _, err := findTokenArg(c)
+					if err != nil {
+						return err
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintf(w, "ID:\t%s\n", token.ID)
+					fmt.Fprintf(w, "Name:\t%s\n", orDash(token.Name))
+					fmt.Fprintf(w, "Status:\t%s\n", tokenStatus(token))
+					fmt.Fprintf(w, "Created:\t%s\n", token.CreatedAt.Format(time.RFC3339))
+					fmt.Fprintf(w, "Expires:\t%s\n", token.ExpiresAt.Format(time.RFC3339))
+					fmt.Fprintf(w, "Last used:\t%s\n", formatLastUsed(token.LastUsed))
+					if token.ReplacedBy != "" {
+						fmt.Fprintf(w, "Replaced by:\t%s\n", shortTokenID(token.ReplacedBy))
+					}
+					if token.KeyID != "" {
+						fmt.Fprintf(w, "Challenge key:\t%s\n", token.KeyID)
+					} else {
+						fmt.Fprintf(w, "Challenge key:\tnone, rotate the token to use challenge authentication\n")
+					}
+					fmt.Fprintf(w, "Subdomains:\t%s\n", orDash(strings.Join(token.Scopes.Subdomains, ", ")))
+					fmt.Fprintf(w, "Tunnel types:\t%s\n", orDash(strings.Join(token.Scopes.TunnelTypes, ", ")))
+					fmt.Fprintf(w, "Networks:\t%s\n", orDash(strings.Join(token.Scopes.CIDRs, ", ")))
+					fmt.Fprintf(w, "Max tunnels:\t%s\n", formatLimit(int64(token.Scopes.MaxTunnels), ""))
+					fmt.Fprintf(w, "Max bandwidth:\t%s\n", formatLimit(token.Scopes.MaxBandwidth, " B/s"))
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "rotate",
+				Usage:     "Replace a token by a new one, keeping the old one valid for a while; with --admin-token the running server also sends the new token to its clients",
+				ArgsUsage: "<id|id-prefix|name>",
+				Flags: append(append([]cli.Flag{
+					&cli.DurationFlag{
+						Name:  "overlap",
+						Value: defaultRotationOverlap,
+						Usage: "How long the old token stays valid",
+					},
+				}, storeFlags...), adminFlags()...),
+				Action: func(c *cli.Context) error {
+					if c.Duration("overlap") < 0 {
+						return fmt.Errorf("--overlap must not be negative")
+					}
+					if c.String("admin-token") != "" {
+						return rotateTokenThroughAdmin(c)
+					}
+
+					token, tokens, err := findTokenArg(c)
+					if err != nil {
+						return err
+					}
+					successor, old, err := tokens.RotateToken(token.ID, c.Duration("overlap"))
+					if err != nil {
+						return fmt.Errorf("failed to rotate token: %w", err)
+					}
+
+					fmt.Printf("Rotated token %s to %s, expiring %s\n", shortTokenID(old.ID), shortTokenID(successor.ID), successor.ExpiresAt.Format(time.RFC3339))
+					fmt.Printf("Token: %s\n", successor.Value)
+					fmt.Printf("The old token stays valid until %s.\n", old.ExpiresAt.Format(time.RFC3339))
+					fmt.Println("Connected clients were not sent the new token and are disconnected when the old one expires; rotate with --admin-token to send it to them.")
+					return nil
+				},
+			},
+			{
+				Name:      "revoke",
+				Usage:     "Revoke a token; running servers disconnect its tunnels",
+				ArgsUsage: "<id|id-prefix|name>",
+				Flags:     storeFlags,
+				Action: func(c *cli.Context) error {
+					token, tokens, err := findTokenArg(c)
+					if err != nil {
+						return err
+					}
+					if err := tokens.RevokeTokenID(token.ID); err != nil {
+						return fmt.Errorf("failed to revoke token: %w", err)
+					}
+					fmt.Printf("Revoked token %s\n", shortTokenID(token.ID))
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// tokenScopeFlags returns the flags limiting a created token
+func tokenScopeFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "subdomain",
+			Usage: "Glob pattern of subdomains the token may use (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "type",
+			Usage: "Tunnel type the token may open: http, tcp or udp (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cidr",
+			Usage: "Network clients may connect from (can be repeated)",
+		},
+		&cli.IntFlag{
+			Name:  "max-tunnels",
+			Usage: "Maximum number of tunnels open at the same time",
+		},
+		&cli.Int64Flag{
+			Name:  "max-bandwidth",
+			Usage: "Maximum traffic of all tunnels in bytes per second",
+		},
+	}
+}
+
+// tokenScopes reads the scopes given with tokenScopeFlags
+func tokenScopes(c *cli.Context) auth.TokenScopes {
+	return auth.TokenScopes{
+		Subdomains:   c.StringSlice("subdomain"),
+		TunnelTypes:  c.StringSlice("type"),
+		CIDRs:        c.StringSlice("cidr"),
+		MaxTunnels:   c.Int("max-tunnels"),
+		MaxBandwidth: c.Int64("max-bandwidth"),
+	}
+}
+
+// openTokenManager opens the persistent token store given on the command line
+func openTokenManager(c *cli.Context) (*auth.TokenManager, error) {
+	if c.String("token-file") == "" && c.String("token-database") == "" {
+		return nil, fmt.Errorf("--token-file or --token-database is required")
+	}
+	store, err := openTokenStore(c.String("token-file"), c.String("token-database"))
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewTokenManagerWithStore(store), nil
+}
+
+// findTokenArg resolves the token referenced by the first argument
+func findTokenArg(c *cli.Context) (*auth.Token, *auth.TokenManager, error) {
+	if c.NArg() < 1 {
+		return nil, nil, fmt.Errorf("token ID or name is required")
+	}
+	tokens, err := openTokenManager(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := tokens.FindToken(c.Args().Get(0))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find token %s: %w", c.Args().Get(0), err)
+	}
+	return token, tokens, nil
+}
+
+// rotateTokenThroughAdmin rotates the token referenced by the first
+// argument through the admin API of the running server, which sends the
+// new token to the clients of the old one
+func rotateTokenThroughAdmin(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("token ID or name is required")
+	}
+
+	var rotated rotatedToken
+	path := "/admin/tokens/" + url.PathEscape(c.Args().Get(0)) + "/rotate"
+	req := rotateTokenRequest{Overlap: c.Duration("overlap").String()}
+	if err := adminRequest(c, http.MethodPost, path, req, &rotated); err != nil {
+		return fmt.Errorf("failed to rotate token: %w", err)
+	}
+
+	fmt.Printf("Rotated token %s to %s, expiring %s\n", shortTokenID(rotated.PreviousID), shortTokenID(rotated.ID), rotated.ExpiresAt.Format(time.RFC3339))
+	fmt.Printf("Token: %s\n", rotated.Value)
+	fmt.Printf("The old token stays valid until %s.\n", rotated.PreviousExpiresAt.Format(time.RFC3339))
+	fmt.Printf("Sent the new token to %d connected client(s).\n", rotated.Notified)
+	return nil
+}
+
+// tokenStatus describes whether a token can be used
+func tokenStatus(token *auth.Token) string {
+	switch {
+	case !token.Active:
+		return "revoked"
+	case time.Now().After(token.ExpiresAt):
+		return "expired"
+	case token.ReplacedBy != "":
+		return "rotated"
+	default:
+		return "active"
+	}
+}
+
+// describeScopes summarizes the limits of a token on one line
+func describeScopes(scopes auth.TokenScopes) string {
+	var parts []string
+	if len(scopes.Subdomains) > 0 {
+		parts = append(parts, "subdomains="+strings.Join(scopes.Subdomains, ","))
+	}
+	if len(scopes.TunnelTypes) > 0 {
+		parts = append(parts, "types="+strings.Join(scopes.TunnelTypes, ","))
+	}
+	if len(scopes.CIDRs) > 0 {
+		parts = append(parts, "cidrs="+strings.Join(scopes.CIDRs, ","))
+	}
+	if scopes.MaxTunnels > 0 {
+		parts = append(parts, fmt.Sprintf("max-tunnels=%d", scopes.MaxTunnels))
+	}
+	if scopes.MaxBandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("max-bandwidth=%d", scopes.MaxBandwidth))
+	}
+	if len(parts) == 0 {
+		return "unrestricted"
+	}
+	return strings.Join(parts, " ")
+}
+
+// shortTokenID abbreviates a token ID for display; any unique prefix can
+// be used to refer to the token
+func shortTokenID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// formatLastUsed formats when a token was last used
+func formatLastUsed(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// formatLimit formats a scope limit, where zero means unlimited
+func formatLimit(limit int64, unit string) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d%s", limit, unit)
+}
+
+// orDash returns s, or a dash when it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
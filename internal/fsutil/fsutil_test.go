@@ -0,0 +1,73 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("WriteFileAtomic failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("expected the new content, got %q (%v)", data, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left, got %d entries", len(entries))
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.lock")
+	first, err := LockFile(path)
+	if err != nil {
+		t.Fatalf("LockFile failed: %v", err)
+	}
+
+	locked := make(chan *FileLock)
+	go func() {
+		second, err := LockFile(path)
+		if err != nil {
+			t.Errorf("LockFile failed: %v", err)
+		}
+		locked <- second
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the second lock to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	select {
+	case second := <-locked:
+		second.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("expected the second lock after unlocking the first")
+	}
+}
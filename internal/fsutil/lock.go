@@ -0,0 +1,35 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileLock is an exclusive advisory lock on a file, held across processes
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile creates path if needed and blocks until it holds an exclusive
+// lock on it. The lock only excludes other users of LockFile; it doesn't
+// stop anyone from reading or writing the file.
+func LockFile(path string) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
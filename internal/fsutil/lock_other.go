@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package fsutil
+
+import "os"
+
+// Platforms without file locking only get the locking within a process
+// that callers do themselves
+
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -1,37 +1,110 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
-// Token represents an authentication token
+// ErrAmbiguousToken is returned when a token reference matches several tokens
+var ErrAmbiguousToken = errors.New("token reference is ambiguous")
+
+// ErrNotRotatable is returned when rotating a token that is no longer valid
+// or was already rotated
+var ErrNotRotatable = errors.New("token can't be rotated")
+
+// lastUsedResolution limits how often the last use of a token is written
+const lastUsedResolution = time.Minute
+
+// Token represents an authentication token. Value is only known right after
+// generation; stores keep the ID, which is the SHA-256 hash of the value.
 type Token struct {
-	ID        string
-	Value     string
-	CreatedAt time.Time
-	ExpiresAt time.Time
-	Active    bool
+	ID    string `json:"id"`
+	Value string `json:"-"`
+	// Name describes what or who the token was created for
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// LastUsed is when the token last authenticated a tunnel, to the minute
+	LastUsed time.Time `json:"last_used"`
+	Active   bool      `json:"active"`
+	// Scopes limit what the token may be used for
+	Scopes TokenScopes `json:"scopes"`
+	// Owner replaces the owner name derived from the token, so a token
+	// created by rotation keeps the reservations of the one it replaces
+	Owner string `json:"owner,omitempty"`
+	// ReplacedBy is the ID of the token this one was rotated to
+	ReplacedBy string `json:"replaced_by,omitempty"`
+	// ChallengeKey is the public key challenge responses of the token are
+	// verified with; KeyID identifies it in the responses. Tokens created
+	// before challenges existed have neither and must be rotated first.
+	ChallengeKey []byte `json:"challenge_key,omitempty"`
+	KeyID        string `json:"key_id,omitempty"`
+}
+
+// OwnerName returns the owner name of the token, the same as TokenOwner
+// returns for its value unless the token inherited another one
+func (t *Token) OwnerName() string {
+	if t.Owner != "" {
+		return t.Owner
+	}
+	hash, err := hex.DecodeString(t.ID)
+	if err != nil || len(hash) < 8 {
+		return "token:" + t.ID
+	}
+	return hashOwner(hash)
 }
 
 // TokenManager handles token generation and validation
 type TokenManager struct {
-	tokens map[string]*Token
+	store TokenStore
 }
 
-// NewTokenManager creates a new token manager
+// NewTokenManager creates a new token manager keeping tokens in memory
 func NewTokenManager() *TokenManager {
-	return &TokenManager{
-		tokens: make(map[string]*Token),
-	}
+	return NewTokenManagerWithStore(NewMemoryTokenStore())
+}
+
+// NewTokenManagerWithStore creates a token manager persisting tokens in store
+func NewTokenManagerWithStore(store TokenStore) *TokenManager {
+	return &TokenManager{store: store}
+}
+
+// HashToken returns the ID a token value is stored under
+func HashToken(tokenValue string) string {
+	hash := sha256.Sum256([]byte(tokenValue))
+	return hex.EncodeToString(hash[:])
 }
 
 // GenerateToken creates a new authentication token
 func (tm *TokenManager) GenerateToken(expiration time.Duration) (*Token, error) {
+	return tm.GenerateScopedToken(expiration, TokenScopes{})
+}
+
+// GenerateScopedToken creates a new authentication token limited by scopes
+func (tm *TokenManager) GenerateScopedToken(expiration time.Duration, scopes TokenScopes) (*Token, error) {
+	return tm.CreateToken("", expiration, scopes)
+}
+
+// CreateToken creates a new named authentication token limited by scopes
+func (tm *TokenManager) CreateToken(name string, expiration time.Duration, scopes TokenScopes) (*Token, error) {
+	if err := scopes.Validate(); err != nil {
+		return nil, err
+	}
+	return tm.createToken(&Token{Name: name, Scopes: scopes}, expiration)
+}
+
+// createToken gives token a new value valid for expiration and stores it
+func (tm *TokenManager) createToken(token *Token, expiration time.Duration) (*Token, error) {
+
 	// Generate random bytes for token
 	randomBytes := make([]byte, 32)
 	if _, err := rand.Read(randomBytes); err != nil {
@@ -40,32 +113,27 @@ func (tm *TokenManager) GenerateToken(expiration time.Duration) (*Token, error)
 
 	// Create token value (base64 encoded)
 	tokenValue := base64.URLEncoding.EncodeToString(randomBytes)
-	
-	// Create token hash for storage
-	hash := sha256.Sum256([]byte(tokenValue))
-	tokenID := hex.EncodeToString(hash[:])
 
 	now := time.Now()
-	token := &Token{
-		ID:        tokenID,
-		Value:     tokenValue,
-		CreatedAt: now,
-		ExpiresAt: now.Add(expiration),
-		Active:    true,
-	}
+	publicKey := TokenPublicKey(tokenValue)
+	token.ID = HashToken(tokenValue)
+	token.Value = tokenValue
+	token.ChallengeKey = publicKey
+	token.KeyID = TokenKeyID(publicKey)
+	token.CreatedAt = now
+	token.ExpiresAt = now.Add(expiration)
+	token.Active = true
 
-	tm.tokens[tokenID] = token
+	if err := tm.store.Save(token); err != nil {
+		return nil, fmt.Errorf("failed to store token: %w", err)
+	}
 	return token, nil
 }
 
 // ValidateToken validates a token and returns the token if valid
 func (tm *TokenManager) ValidateToken(tokenValue string) (*Token, bool) {
-	// Hash the token value
-	hash := sha256.Sum256([]byte(tokenValue))
-	tokenID := hex.EncodeToString(hash[:])
-
-	token, exists := tm.tokens[tokenID]
-	if !exists {
+	token, err := tm.store.Get(HashToken(tokenValue))
+	if err != nil {
 		return nil, false
 	}
 
@@ -77,26 +145,138 @@ func (tm *TokenManager) ValidateToken(tokenValue string) (*Token, bool) {
 	return token, true
 }
 
-// RevokeToken revokes a token
-func (tm *TokenManager) RevokeToken(tokenValue string) bool {
-	hash := sha256.Sum256([]byte(tokenValue))
-	tokenID := hex.EncodeToString(hash[:])
+// GetToken returns the token with the given ID, whether valid or not
+func (tm *TokenManager) GetToken(id string) (*Token, error) {
+	return tm.store.Get(id)
+}
+
+// FindToken returns the token referenced by its ID, a unique prefix of its
+// ID, or its name, whether valid or not
+func (tm *TokenManager) FindToken(ref string) (*Token, error) {
+	if ref == "" {
+		return nil, ErrTokenNotFound
+	}
+	if token, err := tm.store.Get(ref); err == nil || !errors.Is(err, ErrTokenNotFound) {
+		return token, err
+	}
+
+	tokens, err := tm.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches, current []*Token
+	for _, token := range tokens {
+		if token.Name != ref && !strings.HasPrefix(token.ID, ref) {
+			continue
+		}
+		matches = append(matches, token)
+		if token.ReplacedBy == "" {
+			current = append(current, token)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, ErrTokenNotFound
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(current) == 1:
+		// A name refers to the latest token when it was rotated
+		return current[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrAmbiguousToken, ref)
+	}
+}
+
+// RotateToken replaces a token by a new one with the same name, owner and
+// scopes, valid as long as the old one was when it was created. The old
+// token stays valid for overlap, or until it expires if that is sooner, so
+// clients can switch over without being disconnected.
+func (tm *TokenManager) RotateToken(id string, overlap time.Duration) (successor, old *Token, err error) {
+	old, err = tm.store.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkRotatable(old, time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	successor, err = tm.createToken(&Token{
+		Name:   old.Name,
+		Owner:  old.OwnerName(),
+		Scopes: old.Scopes,
+	}, old.ExpiresAt.Sub(old.CreatedAt))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The store checks again, as the token may have been revoked or
+	// rotated since it was read
+	old, err = tm.store.MarkRotated(id, successor.ID, time.Now().Add(overlap))
+	if err != nil {
+		tm.store.Delete(successor.ID)
+		if errors.Is(err, ErrNotRotatable) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("failed to update rotated token: %w", err)
+	}
+	return successor, old, nil
+}
+
+// checkRotatable returns ErrNotRotatable unless token is active, unexpired
+// and not rotated yet
+func checkRotatable(token *Token, now time.Time) error {
+	switch {
+	case !token.Active || now.After(token.ExpiresAt):
+		return fmt.Errorf("%w: it is revoked or expired", ErrNotRotatable)
+	case token.ReplacedBy != "":
+		return fmt.Errorf("%w: it was already rotated", ErrNotRotatable)
+	}
+	return nil
+}
+
+// FindByKeyID returns the token whose challenge key has the given ID
+func (tm *TokenManager) FindByKeyID(keyID string) (*Token, error) {
+	return tm.store.GetByKeyID(keyID)
+}
 
-	token, exists := tm.tokens[tokenID]
-	if !exists {
-		return false
+// AllTokens returns every stored token, including revoked and expired ones
+func (tm *TokenManager) AllTokens() ([]*Token, error) {
+	return tm.store.List()
+}
+
+// MarkUsed records that a token authenticated a client. Writes are limited
+// to one per lastUsedResolution so busy tokens don't hammer the store.
+func (tm *TokenManager) MarkUsed(token *Token) error {
+	now := time.Now()
+	if now.Sub(token.LastUsed) < lastUsedResolution {
+		return nil
 	}
 
-	token.Active = false
-	return true
+	token.LastUsed = now
+	return tm.store.TouchLastUsed(token.ID, now)
+}
+
+// RevokeToken revokes a token
+func (tm *TokenManager) RevokeToken(tokenValue string) bool {
+	return tm.RevokeTokenID(HashToken(tokenValue)) == nil
+}
+
+// RevokeTokenID revokes the token with the given ID
+func (tm *TokenManager) RevokeTokenID(id string) error {
+	return tm.store.Revoke(id)
 }
 
 // ListTokens returns all active tokens
 func (tm *TokenManager) ListTokens() []*Token {
+	tokens, err := tm.store.List()
+	if err != nil {
+		return nil
+	}
+
 	var activeTokens []*Token
 	now := time.Now()
-
-	for _, token := range tm.tokens {
+	for _, token := range tokens {
 		if token.Active && now.Before(token.ExpiresAt) {
 			activeTokens = append(activeTokens, token)
 		}
@@ -107,42 +287,76 @@ func (tm *TokenManager) ListTokens() []*Token {
 
 // CleanupExpired removes expired tokens
 func (tm *TokenManager) CleanupExpired() int {
+	tokens, err := tm.store.List()
+	if err != nil {
+		return 0
+	}
+
 	now := time.Now()
 	removed := 0
-
-	for id, token := range tm.tokens {
+	for _, token := range tokens {
 		if now.After(token.ExpiresAt) {
-			delete(tm.tokens, id)
-			removed++
+			if err := tm.store.Delete(token.ID); err == nil {
+				removed++
+			}
 		}
 	}
 
 	return removed
 }
 
+// TokenOwner returns the owner name used to bind resources such as
+// subdomain reservations to a token. Only a prefix of the token hash is
+// used so the token itself never ends up on disk.
+func TokenOwner(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hashOwner(hash[:])
+}
+
 // SimpleAuth provides a simple authentication mechanism
 type SimpleAuth struct {
-	tokenManager *TokenManager
+	tokenManager  *TokenManager
 	allowedTokens map[string]bool
+	// allowedKeys maps challenge key IDs to allowed tokens
+	allowedKeys map[string]string
+	mu          sync.RWMutex
 }
 
 // NewSimpleAuth creates a new simple authentication handler
 func NewSimpleAuth() *SimpleAuth {
+	return NewSimpleAuthWithStore(NewMemoryTokenStore())
+}
+
+// NewSimpleAuthWithStore creates a simple authentication handler whose
+// generated tokens are kept in store
+func NewSimpleAuthWithStore(store TokenStore) *SimpleAuth {
 	return &SimpleAuth{
-		tokenManager:  NewTokenManager(),
+		tokenManager:  NewTokenManagerWithStore(store),
 		allowedTokens: make(map[string]bool),
+		allowedKeys:   make(map[string]string),
 	}
 }
 
+// TokenManager returns the manager of generated tokens
+func (sa *SimpleAuth) TokenManager() *TokenManager {
+	return sa.tokenManager
+}
+
 // AddAllowedToken adds a token to the allowed list
 func (sa *SimpleAuth) AddAllowedToken(token string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
 	sa.allowedTokens[token] = true
+	sa.allowedKeys[TokenKeyID(TokenPublicKey(token))] = token
 }
 
 // Authenticate validates a token
 func (sa *SimpleAuth) Authenticate(token string) bool {
 	// Check if token is in allowed list
-	if sa.allowedTokens[token] {
+	sa.mu.RLock()
+	allowed := sa.allowedTokens[token]
+	sa.mu.RUnlock()
+	if allowed {
 		return true
 	}
 
@@ -151,6 +365,87 @@ func (sa *SimpleAuth) Authenticate(token string) bool {
 	return valid
 }
 
+// AuthenticateToken validates a token like Authenticate and returns the
+// stored token carrying its scopes, recording when it was last used. Tokens
+// given with AddAllowedToken are unscoped and return a nil token.
+func (sa *SimpleAuth) AuthenticateToken(token string) (*Token, bool) {
+	sa.mu.RLock()
+	allowed := sa.allowedTokens[token]
+	sa.mu.RUnlock()
+	if allowed {
+		return nil, true
+	}
+
+	stored, ok := sa.tokenManager.ValidateToken(token)
+	if !ok {
+		return nil, false
+	}
+	// Failing to record the use must not lock clients out
+	_ = sa.tokenManager.MarkUsed(stored)
+	return stored, true
+}
+
+// AuthenticateChallenge verifies a challenge response signed with the key
+// of a token and returns the identity of the token
+func (sa *SimpleAuth) AuthenticateChallenge(keyID, nonce string, params url.Values, signature string) (*Identity, error) {
+	sa.mu.RLock()
+	allowed, ok := sa.allowedKeys[keyID]
+	sa.mu.RUnlock()
+	if ok {
+		if !VerifyChallenge(TokenPublicKey(allowed), nonce, params, signature) {
+			return nil, ErrInvalidProof
+		}
+		return &Identity{Name: TokenOwner(allowed)}, nil
+	}
+
+	token, err := sa.tokenManager.FindByKeyID(keyID)
+	if errors.Is(err, ErrTokenNotFound) {
+		return nil, ErrInvalidProof
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !VerifyChallenge(token.ChallengeKey, nonce, params, signature) {
+		return nil, ErrInvalidProof
+	}
+	if !token.Active || time.Now().After(token.ExpiresAt) {
+		return nil, ErrInvalidProof
+	}
+
+	// Failing to record the use must not lock clients out
+	_ = sa.tokenManager.MarkUsed(token)
+	return &Identity{Name: token.OwnerName(), Scopes: token.Scopes, Token: token}, nil
+}
+
+// Authenticator returns sa as an Authenticator of tunnel clients
+func (sa *SimpleAuth) Authenticator() Authenticator {
+	return simpleAuthenticator{sa}
+}
+
+// simpleAuthenticator adapts SimpleAuth to the Authenticator interface
+type simpleAuthenticator struct {
+	*SimpleAuth
+}
+
+// Authenticate checks a token given with AddAllowedToken or generated by
+// the token manager
+func (a simpleAuthenticator) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	if creds.Username != "" {
+		return nil, ErrInvalidCredentials
+	}
+	token, ok := a.AuthenticateToken(creds.Secret)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	identity := &Identity{Name: TokenOwner(creds.Secret), Token: token}
+	if token != nil {
+		identity.Name = token.OwnerName()
+		identity.Scopes = token.Scopes
+	}
+	return identity, nil
+}
+
 // GenerateClientToken generates a token for client use
 func (sa *SimpleAuth) GenerateClientToken(expiration time.Duration) (string, error) {
 	token, err := sa.tokenManager.GenerateToken(expiration)
@@ -158,4 +453,4 @@ func (sa *SimpleAuth) GenerateClientToken(expiration time.Duration) (string, err
 		return "", err
 	}
 	return token.Value, nil
-} 
\ No newline at end of file
+}
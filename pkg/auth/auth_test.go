@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenManager_FindToken(t *testing.T) {
+	manager := NewTokenManager()
+	ci, err := manager.CreateToken("ci", time.Hour, TokenScopes{})
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	if _, err := manager.CreateToken("laptop", time.Hour, TokenScopes{}); err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+
+	for _, ref := range []string{ci.ID, ci.ID[:12], "ci"} {
+		found, err := manager.FindToken(ref)
+		if err != nil || found.ID != ci.ID {
+			t.Errorf("FindToken(%q) = %v, %v; want token %s", ref, found, err, ci.ID)
+		}
+	}
+
+	if _, err := manager.FindToken("missing"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+	// The empty prefix matches every token
+	if _, err := manager.FindToken(""); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for an empty reference, got %v", err)
+	}
+}
+
+func TestSimpleAuth_RecordsLastUsed(t *testing.T) {
+	sa := NewSimpleAuth()
+	token, err := sa.TokenManager().CreateToken("ci", time.Hour, TokenScopes{})
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+
+	if _, ok := sa.AuthenticateToken(token.Value); !ok {
+		t.Fatal("expected token to authenticate")
+	}
+	stored, err := sa.TokenManager().GetToken(token.ID)
+	if err != nil {
+		t.Fatalf("GetToken failed: %v", err)
+	}
+	if stored.LastUsed.IsZero() {
+		t.Error("expected last use to be recorded")
+	}
+
+	// A use recorded concurrently with a revocation must not reactivate it
+	if err := sa.TokenManager().RevokeTokenID(token.ID); err != nil {
+		t.Fatalf("RevokeTokenID failed: %v", err)
+	}
+	token.LastUsed = time.Time{}
+	if err := sa.TokenManager().MarkUsed(token); err != nil {
+		t.Fatalf("MarkUsed failed: %v", err)
+	}
+	if _, ok := sa.AuthenticateToken(token.Value); ok {
+		t.Error("expected revoked token to be rejected")
+	}
+}
+
+func TestTokenManager_RotateToken(t *testing.T) {
+	sa := NewSimpleAuth()
+	manager := sa.TokenManager()
+	old, err := manager.CreateToken("ci", 24*time.Hour, TokenScopes{Subdomains: []string{"ci-*"}})
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+
+	successor, rotated, err := manager.RotateToken(old.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("RotateToken failed: %v", err)
+	}
+	if successor.Name != "ci" || successor.Scopes.Subdomains[0] != "ci-*" {
+		t.Errorf("expected the successor to keep name and scopes, got %+v", successor)
+	}
+	if successor.ExpiresAt.Sub(successor.CreatedAt) != 24*time.Hour {
+		t.Errorf("expected the successor to be valid for a day, got %s", successor.ExpiresAt.Sub(successor.CreatedAt))
+	}
+	if rotated.ReplacedBy != successor.ID || time.Until(rotated.ExpiresAt) > time.Hour {
+		t.Errorf("expected the old token to expire within the overlap, got %+v", rotated)
+	}
+
+	// Both tokens work during the overlap and share the owner
+	oldIdentity, err := sa.Authenticator().Authenticate(context.Background(), Credentials{Secret: old.Value})
+	if err != nil {
+		t.Fatalf("old token rejected during the overlap: %v", err)
+	}
+	newIdentity, err := sa.Authenticator().Authenticate(context.Background(), Credentials{Secret: successor.Value})
+	if err != nil {
+		t.Fatalf("successor rejected: %v", err)
+	}
+	if oldIdentity.Name != TokenOwner(old.Value) || newIdentity.Name != oldIdentity.Name {
+		t.Errorf("expected the successor to keep owner %s, got %s", oldIdentity.Name, newIdentity.Name)
+	}
+
+	// The name now refers to the successor
+	if found, err := manager.FindToken("ci"); err != nil || found.ID != successor.ID {
+		t.Errorf("FindToken(ci) = %v, %v; want the successor", found, err)
+	}
+
+	if _, _, err := manager.RotateToken(old.ID, time.Hour); !errors.Is(err, ErrNotRotatable) {
+		t.Errorf("expected ErrNotRotatable rotating twice, got %v", err)
+	}
+}
+
+func TestTokenManager_ConcurrentRevokeAndRotate(t *testing.T) {
+	stores := map[string]func() TokenStore{
+		"memory": func() TokenStore { return NewMemoryTokenStore() },
+		"file": func() TokenStore {
+			store, err := NewFileTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+			if err != nil {
+				t.Fatalf("NewFileTokenStore failed: %v", err)
+			}
+			return store
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			manager := NewTokenManagerWithStore(newStore())
+			for i := 0; i < 20; i++ {
+				token, err := manager.CreateToken("ci", time.Hour, TokenScopes{})
+				if err != nil {
+					t.Fatalf("CreateToken failed: %v", err)
+				}
+
+				var wg sync.WaitGroup
+				var successor *Token
+				var rotateErr error
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					if err := manager.RevokeTokenID(token.ID); err != nil {
+						t.Errorf("RevokeTokenID failed: %v", err)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					successor, _, rotateErr = manager.RotateToken(token.ID, time.Minute)
+				}()
+				wg.Wait()
+
+				// Whichever ran first, the revocation sticks
+				if _, ok := manager.ValidateToken(token.Value); ok {
+					t.Fatalf("revoked token %d is valid again", i)
+				}
+				switch {
+				case errors.Is(rotateErr, ErrNotRotatable):
+					if tokens, _ := manager.AllTokens(); len(tokens) != i+1 {
+						t.Fatalf("a failed rotation left its successor behind: %d tokens", len(tokens))
+					}
+				case rotateErr != nil:
+					t.Fatalf("RotateToken failed: %v", rotateErr)
+				default:
+					// Rotated first: drop the successor so the count holds
+					if err := manager.store.Delete(successor.ID); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
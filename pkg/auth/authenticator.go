@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// ErrInvalidCredentials is returned by authenticators that don't know the
+// credentials they were given
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Credentials are what a tunnel client authenticates with
+type Credentials struct {
+	// Username is set for clients using password authentication
+	Username string
+	// Secret is the token, or the password when Username is set
+	Secret string
+	// RemoteIP is the address the client connects from
+	RemoteIP net.IP
+}
+
+// Identity is who a client authenticated as and what it may do
+type Identity struct {
+	// Name is the owner that tunnels and reservations are bound to
+	Name string
+	// Scopes limit the tunnels the identity may open
+	Scopes TokenScopes
+	// Token is set for clients authenticated by a generated token, whose
+	// revocation or expiry closes their tunnels
+	Token *Token
+}
+
+// Authorize checks a tunnel request against the identity's permissions
+func (id *Identity) Authorize(req TunnelRequest) error {
+	if id.Token != nil {
+		return id.Token.Authorize(req)
+	}
+	return id.Scopes.Authorize(req)
+}
+
+// Authenticator checks the credentials of tunnel clients. Implementations
+// return ErrInvalidCredentials for credentials they don't accept, and other
+// errors when they can't decide, e.g. because a backend is unavailable.
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (*Identity, error)
+}
+
+// ChallengeAuthenticator is implemented by authenticators that know the
+// tokens they accept and can therefore verify challenge responses, so
+// clients never have to send their token
+type ChallengeAuthenticator interface {
+	AuthenticateChallenge(keyID, nonce string, params url.Values, signature string) (*Identity, error)
+}
+
+// Chain tries authenticators in order and returns the first identity one
+// of them accepts
+type Chain []Authenticator
+
+// Authenticate asks each authenticator in turn. It stops at the first
+// error other than ErrInvalidCredentials.
+func (c Chain) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(ctx, creds)
+		if errors.Is(err, ErrInvalidCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// AuthenticateChallenge asks each authenticator that verifies challenges
+func (c Chain) AuthenticateChallenge(keyID, nonce string, params url.Values, signature string) (*Identity, error) {
+	for _, authenticator := range c {
+		challenger, ok := authenticator.(ChallengeAuthenticator)
+		if !ok {
+			continue
+		}
+		identity, err := challenger.AuthenticateChallenge(keyID, nonce, params, signature)
+		if errors.Is(err, ErrInvalidProof) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrInvalidProof
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticTokenAuth(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.yaml")
+	data := `tokens:
+  - token: ci-secret
+    name: ci
+    scopes:
+      subdomains: ["ci-*"]
+      max_tunnels: 2
+  - token: anonymous-secret
+`
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadStaticTokens(file)
+	if err != nil {
+		t.Fatalf("LoadStaticTokens failed: %v", err)
+	}
+	static, err := NewStaticTokenAuth(tokens)
+	if err != nil {
+		t.Fatalf("NewStaticTokenAuth failed: %v", err)
+	}
+
+	identity, err := static.Authenticate(context.Background(), Credentials{Secret: "ci-secret"})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if identity.Name != "static:ci" || identity.Scopes.MaxTunnels != 2 || len(identity.Scopes.Subdomains) != 1 {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	identity, err = static.Authenticate(context.Background(), Credentials{Secret: "anonymous-secret"})
+	if err != nil || identity.Name != TokenOwner("anonymous-secret") {
+		t.Errorf("unnamed token: got %+v, %v", identity, err)
+	}
+
+	if _, err := static.Authenticate(context.Background(), Credentials{Secret: "wrong"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Static tokens can be proven by challenge as well
+	params := url.Values{"subdomain": {"ci-1"}}
+	keyID := TokenKeyID(TokenPublicKey("ci-secret"))
+	identity, err = static.AuthenticateChallenge(keyID, "nonce", params, SignChallenge(TokenKey("ci-secret"), "nonce", params))
+	if err != nil || identity.Name != "static:ci" {
+		t.Errorf("challenge: got %+v, %v", identity, err)
+	}
+
+	if _, err := NewStaticTokenAuth([]StaticToken{{Token: "a"}, {Token: "a"}}); err == nil {
+		t.Error("expected duplicate tokens to be rejected")
+	}
+}
+
+func TestChain(t *testing.T) {
+	simple := NewSimpleAuth()
+	simple.AddAllowedToken("allowed")
+	static, err := NewStaticTokenAuth([]StaticToken{{Token: "listed", Name: "listed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := Chain{simple.Authenticator(), static}
+
+	for secret, owner := range map[string]string{
+		"allowed": TokenOwner("allowed"),
+		"listed":  "static:listed",
+	} {
+		identity, err := chain.Authenticate(context.Background(), Credentials{Secret: secret})
+		if err != nil || identity.Name != owner {
+			t.Errorf("%s: got %+v, %v; want owner %s", secret, identity, err, owner)
+		}
+	}
+
+	if _, err := chain.Authenticate(context.Background(), Credentials{Secret: "unknown"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+
+	params := url.Values{}
+	keyID := TokenKeyID(TokenPublicKey("listed"))
+	if _, err := chain.AuthenticateChallenge(keyID, "n", params, SignChallenge(TokenKey("listed"), "n", params)); err != nil {
+		t.Errorf("expected the chain to find the static token by challenge: %v", err)
+	}
+}
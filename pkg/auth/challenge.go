@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ChallengeMethodToken proves possession of a token with an Ed25519
+// signature by a key derived from the token
+const ChallengeMethodToken = "token-ed25519"
+
+// challengeContext separates challenge signatures from other uses of the key
+const challengeContext = "gotunnel-challenge-v1"
+
+// tokenKeyContext separates the derivation of token keys from other hashes
+// of the token, such as its ID
+const tokenKeyContext = "gotunnel-token-key-v1"
+
+// ErrInvalidProof is returned when a challenge response doesn't verify
+var ErrInvalidProof = errors.New("invalid challenge response")
+
+// NewNonce returns a random challenge nonce
+func NewNonce() (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// TokenKey derives the key a client proves possession of a token with.
+// Its seed is an HMAC of the token, so the token ID, which is a plain hash
+// of the token, doesn't reveal it, and stores only keep its public half.
+func TokenKey(tokenValue string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, []byte(tokenValue))
+	mac.Write([]byte(tokenKeyContext))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// TokenPublicKey returns the public key challenge responses of a token are
+// verified with
+func TokenPublicKey(tokenValue string) ed25519.PublicKey {
+	return TokenKey(tokenValue).Public().(ed25519.PublicKey)
+}
+
+// TokenKeyID identifies the key of a token in challenge responses
+func TokenKeyID(publicKey ed25519.PublicKey) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:8])
+}
+
+// hashOwner returns the owner name of the token with the given hash, the
+// same as TokenOwner returns for the token itself
+func hashOwner(hash []byte) string {
+	return "token:" + hex.EncodeToString(hash[:8])
+}
+
+// ChallengeMessage returns the bytes signed in a challenge response: the
+// nonce together with the session parameters the client asked for, so
+// neither can be swapped out by someone relaying the response
+func ChallengeMessage(nonce string, params url.Values) []byte {
+	return []byte(challengeContext + "\n" + nonce + "\n" + params.Encode())
+}
+
+// SignChallenge computes the challenge response for a token key
+func SignChallenge(key ed25519.PrivateKey, nonce string, params url.Values) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, ChallengeMessage(nonce, params)))
+}
+
+// VerifyChallenge checks a challenge response against the public key of a
+// token
+func VerifyChallenge(publicKey ed25519.PublicKey, nonce string, params url.Values, signature string) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, ChallengeMessage(nonce, params), sig)
+}
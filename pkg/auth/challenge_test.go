@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignChallenge(t *testing.T) {
+	publicKey := TokenPublicKey("secret")
+	params := url.Values{"subdomain": {"demo"}, "host": {"tunnel.example.com"}}
+	signature := SignChallenge(TokenKey("secret"), "nonce", params)
+
+	if !VerifyChallenge(publicKey, "nonce", params, signature) {
+		t.Fatal("expected signature to verify")
+	}
+	if VerifyChallenge(publicKey, "other-nonce", params, signature) {
+		t.Error("signature verified for another nonce")
+	}
+	tampered := url.Values{"subdomain": {"admin"}, "host": {"tunnel.example.com"}}
+	if VerifyChallenge(publicKey, "nonce", tampered, signature) {
+		t.Error("signature verified for other session parameters")
+	}
+	if VerifyChallenge(TokenPublicKey("other"), "nonce", params, signature) {
+		t.Error("signature verified with another key")
+	}
+}
+
+func TestTokenKey_NotStored(t *testing.T) {
+	manager := NewTokenManager()
+	token, err := manager.CreateToken("ci", time.Hour, TokenScopes{})
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	stored, err := manager.GetToken(token.ID)
+	if err != nil {
+		t.Fatalf("GetToken failed: %v", err)
+	}
+	if stored.KeyID != TokenKeyID(TokenPublicKey(token.Value)) {
+		t.Error("expected the stored key ID to match the client's")
+	}
+
+	id, err := hex.DecodeString(stored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := TokenKey(token.Value).Seed()
+	if bytes.Equal(seed, id) || bytes.Contains(stored.ChallengeKey, seed) {
+		t.Fatal("the signing key must not be stored")
+	}
+
+	// The token ID, which anyone listing tokens sees, can't sign challenges
+	params := url.Values{}
+	forged := SignChallenge(ed25519.NewKeyFromSeed(id), "nonce", params)
+	if VerifyChallenge(stored.ChallengeKey, "nonce", params, forged) {
+		t.Error("a challenge response signed with the token ID verified")
+	}
+	if !VerifyChallenge(stored.ChallengeKey, "nonce", params, SignChallenge(TokenKey(token.Value), "nonce", params)) {
+		t.Error("expected the token holder's response to verify")
+	}
+}
+
+func TestSimpleAuth_AuthenticateChallenge(t *testing.T) {
+	sa := NewSimpleAuth()
+	sa.AddAllowedToken("static")
+	generated, err := sa.TokenManager().CreateToken("ci", time.Hour, TokenScopes{})
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+
+	params := url.Values{"subdomain": {"demo"}}
+	prove := func(token string) (*Identity, error) {
+		keyID := TokenKeyID(TokenPublicKey(token))
+		return sa.AuthenticateChallenge(keyID, "nonce", params, SignChallenge(TokenKey(token), "nonce", params))
+	}
+
+	identity, err := prove("static")
+	if err != nil || identity.Token != nil || identity.Name != TokenOwner("static") {
+		t.Errorf("static token: got %+v, %v", identity, err)
+	}
+
+	identity, err = prove(generated.Value)
+	if err != nil || identity.Token == nil || identity.Token.ID != generated.ID || identity.Name != TokenOwner(generated.Value) {
+		t.Errorf("generated token: got %+v, %v", identity, err)
+	}
+
+	if _, err := prove("unknown"); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("expected ErrInvalidProof for an unknown token, got %v", err)
+	}
+
+	if err := sa.TokenManager().RevokeTokenID(generated.ID); err != nil {
+		t.Fatalf("RevokeTokenID failed: %v", err)
+	}
+	if _, err := prove(generated.Value); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("expected ErrInvalidProof for a revoked token, got %v", err)
+	}
+}
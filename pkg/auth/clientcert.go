@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownCertificate is returned for client certificates that match no mapping
+var ErrUnknownCertificate = errors.New("client certificate is not mapped to an identity")
+
+// CertMapping maps client certificates to an identity
+type CertMapping struct {
+	// Match is compared with the subject common name and the DNS, email
+	// and URI SANs of the certificate; "*" matches every certificate
+	Match string `yaml:"match" json:"match"`
+	// Identity names the tunnel owner; defaults to the matched value
+	Identity string `yaml:"identity" json:"identity"`
+	// Subdomains are glob patterns of the subdomains the identity may use;
+	// empty allows all
+	Subdomains []string `yaml:"subdomains" json:"subdomains"`
+}
+
+// CertIdentity is the identity a client certificate was mapped to
+type CertIdentity struct {
+	Name       string
+	Subdomains []string
+}
+
+// AllowsSubdomain reports whether the identity may open a tunnel on subdomain
+func (ci *CertIdentity) AllowsSubdomain(subdomain string) bool {
+	if len(ci.Subdomains) == 0 {
+		return true
+	}
+	for _, pattern := range ci.Subdomains {
+		if ok, _ := path.Match(pattern, subdomain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCertAuth authenticates tunnel clients by the certificate they
+// presented during the TLS handshake
+type ClientCertAuth struct {
+	mappings []CertMapping
+}
+
+// NewClientCertAuth creates a client certificate authenticator. Without
+// mappings every verified certificate is accepted as its common name.
+func NewClientCertAuth(mappings []CertMapping) *ClientCertAuth {
+	return &ClientCertAuth{mappings: mappings}
+}
+
+// LoadCertMappings reads a YAML list of certificate mappings
+func LoadCertMappings(file string) ([]CertMapping, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate mappings: %w", err)
+	}
+
+	var mappings []CertMapping
+	if err := yaml.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate mappings: %w", err)
+	}
+	for i, m := range mappings {
+		if m.Match == "" {
+			return nil, fmt.Errorf("certificate mapping %d has no match", i+1)
+		}
+	}
+	return mappings, nil
+}
+
+// Identify maps a verified client certificate to an identity
+func (ca *ClientCertAuth) Identify(cert *x509.Certificate) (*CertIdentity, error) {
+	names := certificateNames(cert)
+
+	if len(ca.mappings) == 0 {
+		if cert.Subject.CommonName == "" {
+			return nil, ErrUnknownCertificate
+		}
+		return &CertIdentity{Name: cert.Subject.CommonName}, nil
+	}
+
+	for _, m := range ca.mappings {
+		for _, name := range names {
+			if m.Match != "*" && !strings.EqualFold(m.Match, name) {
+				continue
+			}
+
+			identity := m.Identity
+			if identity == "" {
+				identity = name
+			}
+			return &CertIdentity{Name: identity, Subdomains: m.Subdomains}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCertificate, cert.Subject)
+}
+
+// CertOwner returns the owner name of a certificate identity, the
+// counterpart of TokenOwner
+func CertOwner(identity *CertIdentity) string {
+	return "cert:" + identity.Name
+}
+
+// certificateNames lists the names a mapping can match, common name first
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
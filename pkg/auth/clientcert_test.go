@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientCertAuth_Identify(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/ci")
+	alice := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, EmailAddresses: []string{"alice@example.com"}}
+	ci := &x509.Certificate{URIs: []*url.URL{spiffe}}
+	mallory := &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}}
+
+	ca := NewClientCertAuth([]CertMapping{
+		{Match: "alice@example.com", Identity: "alice", Subdomains: []string{"alice-*", "demo"}},
+		{Match: "spiffe://example.com/ci"},
+	})
+
+	identity, err := ca.Identify(alice)
+	if err != nil {
+		t.Fatalf("Identify failed: %v", err)
+	}
+	if identity.Name != "alice" || CertOwner(identity) != "cert:alice" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	if !identity.AllowsSubdomain("alice-api") || !identity.AllowsSubdomain("demo") || identity.AllowsSubdomain("bob") {
+		t.Error("subdomain patterns not applied")
+	}
+
+	identity, err = ca.Identify(ci)
+	if err != nil {
+		t.Fatalf("Identify failed: %v", err)
+	}
+	if identity.Name != "spiffe://example.com/ci" || !identity.AllowsSubdomain("anything") {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	if _, err := ca.Identify(mallory); !errors.Is(err, ErrUnknownCertificate) {
+		t.Errorf("expected ErrUnknownCertificate, got %v", err)
+	}
+
+	// Without mappings the common name is the identity
+	identity, err = NewClientCertAuth(nil).Identify(mallory)
+	if err != nil || identity.Name != "mallory" {
+		t.Errorf("expected common name identity, got %+v, %v", identity, err)
+	}
+}
+
+func TestLoadCertMappings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "certs.yaml")
+	data := "- match: alice\n  subdomains: [\"alice-*\"]\n- identity: nobody\n"
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertMappings(file); err == nil {
+		t.Error("expected error for mapping without match")
+	}
+
+	if err := os.WriteFile(file, []byte(data[:strings.Index(data, "- identity")]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mappings, err := LoadCertMappings(file)
+	if err != nil {
+		t.Fatalf("LoadCertMappings failed: %v", err)
+	}
+	if len(mappings) != 1 || mappings[0].Match != "alice" || mappings[0].Subdomains[0] != "alice-*" {
+		t.Errorf("unexpected mappings %+v", mappings)
+	}
+}
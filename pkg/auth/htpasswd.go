@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuth authenticates clients by username and password against an
+// htpasswd file. Only bcrypt ("htpasswd -B") and {SHA} hashes are
+// supported. The file is reloaded when it changes.
+type HtpasswdAuth struct {
+	path    string
+	modTime time.Time
+	users   map[string]string
+	mu      sync.Mutex
+}
+
+// NewHtpasswdAuth loads the htpasswd file at path
+func NewHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{path: path}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// refresh reloads the file when it changed since it was last read
+func (a *HtpasswdAuth) refresh() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat htpasswd file: %w", err)
+	}
+	if info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return err
+	}
+	a.users = users
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// parseHtpasswd parses "user:hash" lines, skipping blank lines and comments
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("invalid htpasswd entry on line %d", line)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("unsupported password hash for %s, use bcrypt (htpasswd -B)", user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// Authenticate checks the username and password of the client
+func (a *HtpasswdAuth) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	if creds.Username == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	a.mu.Lock()
+	err := a.refresh()
+	hash, ok := a.users[creds.Username]
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !checkPassword(hash, creds.Secret) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Name: "htpasswd:" + creds.Username}, nil
+}
+
+// checkPassword compares a password with an htpasswd hash
+func checkPassword(hash, password string) bool {
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
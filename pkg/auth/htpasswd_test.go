@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	// The {SHA} entry is the hash of "password"
+	data := "# tunnel users\nalice:" + string(hash) + "\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	htpasswd, err := NewHtpasswdAuth(file)
+	if err != nil {
+		t.Fatalf("NewHtpasswdAuth failed: %v", err)
+	}
+
+	ctx := context.Background()
+	identity, err := htpasswd.Authenticate(ctx, Credentials{Username: "alice", Secret: "s3cret"})
+	if err != nil || identity.Name != "htpasswd:alice" {
+		t.Errorf("alice: got %+v, %v", identity, err)
+	}
+	if _, err := htpasswd.Authenticate(ctx, Credentials{Username: "bob", Secret: "password"}); err != nil {
+		t.Errorf("bob: %v", err)
+	}
+
+	for _, creds := range []Credentials{
+		{Username: "alice", Secret: "wrong"},
+		{Username: "carol", Secret: "s3cret"},
+		{Secret: "s3cret"},
+	} {
+		if _, err := htpasswd.Authenticate(ctx, creds); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%+v: expected ErrInvalidCredentials, got %v", creds, err)
+		}
+	}
+
+	// Removing a user takes effect without restarting
+	if err := os.WriteFile(file, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := htpasswd.Authenticate(ctx, Credentials{Username: "alice", Secret: "s3cret"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected removed user to be rejected, got %v", err)
+	}
+}
+
+func TestHtpasswdAuth_UnsupportedHash(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte("alice:$apr1$salt$hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHtpasswdAuth(file); err == nil {
+		t.Error("expected MD5 hashes to be rejected")
+	}
+}
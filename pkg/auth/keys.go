@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ChallengeMethodEd25519 proves possession of an Ed25519 identity key with
+// an SSH signature over the challenge message
+const ChallengeMethodEd25519 = "ed25519"
+
+// GenerateIdentity creates an Ed25519 identity key. It returns the private
+// key in OpenSSH format and the public key as an authorized_keys line.
+func GenerateIdentity(comment string) (privateKey, publicKey []byte, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(sshPub), []byte("\n"))
+	if comment != "" {
+		line = append(line, " "+comment...)
+	}
+	return pem.EncodeToMemory(block), append(line, '\n'), nil
+}
+
+// LoadIdentity reads an Ed25519 identity key in OpenSSH format, as written
+// by GenerateIdentity or ssh-keygen -t ed25519
+func LoadIdentity(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("identity key %s is encrypted, which is not supported", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity key: %w", err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("identity key %s is %s, only Ed25519 keys are supported", path, signer.PublicKey().Type())
+	}
+	return signer, nil
+}
+
+// KeyFingerprint identifies a public key in challenge responses and
+// authorized_keys listings, in the format ssh-keygen -l prints
+func KeyFingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+// SignChallengeWithKey computes the challenge response for an identity key
+func SignChallengeWithKey(signer ssh.Signer, nonce string, params url.Values) (string, error) {
+	sig, err := signer.Sign(rand.Reader, ChallengeMessage(nonce, params))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign challenge: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(ssh.Marshal(sig)), nil
+}
+
+// VerifyKeyChallenge checks a challenge response signed with an identity key
+func VerifyKeyChallenge(key ssh.PublicKey, nonce string, params url.Values, signature string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(data, &sig); err != nil {
+		return false
+	}
+	return key.Verify(ChallengeMessage(nonce, params), &sig) == nil
+}
+
+// AuthorizedKey is an identity key allowed to open tunnels
+type AuthorizedKey struct {
+	Key ssh.PublicKey
+	// User names the owner of the key; keys of the same user share
+	// reservations and tunnels
+	User string
+	// Subdomains are glob patterns the key may use; empty allows any
+	Subdomains []string
+}
+
+// AuthorizedKeysAuth authenticates clients by signatures of identity keys
+// listed in an authorized_keys file:
+//
+//	user="alice",subdomains="alice-*,demo" ssh-ed25519 AAAAC3Nz... alice@laptop
+//
+// The user defaults to the key comment. The file is reloaded when it changes.
+type AuthorizedKeysAuth struct {
+	path    string
+	modTime time.Time
+	// keys maps fingerprints to authorized keys
+	keys map[string]*AuthorizedKey
+	mu   sync.Mutex
+}
+
+// NewAuthorizedKeysAuth loads the authorized_keys file at path
+func NewAuthorizedKeysAuth(path string) (*AuthorizedKeysAuth, error) {
+	a := &AuthorizedKeysAuth{path: path}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// refresh reloads the file when it changed since it was last read
+func (a *AuthorizedKeysAuth) refresh() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat authorized keys file: %w", err)
+	}
+	if info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to read authorized keys file: %w", err)
+	}
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return err
+	}
+	a.keys = keys
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// parseAuthorizedKeys parses authorized_keys lines, skipping blank lines and
+// comments. Options other than user and subdomains are rejected rather than
+// ignored, as they would not restrict anything.
+func parseAuthorizedKeys(data []byte) (map[string]*AuthorizedKey, error) {
+	keys := make(map[string]*AuthorizedKey)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid authorized key on line %d: %w", line, err)
+		}
+		if pub.Type() != ssh.KeyAlgoED25519 {
+			return nil, fmt.Errorf("unsupported key type %s on line %d, only Ed25519 keys are supported", pub.Type(), line)
+		}
+
+		key := &AuthorizedKey{Key: pub, User: comment}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			value = strings.Trim(value, `"`)
+			switch name {
+			case "user":
+				key.User = value
+			case "subdomains":
+				key.Subdomains = strings.Split(value, ",")
+			default:
+				return nil, fmt.Errorf("unsupported option %q on line %d", name, line)
+			}
+		}
+		if key.User == "" {
+			return nil, fmt.Errorf("authorized key on line %d has no user option or comment", line)
+		}
+		if err := (TokenScopes{Subdomains: key.Subdomains}).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid authorized key on line %d: %w", line, err)
+		}
+
+		fingerprint := KeyFingerprint(pub)
+		if _, ok := keys[fingerprint]; ok {
+			return nil, fmt.Errorf("duplicate authorized key on line %d", line)
+		}
+		keys[fingerprint] = key
+	}
+	return keys, scanner.Err()
+}
+
+// AuthenticateKey verifies a challenge response signed with the identity
+// key with the given fingerprint and returns the identity of its user
+func (a *AuthorizedKeysAuth) AuthenticateKey(fingerprint, nonce string, params url.Values, signature string) (*Identity, error) {
+	a.mu.Lock()
+	err := a.refresh()
+	key, ok := a.keys[fingerprint]
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !VerifyKeyChallenge(key.Key, nonce, params, signature) {
+		return nil, ErrInvalidProof
+	}
+	return &Identity{
+		Name:   "key:" + key.User,
+		Scopes: TokenScopes{Subdomains: key.Subdomains},
+	}, nil
+}
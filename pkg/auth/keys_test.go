@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorizedKeysAuth(t *testing.T) {
+	dir := t.TempDir()
+	privateKey, publicKey, err := GenerateIdentity("alice@laptop")
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, privateKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := LoadIdentity(keyFile)
+	if err != nil {
+		t.Fatalf("LoadIdentity failed: %v", err)
+	}
+
+	file := filepath.Join(dir, "authorized_keys")
+	data := "# developers\nsubdomains=\"alice-*\" " + string(publicKey)
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewAuthorizedKeysAuth(file)
+	if err != nil {
+		t.Fatalf("NewAuthorizedKeysAuth failed: %v", err)
+	}
+
+	params := url.Values{"host": {"tunnel.example.com"}, "subdomain": {"alice-app"}}
+	signature, err := SignChallengeWithKey(signer, "nonce", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := KeyFingerprint(signer.PublicKey())
+
+	identity, err := keys.AuthenticateKey(fingerprint, "nonce", params, signature)
+	if err != nil {
+		t.Fatalf("AuthenticateKey failed: %v", err)
+	}
+	if identity.Name != "key:alice@laptop" {
+		t.Errorf("expected the comment as user, got %s", identity.Name)
+	}
+	if err := identity.Authorize(TunnelRequest{Subdomain: "bob-app"}); err == nil {
+		t.Error("expected subdomain outside the key's patterns to be rejected")
+	}
+
+	// The signature covers the nonce and the session parameters
+	if _, err := keys.AuthenticateKey(fingerprint, "other", params, signature); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("expected ErrInvalidProof for another nonce, got %v", err)
+	}
+	params.Set("subdomain", "bob-app")
+	if _, err := keys.AuthenticateKey(fingerprint, "nonce", params, signature); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("expected ErrInvalidProof for other parameters, got %v", err)
+	}
+
+	// Keys not in the file are rejected
+	if _, err := keys.AuthenticateKey("SHA256:unknown", "nonce", params, signature); !errors.Is(err, ErrInvalidProof) {
+		t.Errorf("expected ErrInvalidProof for an unknown key, got %v", err)
+	}
+}
+
+func TestParseAuthorizedKeysOptions(t *testing.T) {
+	_, publicKey, err := GenerateIdentity("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := parseAuthorizedKeys([]byte(`user="robert",subdomains="b-*,demo" ` + string(publicKey)))
+	if err != nil {
+		t.Fatalf("parseAuthorizedKeys failed: %v", err)
+	}
+	for _, key := range keys {
+		if key.User != "robert" || len(key.Subdomains) != 2 || key.Subdomains[1] != "demo" {
+			t.Errorf("unexpected key %+v", key)
+		}
+	}
+
+	_, anonymousKey, err := GenerateIdentity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		string(anonymousKey),
+		`from="10.0.0.0/8" ` + string(publicKey),
+		`subdomains="[" ` + string(publicKey),
+		string(publicKey) + string(publicKey),
+		"ssh-ed25519 not-base64",
+	} {
+		if _, err := parseAuthorizedKeys([]byte(line)); err == nil {
+			t.Errorf("expected %q to be rejected", line)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// lockoutPruneInterval is how often forgotten lockout entries are removed
+const lockoutPruneInterval = time.Minute
+
+// LockoutPolicy configures when sources of failed authentication attempts
+// are locked out
+type LockoutPolicy struct {
+	// Threshold is the number of consecutive failures that lock a source out
+	Threshold int
+	// Duration is how long the first lockout lasts; each further lockout
+	// of the same source doubles it
+	Duration time.Duration
+	// MaxDuration caps the lockout duration. A source without failures for
+	// that long starts over with a clean record.
+	MaxDuration time.Duration
+}
+
+// Lockout describes the failed attempts of a source
+type Lockout struct {
+	// Key identifies the source, such as "ip:192.0.2.1" or "identity:alice"
+	Key string `json:"key"`
+	// Failures counts failures since the last lockout or success
+	Failures int `json:"failures"`
+	// Lockouts counts how often the source was locked out in a row
+	Lockouts    int       `json:"lockouts"`
+	LastFailure time.Time `json:"last_failure"`
+	// Until is when the current lockout ends; zero when not locked out
+	Until time.Time `json:"until,omitempty"`
+}
+
+// Locked reports whether the source is locked out at now
+func (l *Lockout) Locked(now time.Time) bool {
+	return now.Before(l.Until)
+}
+
+// LockoutTracker counts failed authentication attempts per source and locks
+// sources out for exponentially growing periods
+type LockoutTracker struct {
+	policy LockoutPolicy
+
+	mu        sync.Mutex
+	entries   map[string]*Lockout
+	lastPrune time.Time
+}
+
+// NewLockoutTracker creates a tracker applying policy
+func NewLockoutTracker(policy LockoutPolicy) *LockoutTracker {
+	if policy.MaxDuration < policy.Duration {
+		policy.MaxDuration = policy.Duration
+	}
+	return &LockoutTracker{
+		policy:  policy,
+		entries: make(map[string]*Lockout),
+	}
+}
+
+// Check returns when the lockout of the first locked out key ends, if any
+func (t *LockoutTracker) Check(keys ...string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if entry, ok := t.entries[key]; ok && entry.Locked(now) {
+			return entry.Until, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Fail records a failed attempt of key. When it locks the source out, it
+// returns a copy of the lockout.
+func (t *LockoutTracker) Fail(key string) (*Lockout, bool) {
+	return t.fail(key, time.Now())
+}
+
+func (t *LockoutTracker) fail(key string, now time.Time) (*Lockout, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	entry, ok := t.entries[key]
+	if !ok || t.forgotten(entry, now) {
+		entry = &Lockout{Key: key}
+		t.entries[key] = entry
+	}
+	entry.LastFailure = now
+	if entry.Locked(now) {
+		return nil, false
+	}
+	entry.Failures++
+	if entry.Failures < t.policy.Threshold {
+		return nil, false
+	}
+
+	entry.Until = now.Add(t.lockoutDuration(entry.Lockouts))
+	entry.Lockouts++
+	entry.Failures = 0
+	locked := *entry
+	return &locked, true
+}
+
+// lockoutDuration returns the length of a lockout after previous lockouts
+func (t *LockoutTracker) lockoutDuration(previous int) time.Duration {
+	d := t.policy.Duration
+	for i := 0; i < previous && d < t.policy.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > t.policy.MaxDuration {
+		d = t.policy.MaxDuration
+	}
+	return d
+}
+
+// forgotten reports whether an entry has been quiet long enough to drop
+func (t *LockoutTracker) forgotten(entry *Lockout, now time.Time) bool {
+	return !entry.Locked(now) && now.Sub(entry.LastFailure) > t.policy.MaxDuration
+}
+
+// prune removes forgotten entries, at most once per lockoutPruneInterval
+func (t *LockoutTracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < lockoutPruneInterval {
+		return
+	}
+	t.lastPrune = now
+	for key, entry := range t.entries {
+		if t.forgotten(entry, now) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Succeed clears the failures of keys after a successful attempt. Sources
+// that are locked out stay locked out.
+func (t *LockoutTracker) Succeed(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if entry, ok := t.entries[key]; ok && !entry.Locked(now) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Locked returns the sources that are currently locked out, ordered by key
+func (t *LockoutTracker) Locked() []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var locked []Lockout
+	for _, entry := range t.entries {
+		if entry.Locked(now) {
+			locked = append(locked, *entry)
+		}
+	}
+	sort.Slice(locked, func(i, j int) bool { return locked[i].Key < locked[j].Key })
+	return locked
+}
+
+// Clear forgets the failures and lockouts of key and reports whether there
+// were any
+func (t *LockoutTracker) Clear(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+	return ok
+}
+
+// ClearAll forgets all failures and lockouts and returns how many sources
+// were locked out
+func (t *LockoutTracker) ClearAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	cleared := 0
+	for _, entry := range t.entries {
+		if entry.Locked(now) {
+			cleared++
+		}
+	}
+	t.entries = make(map[string]*Lockout)
+	return cleared
+}
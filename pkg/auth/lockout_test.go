@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutTracker(t *testing.T) {
+	tracker := NewLockoutTracker(LockoutPolicy{Threshold: 3, Duration: time.Minute, MaxDuration: 3 * time.Minute})
+	key := "ip:192.0.2.1"
+
+	for i := 0; i < 2; i++ {
+		if _, locked := tracker.Fail(key); locked {
+			t.Fatalf("locked out after %d failures", i+1)
+		}
+	}
+	lockout, locked := tracker.Fail(key)
+	if !locked {
+		t.Fatal("expected a lockout after 3 failures")
+	}
+	if lockout.Lockouts != 1 || time.Until(lockout.Until) > time.Minute {
+		t.Errorf("unexpected first lockout %+v", lockout)
+	}
+	if _, locked := tracker.Check("ip:198.51.100.1", key); !locked {
+		t.Error("expected Check to report the lockout")
+	}
+
+	// Success doesn't end a lockout, but clearing does
+	tracker.Succeed(key)
+	if len(tracker.Locked()) != 1 {
+		t.Error("expected the lockout to survive a success")
+	}
+	if !tracker.Clear(key) {
+		t.Error("expected Clear to find the lockout")
+	}
+	if _, locked := tracker.Check(key); locked {
+		t.Error("expected cleared source to be unlocked")
+	}
+}
+
+func TestLockoutTrackerBackoff(t *testing.T) {
+	tracker := NewLockoutTracker(LockoutPolicy{Threshold: 2, Duration: time.Minute, MaxDuration: 3 * time.Minute})
+	key := "identity:alice"
+	now := time.Now()
+
+	// Each lockout doubles, up to the maximum
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		tracker.fail(key, now)
+		lockout, locked := tracker.fail(key, now)
+		if !locked {
+			t.Fatal("expected a lockout")
+		}
+		if got := lockout.Until.Sub(now); got != expected {
+			t.Errorf("lockout %d: expected %s, got %s", lockout.Lockouts, expected, got)
+		}
+		// Failures during a lockout don't count
+		tracker.fail(key, now.Add(time.Second))
+		now = lockout.Until
+	}
+
+	// A quiet source starts over
+	now = now.Add(4 * time.Minute)
+	tracker.fail(key, now)
+	lockout, _ := tracker.fail(key, now)
+	if lockout == nil || lockout.Lockouts != 1 || lockout.Until.Sub(now) != time.Minute {
+		t.Errorf("expected the record to be forgotten, got %+v", lockout)
+	}
+}
+
+func TestLockoutTrackerSucceed(t *testing.T) {
+	tracker := NewLockoutTracker(LockoutPolicy{Threshold: 2, Duration: time.Minute})
+	tracker.Fail("ip:192.0.2.1")
+	tracker.Succeed("ip:192.0.2.1")
+	if _, locked := tracker.Fail("ip:192.0.2.1"); locked {
+		t.Error("expected a success to reset the failure count")
+	}
+	if n := tracker.ClearAll(); n != 0 {
+		t.Errorf("expected no locked out sources, got %d", n)
+	}
+}
@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgresTokenStore keeps tokens in a PostgreSQL table, so several server
+// instances can share them
+type PostgresTokenStore struct {
+	db *sql.DB
+}
+
+// NewPostgresTokenStore connects to the database at dbURL and creates the
+// tokens table if it doesn't exist yet
+func NewPostgresTokenStore(dbURL string) (*PostgresTokenStore, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	store := &PostgresTokenStore{db: db}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrate creates the tokens table
+func (s *PostgresTokenStore) migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS tunnel_tokens (
+			id         TEXT PRIMARY KEY,
+			created_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			active     BOOLEAN NOT NULL DEFAULT TRUE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tokens table: %w", err)
+	}
+
+	_, err = s.db.Exec(`ALTER TABLE tunnel_tokens ADD COLUMN IF NOT EXISTS scopes JSONB NOT NULL DEFAULT '{}'`)
+	if err != nil {
+		return fmt.Errorf("failed to add token scopes: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		ALTER TABLE tunnel_tokens
+			ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS last_used TIMESTAMPTZ
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add token names: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		ALTER TABLE tunnel_tokens
+			ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS replaced_by TEXT NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add token rotation: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		ALTER TABLE tunnel_tokens
+			ADD COLUMN IF NOT EXISTS challenge_key BYTEA,
+			ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add token challenge keys: %w", err)
+	}
+	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS tunnel_tokens_key_id ON tunnel_tokens (key_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to index token challenge keys: %w", err)
+	}
+	return nil
+}
+
+// tokenColumns are the columns read by scanToken, in order
+const tokenColumns = `id, name, created_at, expires_at, last_used, active, scopes, owner, replaced_by, challenge_key, key_id`
+
+// scanToken reads a token row of tokenColumns
+func scanToken(row interface{ Scan(...interface{}) error }) (*Token, error) {
+	var token Token
+	var lastUsed sql.NullTime
+	var scopes []byte
+	if err := row.Scan(&token.ID, &token.Name, &token.CreatedAt, &token.ExpiresAt, &lastUsed, &token.Active, &scopes, &token.Owner, &token.ReplacedBy, &token.ChallengeKey, &token.KeyID); err != nil {
+		return nil, err
+	}
+	token.LastUsed = lastUsed.Time
+	if err := json.Unmarshal(scopes, &token.Scopes); err != nil {
+		return nil, fmt.Errorf("invalid scopes of token %s: %w", token.ID, err)
+	}
+	return &token, nil
+}
+
+// Close closes the database connection
+func (s *PostgresTokenStore) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the token with the given ID
+func (s *PostgresTokenStore) Get(id string) (*Token, error) {
+	token, err := scanToken(s.db.QueryRow(`
+		SELECT `+tokenColumns+`
+		FROM tunnel_tokens WHERE id = $1
+	`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+	return token, nil
+}
+
+// GetByKeyID returns the token with the given challenge key ID
+func (s *PostgresTokenStore) GetByKeyID(keyID string) (*Token, error) {
+	if keyID == "" {
+		return nil, ErrTokenNotFound
+	}
+	token, err := scanToken(s.db.QueryRow(`
+		SELECT `+tokenColumns+`
+		FROM tunnel_tokens WHERE key_id = $1
+	`, keyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+	return token, nil
+}
+
+// Save creates or replaces a token
+func (s *PostgresTokenStore) Save(token *Token) error {
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return fmt.Errorf("failed to encode token scopes: %w", err)
+	}
+
+	var lastUsed sql.NullTime
+	if !token.LastUsed.IsZero() {
+		lastUsed = sql.NullTime{Time: token.LastUsed, Valid: true}
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO tunnel_tokens (`+tokenColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at,
+			last_used = EXCLUDED.last_used,
+			active = EXCLUDED.active,
+			scopes = EXCLUDED.scopes,
+			owner = EXCLUDED.owner,
+			replaced_by = EXCLUDED.replaced_by,
+			challenge_key = EXCLUDED.challenge_key,
+			key_id = EXCLUDED.key_id
+	`, token.ID, token.Name, token.CreatedAt, token.ExpiresAt, lastUsed, token.Active, scopes, token.Owner, token.ReplacedBy, token.ChallengeKey, token.KeyID)
+	if err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+	return nil
+}
+
+// TouchLastUsed sets when a token was last used
+func (s *PostgresTokenStore) TouchLastUsed(id string, t time.Time) error {
+	result, err := s.db.Exec(`UPDATE tunnel_tokens SET last_used = $2 WHERE id = $1`, id, t)
+	if err != nil {
+		return fmt.Errorf("failed to update token: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// Revoke deactivates a token
+func (s *PostgresTokenStore) Revoke(id string) error {
+	result, err := s.db.Exec(`UPDATE tunnel_tokens SET active = FALSE WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// MarkRotated records that a token was replaced by successorID, unless a
+// concurrent change revoked or rotated it first
+func (s *PostgresTokenStore) MarkRotated(id, successorID string, expiresAt time.Time) (*Token, error) {
+	now := time.Now()
+	token, err := scanToken(s.db.QueryRow(`
+		UPDATE tunnel_tokens
+		SET replaced_by = $2, expires_at = LEAST(expires_at, $3)
+		WHERE id = $1 AND active AND replaced_by = '' AND expires_at > $4
+		RETURNING `+tokenColumns, id, successorID, expiresAt, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		current, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRotatable(current, now); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotRotatable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate token: %w", err)
+	}
+	return token, nil
+}
+
+// Delete removes a token
+func (s *PostgresTokenStore) Delete(id string) error {
+	result, err := s.db.Exec(`DELETE FROM tunnel_tokens WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// List returns all tokens ordered by creation time
+func (s *PostgresTokenStore) List() ([]*Token, error) {
+	rows, err := s.db.Query(`
+		SELECT ` + tokenColumns + `
+		FROM tunnel_tokens ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrScopeDenied is returned when a token's scopes don't allow a tunnel
+var ErrScopeDenied = errors.New("token scope does not allow this tunnel")
+
+// TunnelTypes are the tunnel types a token can be limited to
+var TunnelTypes = []string{"http", "tcp", "udp"}
+
+// TokenScopes limits what a token may be used for. Zero values mean no limit.
+type TokenScopes struct {
+	// Subdomains are glob patterns of the subdomains tunnels may use
+	Subdomains []string `json:"subdomains,omitempty" yaml:"subdomains,omitempty"`
+	// TunnelTypes lists the allowed tunnel types (http, tcp, udp)
+	TunnelTypes []string `json:"tunnel_types,omitempty" yaml:"tunnel_types,omitempty"`
+	// MaxTunnels caps the tunnels open with the token at the same time
+	MaxTunnels int `json:"max_tunnels,omitempty" yaml:"max_tunnels,omitempty"`
+	// MaxBandwidth caps the traffic of all tunnels of the token in bytes
+	// per second, averaged over a minute
+	MaxBandwidth int64 `json:"max_bandwidth,omitempty" yaml:"max_bandwidth,omitempty"`
+	// CIDRs are the networks clients may connect from
+	CIDRs []string `json:"cidrs,omitempty" yaml:"cidrs,omitempty"`
+}
+
+// TunnelRequest describes a tunnel a client asks to open
+type TunnelRequest struct {
+	Subdomain string
+	Type      string
+	RemoteIP  net.IP
+	// OpenTunnels is the number of tunnels already open with the token
+	OpenTunnels int
+}
+
+// Validate checks the tunnel types and CIDRs of the scopes
+func (s TokenScopes) Validate() error {
+	for _, t := range s.TunnelTypes {
+		valid := false
+		for _, known := range TunnelTypes {
+			if t == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown tunnel type %q, expected one of %s", t, strings.Join(TunnelTypes, ", "))
+		}
+	}
+	for _, pattern := range s.Subdomains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid subdomain pattern %q: %w", pattern, err)
+		}
+	}
+	for _, cidr := range s.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+	}
+	if s.MaxTunnels < 0 || s.MaxBandwidth < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// AllowsSubdomain reports whether subdomain matches one of the patterns
+func (s TokenScopes) AllowsSubdomain(subdomain string) bool {
+	if len(s.Subdomains) == 0 {
+		return true
+	}
+	for _, pattern := range s.Subdomains {
+		if ok, _ := path.Match(pattern, subdomain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsType reports whether tunnels of tunnelType may be opened
+func (s TokenScopes) AllowsType(tunnelType string) bool {
+	if len(s.TunnelTypes) == 0 {
+		return true
+	}
+	for _, t := range s.TunnelTypes {
+		if t == tunnelType {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether a client may connect from ip
+func (s TokenScopes) AllowsIP(ip net.IP) bool {
+	if len(s.CIDRs) == 0 {
+		return true
+	}
+	for _, cidr := range s.CIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks a tunnel request against the token's expiry and scopes
+func (t *Token) Authorize(req TunnelRequest) error {
+	if !t.Active {
+		return fmt.Errorf("%w: token revoked", ErrScopeDenied)
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return fmt.Errorf("%w: token expired", ErrScopeDenied)
+	}
+	return t.Scopes.Authorize(req)
+}
+
+// Authorize checks a tunnel request against the scopes
+func (s TokenScopes) Authorize(req TunnelRequest) error {
+	if !s.AllowsIP(req.RemoteIP) {
+		return fmt.Errorf("%w: connections from %s are not allowed", ErrScopeDenied, req.RemoteIP)
+	}
+	if !s.AllowsType(req.Type) {
+		return fmt.Errorf("%w: %s tunnels are not allowed", ErrScopeDenied, req.Type)
+	}
+	if !s.AllowsSubdomain(req.Subdomain) {
+		return fmt.Errorf("%w: subdomain %s is not allowed", ErrScopeDenied, req.Subdomain)
+	}
+	if s.MaxTunnels > 0 && req.OpenTunnels >= s.MaxTunnels {
+		return fmt.Errorf("%w: at most %d tunnels may be open", ErrScopeDenied, s.MaxTunnels)
+	}
+	return nil
+}
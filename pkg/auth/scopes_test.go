@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestToken_Authorize(t *testing.T) {
+	token := &Token{
+		Active:    true,
+		ExpiresAt: time.Now().Add(time.Hour),
+		Scopes: TokenScopes{
+			Subdomains:  []string{"team-*"},
+			TunnelTypes: []string{"http"},
+			MaxTunnels:  2,
+			CIDRs:       []string{"10.0.0.0/8"},
+		},
+	}
+	allowed := TunnelRequest{Subdomain: "team-api", Type: "http", RemoteIP: net.ParseIP("10.1.2.3"), OpenTunnels: 1}
+	if err := token.Authorize(allowed); err != nil {
+		t.Fatalf("expected request to be allowed: %v", err)
+	}
+
+	denied := map[string]func(r *TunnelRequest){
+		"subdomain": func(r *TunnelRequest) { r.Subdomain = "other" },
+		"type":      func(r *TunnelRequest) { r.Type = "tcp" },
+		"cidr":      func(r *TunnelRequest) { r.RemoteIP = net.ParseIP("192.168.1.1") },
+		"limit":     func(r *TunnelRequest) { r.OpenTunnels = 2 },
+	}
+	for name, modify := range denied {
+		req := allowed
+		modify(&req)
+		if err := token.Authorize(req); !errors.Is(err, ErrScopeDenied) {
+			t.Errorf("%s: expected ErrScopeDenied, got %v", name, err)
+		}
+	}
+
+	expired := *token
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := expired.Authorize(allowed); !errors.Is(err, ErrScopeDenied) {
+		t.Errorf("expected expired token to be denied, got %v", err)
+	}
+
+	// Unscoped tokens allow everything
+	unscoped := &Token{Active: true, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := unscoped.Authorize(TunnelRequest{Subdomain: "x", Type: "udp", OpenTunnels: 100}); err != nil {
+		t.Errorf("unscoped token should allow everything: %v", err)
+	}
+}
+
+func TestTokenScopes_Validate(t *testing.T) {
+	invalid := []TokenScopes{
+		{TunnelTypes: []string{"ftp"}},
+		{CIDRs: []string{"10.0.0.0"}},
+		{Subdomains: []string{"[a-"}},
+		{MaxTunnels: -1},
+	}
+	for _, scopes := range invalid {
+		if err := scopes.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", scopes)
+		}
+	}
+
+	manager := NewTokenManager()
+	token, err := manager.GenerateScopedToken(time.Hour, TokenScopes{Subdomains: []string{"demo"}})
+	if err != nil {
+		t.Fatalf("GenerateScopedToken failed: %v", err)
+	}
+	stored, ok := manager.ValidateToken(token.Value)
+	if !ok || len(stored.Scopes.Subdomains) != 1 {
+		t.Fatalf("expected stored scopes, got %+v", stored)
+	}
+}
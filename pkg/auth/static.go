@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StaticToken is a token listed in a static token file
+type StaticToken struct {
+	Token string `yaml:"token" json:"token"`
+	// Name becomes the owner of the token's tunnels as "static:<name>";
+	// without it the owner is derived from the token like for other tokens
+	Name   string      `yaml:"name" json:"name"`
+	Scopes TokenScopes `yaml:"scopes" json:"scopes"`
+}
+
+// staticTokenFile is the format of a static token file
+type staticTokenFile struct {
+	Tokens []StaticToken `yaml:"tokens"`
+}
+
+// StaticTokenAuth authenticates clients against a fixed list of tokens
+type StaticTokenAuth struct {
+	// byID maps token hashes, so lookups don't depend on the token value
+	byID map[string]*StaticToken
+	// byKeyID maps challenge key IDs to tokens
+	byKeyID map[string]*StaticToken
+}
+
+// LoadStaticTokens reads a YAML file with a list of tokens and their scopes
+func LoadStaticTokens(file string) ([]StaticToken, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var parsed staticTokenFile
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %w", err)
+	}
+	return parsed.Tokens, nil
+}
+
+// NewStaticTokenAuth creates an authenticator accepting the given tokens
+func NewStaticTokenAuth(tokens []StaticToken) (*StaticTokenAuth, error) {
+	a := &StaticTokenAuth{
+		byID:    make(map[string]*StaticToken, len(tokens)),
+		byKeyID: make(map[string]*StaticToken, len(tokens)),
+	}
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %d has no value", i+1)
+		}
+		if err := token.Scopes.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid scopes of token %d: %w", i+1, err)
+		}
+
+		id := HashToken(token.Token)
+		if _, exists := a.byID[id]; exists {
+			return nil, fmt.Errorf("token %d is listed twice", i+1)
+		}
+		a.byID[id] = token
+		a.byKeyID[TokenKeyID(TokenPublicKey(token.Token))] = token
+	}
+	return a, nil
+}
+
+// Authenticate accepts the listed tokens
+func (a *StaticTokenAuth) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	if creds.Username != "" {
+		return nil, ErrInvalidCredentials
+	}
+	token, ok := a.byID[HashToken(creds.Secret)]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return token.identity(), nil
+}
+
+// AuthenticateChallenge verifies a challenge response signed with one of
+// the listed tokens
+func (a *StaticTokenAuth) AuthenticateChallenge(keyID, nonce string, params url.Values, signature string) (*Identity, error) {
+	token, ok := a.byKeyID[keyID]
+	if !ok || !VerifyChallenge(TokenPublicKey(token.Token), nonce, params, signature) {
+		return nil, ErrInvalidProof
+	}
+	return token.identity(), nil
+}
+
+// identity returns the identity clients holding the token get
+func (t *StaticToken) identity() *Identity {
+	name := TokenOwner(t.Token)
+	if t.Name != "" {
+		name = "static:" + t.Name
+	}
+	return &Identity{Name: name, Scopes: t.Scopes}
+}
@@ -0,0 +1,458 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ogrok/gotunnel/internal/fsutil"
+)
+
+// ErrTokenNotFound is returned when a token store has no token with an ID
+var ErrTokenNotFound = errors.New("token not found")
+
+// TokenStore persists tokens by ID, the SHA-256 hash of their value.
+// Implementations never store token values and are safe for concurrent use.
+type TokenStore interface {
+	// Get returns the token with the given ID or ErrTokenNotFound
+	Get(id string) (*Token, error)
+	// GetByKeyID returns the token with the given challenge key ID or
+	// ErrTokenNotFound
+	GetByKeyID(keyID string) (*Token, error)
+	// Save creates or replaces a token
+	Save(token *Token) error
+	// Delete removes a token, returning ErrTokenNotFound if it doesn't exist
+	Delete(id string) error
+	// TouchLastUsed sets when a token was last used without rewriting the
+	// rest of it, so it can't undo a concurrent revocation or rotation
+	TouchLastUsed(id string, t time.Time) error
+	// Revoke deactivates a token, returning ErrTokenNotFound if it doesn't
+	// exist
+	Revoke(id string) error
+	// MarkRotated records that a token was replaced by successorID and
+	// shortens it to expire at expiresAt at the latest. It checks and
+	// changes the token in one step, returning ErrNotRotatable if it was
+	// revoked, expired or rotated in the meantime.
+	MarkRotated(id, successorID string, expiresAt time.Time) (*Token, error)
+	// List returns all tokens ordered by creation time
+	List() ([]*Token, error)
+}
+
+// storedToken returns a copy of token without its value
+func storedToken(token *Token) *Token {
+	stored := *token
+	stored.Value = ""
+	return &stored
+}
+
+// markRotated applies a rotation to a stored token
+func markRotated(token *Token, successorID string, expiresAt time.Time) error {
+	if err := checkRotatable(token, time.Now()); err != nil {
+		return err
+	}
+	token.ReplacedBy = successorID
+	if expiresAt.Before(token.ExpiresAt) {
+		token.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+// sortTokens orders tokens by creation time, then ID
+func sortTokens(tokens []*Token) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+}
+
+// keyIndex maps challenge key IDs to token IDs
+type keyIndex map[string]string
+
+// add indexes token, replacing the entry of an earlier version of it
+func (idx keyIndex) add(token, previous *Token) {
+	if previous != nil {
+		idx.remove(previous)
+	}
+	if token.KeyID != "" {
+		idx[token.KeyID] = token.ID
+	}
+}
+
+// remove drops the entry of token
+func (idx keyIndex) remove(token *Token) {
+	if idx[token.KeyID] == token.ID {
+		delete(idx, token.KeyID)
+	}
+}
+
+// indexTokens builds the key index of tokens
+func indexTokens(tokens map[string]*Token) keyIndex {
+	idx := make(keyIndex, len(tokens))
+	for _, token := range tokens {
+		idx.add(token, nil)
+	}
+	return idx
+}
+
+// MemoryTokenStore keeps tokens in memory; they are lost on restart
+type MemoryTokenStore struct {
+	tokens  map[string]*Token
+	byKeyID keyIndex
+	mu      sync.RWMutex
+}
+
+// NewMemoryTokenStore creates an empty in-memory token store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:  make(map[string]*Token),
+		byKeyID: make(keyIndex),
+	}
+}
+
+// Get returns the token with the given ID
+func (s *MemoryTokenStore) Get(id string) (*Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// GetByKeyID returns the token with the given challenge key ID
+func (s *MemoryTokenStore) GetByKeyID(keyID string) (*Token, error) {
+	s.mu.RLock()
+	id, ok := s.byKeyID[keyID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return s.Get(id)
+}
+
+// Save creates or replaces a token
+func (s *MemoryTokenStore) Save(token *Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := storedToken(token)
+	s.byKeyID.add(stored, s.tokens[token.ID])
+	s.tokens[token.ID] = stored
+	return nil
+}
+
+// Delete removes a token
+func (s *MemoryTokenStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	s.byKeyID.remove(token)
+	delete(s.tokens, id)
+	return nil
+}
+
+// TouchLastUsed sets when a token was last used
+func (s *MemoryTokenStore) TouchLastUsed(id string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	token.LastUsed = t
+	return nil
+}
+
+// Revoke deactivates a token
+func (s *MemoryTokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	token.Active = false
+	return nil
+}
+
+// MarkRotated records that a token was replaced by successorID
+func (s *MemoryTokenStore) MarkRotated(id, successorID string, expiresAt time.Time) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	if err := markRotated(token, successorID, expiresAt); err != nil {
+		return nil, err
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// List returns all tokens ordered by creation time
+func (s *MemoryTokenStore) List() ([]*Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		copied := *token
+		tokens = append(tokens, &copied)
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
+
+// FileTokenStore keeps tokens in a JSON file. Only token hashes are
+// written, and the file is replaced atomically so a crash never leaves it
+// half written. Changes made by other processes, such as the token admin
+// commands, are picked up on the next access; writes hold a lock on a file
+// next to it so processes don't overwrite each other's changes.
+type FileTokenStore struct {
+	path    string
+	modTime time.Time
+	tokens  map[string]*Token
+	byKeyID keyIndex
+	mu      sync.Mutex
+}
+
+// tokenFile is the on-disk format of a FileTokenStore
+type tokenFile struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// NewFileTokenStore opens the token file at path, creating it on first save
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	s := &FileTokenStore{
+		path:    path,
+		tokens:  make(map[string]*Token),
+		byKeyID: make(keyIndex),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh reloads the file when it changed since it was last read
+func (s *FileTokenStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat token file: %w", err)
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse token file: %w", err)
+	}
+
+	tokens := make(map[string]*Token, len(file.Tokens))
+	for _, token := range file.Tokens {
+		tokens[token.ID] = token
+	}
+	s.tokens = tokens
+	s.byKeyID = indexTokens(tokens)
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// lockFile locks the token file against writes of other processes. It
+// must be called with mu held, and the file reloaded after it returns.
+func (s *FileTokenStore) lockFile() (*fsutil.FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create token directory: %w", err)
+	}
+	return fsutil.LockFile(s.path + ".lock")
+}
+
+// update reloads the file, applies change and writes the result, holding
+// the file lock throughout
+func (s *FileTokenStore) update(change func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, err := s.lockFile()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Reload even if the modification time looks unchanged, as it can't
+	// tell apart writes within its resolution
+	s.modTime = time.Time{}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	s.byKeyID = indexTokens(s.tokens)
+	return s.save()
+}
+
+// save writes all tokens to disk
+func (s *FileTokenStore) save() error {
+	file := tokenFile{Tokens: make([]*Token, 0, len(s.tokens))}
+	for _, token := range s.tokens {
+		file.Tokens = append(file.Tokens, token)
+	}
+	sortTokens(file.Tokens)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	if err := fsutil.WriteFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Get returns the token with the given ID
+func (s *FileTokenStore) Get(id string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// GetByKeyID returns the token with the given challenge key ID
+func (s *FileTokenStore) GetByKeyID(keyID string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	token, ok := s.tokens[s.byKeyID[keyID]]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// Save creates or replaces a token and writes the file
+func (s *FileTokenStore) Save(token *Token) error {
+	return s.update(func() error {
+		s.tokens[token.ID] = storedToken(token)
+		return nil
+	})
+}
+
+// Delete removes a token and writes the file
+func (s *FileTokenStore) Delete(id string) error {
+	return s.update(func() error {
+		if _, ok := s.tokens[id]; !ok {
+			return ErrTokenNotFound
+		}
+		delete(s.tokens, id)
+		return nil
+	})
+}
+
+// TouchLastUsed sets when a token was last used and writes the file
+func (s *FileTokenStore) TouchLastUsed(id string, t time.Time) error {
+	return s.update(func() error {
+		token, ok := s.tokens[id]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		token.LastUsed = t
+		return nil
+	})
+}
+
+// Revoke deactivates a token and writes the file
+func (s *FileTokenStore) Revoke(id string) error {
+	return s.update(func() error {
+		token, ok := s.tokens[id]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		token.Active = false
+		return nil
+	})
+}
+
+// MarkRotated records that a token was replaced by successorID and writes
+// the file
+func (s *FileTokenStore) MarkRotated(id, successorID string, expiresAt time.Time) (*Token, error) {
+	var rotated Token
+	err := s.update(func() error {
+		token, ok := s.tokens[id]
+		if !ok {
+			return ErrTokenNotFound
+		}
+		if err := markRotated(token, successorID, expiresAt); err != nil {
+			return err
+		}
+		rotated = *token
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rotated, nil
+}
+
+// List returns all tokens ordered by creation time
+func (s *FileTokenStore) List() ([]*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		copied := *token
+		tokens = append(tokens, &copied)
+	}
+	sortTokens(tokens)
+	return tokens, nil
+}
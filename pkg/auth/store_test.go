@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testTokenStore(t *testing.T, store TokenStore) {
+	t.Helper()
+
+	token := &Token{ID: "abc", Value: "secret", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour), Active: true, KeyID: "key-abc"}
+	if err := store.Save(token); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if got, err := store.GetByKeyID("key-abc"); err != nil || got.ID != "abc" {
+		t.Fatalf("GetByKeyID = %+v, %v; want token abc", got, err)
+	}
+	if _, err := store.GetByKeyID(""); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for an empty key ID, got %v", err)
+	}
+
+	got, err := store.Get("abc")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.Value != "" {
+		t.Error("token values must not be stored")
+	}
+	if !got.Active {
+		t.Error("expected active token")
+	}
+
+	tokens, err := store.List()
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("List = %v, %v; want one token", tokens, err)
+	}
+
+	used := time.Now().Truncate(time.Second)
+	if err := store.TouchLastUsed("abc", used); err != nil {
+		t.Fatalf("TouchLastUsed failed: %v", err)
+	}
+	if got, err := store.Get("abc"); err != nil || !got.LastUsed.Equal(used) || !got.Active {
+		t.Errorf("expected only the last use to change, got %+v, %v", got, err)
+	}
+	if err := store.TouchLastUsed("missing", used); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	rotated, err := store.MarkRotated("abc", "def", expiresAt)
+	if err != nil {
+		t.Fatalf("MarkRotated failed: %v", err)
+	}
+	if rotated.ReplacedBy != "def" || !rotated.ExpiresAt.Equal(expiresAt) || !rotated.LastUsed.Equal(used) {
+		t.Errorf("expected a rotated token expiring at %s, got %+v", expiresAt, rotated)
+	}
+	if _, err := store.MarkRotated("abc", "ghi", expiresAt); !errors.Is(err, ErrNotRotatable) {
+		t.Errorf("expected ErrNotRotatable rotating twice, got %v", err)
+	}
+	if err := store.Revoke("abc"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if got, err := store.Get("abc"); err != nil || got.Active || got.ReplacedBy != "def" {
+		t.Errorf("expected only the revocation to change, got %+v, %v", got, err)
+	}
+	if err := store.Revoke("missing"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+
+	if err := store.Delete("abc"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get("abc"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+	if _, err := store.GetByKeyID("key-abc"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound by key ID after Delete, got %v", err)
+	}
+	if err := store.Delete("abc"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	testTokenStore(t, NewMemoryTokenStore())
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileTokenStore failed: %v", err)
+	}
+	testTokenStore(t, store)
+}
+
+func TestFileTokenStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileTokenStore failed: %v", err)
+	}
+
+	manager := NewTokenManagerWithStore(store)
+	token, err := manager.GenerateToken(time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("token file not written: %v", err)
+	}
+	if strings.Contains(string(data), token.Value) {
+		t.Fatal("token file must not contain token values")
+	}
+
+	// A new store, as after a restart, still knows the token
+	reopened, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileTokenStore failed: %v", err)
+	}
+	if _, ok := NewTokenManagerWithStore(reopened).ValidateToken(token.Value); !ok {
+		t.Fatal("token should survive a restart")
+	}
+
+	// Revocations by another process are seen by the running store
+	if !NewTokenManagerWithStore(reopened).RevokeToken(token.Value) {
+		t.Fatal("RevokeToken failed")
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	if _, ok := manager.ValidateToken(token.Value); ok {
+		t.Fatal("revoked token should be rejected")
+	}
+}
+
+func TestFileTokenStore_TouchKeepsOtherChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	server, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileTokenStore failed: %v", err)
+	}
+	token, err := NewTokenManagerWithStore(server).GenerateToken(time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+
+	// Another process revokes the token right after the server read it,
+	// within the resolution of the modification time
+	stat, _ := os.Stat(path)
+	admin, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileTokenStore failed: %v", err)
+	}
+	if !NewTokenManagerWithStore(admin).RevokeToken(token.Value) {
+		t.Fatal("RevokeToken failed")
+	}
+	os.Chtimes(path, stat.ModTime(), stat.ModTime())
+
+	if err := server.TouchLastUsed(token.ID, time.Now()); err != nil {
+		t.Fatalf("TouchLastUsed failed: %v", err)
+	}
+	stored, err := admin.Get(token.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if stored.Active || stored.LastUsed.IsZero() {
+		t.Errorf("expected a revoked token with its last use, got %+v", stored)
+	}
+}
+
+func TestSimpleAuth_Concurrent(t *testing.T) {
+	sa := NewSimpleAuthWithStore(NewMemoryTokenStore())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := sa.GenerateClientToken(time.Hour)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sa.AddAllowedToken("static")
+			if !sa.Authenticate(token) || !sa.Authenticate("static") {
+				t.Error("expected token to authenticate")
+			}
+		}()
+	}
+	wg.Wait()
+}
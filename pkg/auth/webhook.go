@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds how long an authentication webhook may take
+const webhookTimeout = 10 * time.Second
+
+// WebhookAuth asks an external HTTP service whether to accept credentials.
+// The service receives a POST with a JSON WebhookRequest and answers with
+// a JSON WebhookResponse.
+type WebhookAuth struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// WebhookRequest is the body sent to an authentication webhook
+type WebhookRequest struct {
+	Username string `json:"username,omitempty"`
+	// Token is the token, or the password when Username is set
+	Token    string `json:"token"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+}
+
+// WebhookResponse is the answer of an authentication webhook
+type WebhookResponse struct {
+	Allow bool `json:"allow"`
+	// Identity names the tunnel owner as "webhook:<identity>"; it defaults
+	// to the username
+	Identity string      `json:"identity,omitempty"`
+	Scopes   TokenScopes `json:"scopes,omitempty"`
+	// Reason explains a denial in the server log
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewWebhookAuth creates an authenticator calling the webhook at url. A
+// non-empty secret is sent as a bearer token so the webhook can tell the
+// requests come from the tunnel server.
+func NewWebhookAuth(url, secret string) *WebhookAuth {
+	return &WebhookAuth{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Authenticate asks the webhook about the credentials
+func (a *WebhookAuth) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	body := WebhookRequest{Username: creds.Username, Token: creds.Secret}
+	if creds.RemoteIP != nil {
+		body.RemoteIP = creds.RemoteIP.String()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+a.secret)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("authentication webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authentication webhook returned %s", resp.Status)
+	}
+
+	var answer WebhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid authentication webhook response: %w", err)
+	}
+	if !answer.Allow {
+		if answer.Reason != "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, answer.Reason)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if err := answer.Scopes.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scopes from authentication webhook: %w", err)
+	}
+
+	name := answer.Identity
+	if name == "" {
+		name = creds.Username
+	}
+	if name == "" {
+		return &Identity{Name: TokenOwner(creds.Secret), Scopes: answer.Scopes}, nil
+	}
+	return &Identity{Name: "webhook:" + name, Scopes: answer.Scopes}, nil
+}
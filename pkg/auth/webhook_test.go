@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookAuth(t *testing.T) {
+	var received WebhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hook-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch received.Token {
+		case "good":
+			json.NewEncoder(w).Encode(WebhookResponse{
+				Allow:    true,
+				Identity: "alice",
+				Scopes:   TokenScopes{Subdomains: []string{"alice-*"}},
+			})
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(WebhookResponse{Allow: false, Reason: "unknown token"})
+		}
+	}))
+	defer server.Close()
+
+	webhook := NewWebhookAuth(server.URL, "hook-secret")
+	ctx := context.Background()
+
+	identity, err := webhook.Authenticate(ctx, Credentials{Secret: "good", RemoteIP: net.ParseIP("192.0.2.1")})
+	if err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if identity.Name != "webhook:alice" || len(identity.Scopes.Subdomains) != 1 {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	if received.RemoteIP != "192.0.2.1" {
+		t.Errorf("expected the remote IP to be sent, got %q", received.RemoteIP)
+	}
+
+	if _, err := webhook.Authenticate(ctx, Credentials{Secret: "bad"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials for a denial, got %v", err)
+	}
+
+	// A failing webhook is an error, not a denial, so chains stop at it
+	_, err = webhook.Authenticate(ctx, Credentials{Secret: "broken"})
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected a webhook error, got %v", err)
+	}
+
+	if _, err := NewWebhookAuth(server.URL, "wrong").Authenticate(ctx, Credentials{Secret: "good"}); err == nil {
+		t.Error("expected the webhook to reject a wrong secret")
+	}
+}
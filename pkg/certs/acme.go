@@ -0,0 +1,422 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// renewBefore is how long before expiry certificates are renewed
+const renewBefore = 30 * 24 * time.Hour
+
+// ACMEConfig configures automatic certificate management
+type ACMEConfig struct {
+	// Email is the contact address registered with the ACME account
+	Email string
+	// DirectoryURL is the ACME directory; defaults to Let's Encrypt
+	DirectoryURL string
+	// CacheDir stores account keys and certificates on disk
+	CacheDir string
+	// BaseDomain is the domain tunnels are served under
+	BaseDomain string
+	// Domains are additional custom domains certificates may be issued for
+	Domains []string
+	// HostPolicy allows issuing certificates for further hosts, e.g.
+	// subdomains that currently have a tunnel
+	HostPolicy autocert.HostPolicy
+	// DNSProvider enables DNS-01 challenges and with them a wildcard
+	// certificate for the base domain
+	DNSProvider DNSProvider
+	// HTTPClient talks to the ACME directory, e.g. to trust the CA of a
+	// local test server
+	HTTPClient *http.Client
+}
+
+// ACMEManager obtains and renews certificates on demand. Individual hosts
+// are validated through HTTP-01 or TLS-ALPN-01; with a DNS provider the
+// base domain gets a wildcard certificate through DNS-01.
+type ACMEManager struct {
+	config   ACMEConfig
+	autocert *autocert.Manager
+	cache    autocert.DirCache
+	client   *acme.Client
+	logger   *logrus.Logger
+
+	// orderMu serializes wildcard orders and guards client; mu only guards
+	// wildcard, so handshakes aren't blocked by the network I/O of an order
+	orderMu  sync.Mutex
+	mu       sync.Mutex
+	wildcard *tls.Certificate
+}
+
+// NewACMEManager creates an ACME manager storing its state in config.CacheDir
+func NewACMEManager(config ACMEConfig, logger *logrus.Logger) (*ACMEManager, error) {
+	if config.BaseDomain == "" {
+		return nil, fmt.Errorf("a base domain is required for ACME")
+	}
+	if config.CacheDir == "" {
+		return nil, fmt.Errorf("a cache directory is required for ACME")
+	}
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	m := &ACMEManager{
+		config: config,
+		cache:  autocert.DirCache(config.CacheDir),
+		logger: logger,
+	}
+
+	m.autocert = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       m.cache,
+		HostPolicy:  m.hostPolicy,
+		RenewBefore: renewBefore,
+		Email:       config.Email,
+		Client: &acme.Client{
+			DirectoryURL: config.DirectoryURL,
+			HTTPClient:   config.HTTPClient,
+		},
+	}
+
+	return m, nil
+}
+
+// hostPolicy allows the base domain, the configured custom domains and
+// whatever the configured host policy accepts
+func (m *ACMEManager) hostPolicy(ctx context.Context, host string) error {
+	if strings.EqualFold(host, m.config.BaseDomain) {
+		return nil
+	}
+	for _, domain := range m.config.Domains {
+		if strings.EqualFold(host, domain) {
+			return nil
+		}
+	}
+	if m.config.HostPolicy != nil {
+		return m.config.HostPolicy(ctx, host)
+	}
+	return fmt.Errorf("acme: host %q is not allowed", host)
+}
+
+// GetCertificate returns a certificate for the TLS handshake, obtaining or
+// renewing it first when needed
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.config.DNSProvider != nil && m.coveredByWildcard(hello.ServerName) {
+		return m.wildcardCertificate(hello.Context())
+	}
+	return m.autocert.GetCertificate(hello)
+}
+
+// TLSConfig returns a TLS configuration answering TLS-ALPN-01 challenges
+// and serving certificates from the manager
+func (m *ACMEManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to fallback
+func (m *ACMEManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.autocert.HTTPHandler(fallback)
+}
+
+// coveredByWildcard reports whether name is the base domain or a single
+// label below it
+func (m *ACMEManager) coveredByWildcard(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	base := strings.ToLower(m.config.BaseDomain)
+	return name == base || isDirectSubdomain(name, base)
+}
+
+// wildcardCacheKey is the cache entry of the base domain wildcard certificate
+func (m *ACMEManager) wildcardCacheKey() string {
+	return "wildcard_" + strings.ToLower(m.config.BaseDomain)
+}
+
+// wildcardCertificate returns the wildcard certificate of the base domain,
+// loading it from disk or obtaining it through DNS-01 when missing or due
+// for renewal. While a certificate that is still valid gets renewed,
+// handshakes are served that one instead of waiting for the order.
+func (m *ACMEManager) wildcardCertificate(ctx context.Context) (*tls.Certificate, error) {
+	current := m.currentWildcard()
+	if current != nil && time.Until(current.Leaf.NotAfter) > renewBefore {
+		return current, nil
+	}
+
+	if current != nil && time.Now().Before(current.Leaf.NotAfter) {
+		if !m.orderMu.TryLock() {
+			return current, nil
+		}
+	} else {
+		m.orderMu.Lock()
+	}
+	defer m.orderMu.Unlock()
+
+	// An order that finished while waiting may have replaced the certificate
+	current = m.currentWildcard()
+	if current == nil {
+		if cert, err := m.loadCertificate(ctx, m.wildcardCacheKey()); err == nil {
+			m.setWildcard(cert)
+			current = cert
+		} else if !errors.Is(err, autocert.ErrCacheMiss) {
+			m.logger.WithError(err).Warn("Failed to load cached wildcard certificate")
+		}
+	}
+
+	if current != nil && time.Until(current.Leaf.NotAfter) > renewBefore {
+		return current, nil
+	}
+
+	cert, err := m.obtainWildcard(ctx)
+	if err != nil {
+		if current != nil && time.Now().Before(current.Leaf.NotAfter) {
+			// Keep serving the old certificate until renewal succeeds
+			m.logger.WithError(err).Error("Failed to renew wildcard certificate")
+			return current, nil
+		}
+		return nil, err
+	}
+
+	m.setWildcard(cert)
+	return cert, nil
+}
+
+// currentWildcard returns the wildcard certificate in memory, if any
+func (m *ACMEManager) currentWildcard() *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.wildcard
+}
+
+// setWildcard replaces the wildcard certificate served to handshakes
+func (m *ACMEManager) setWildcard(cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wildcard = cert
+}
+
+// obtainWildcard orders a certificate for the base domain and its wildcard
+// through DNS-01 challenges and stores it on disk
+func (m *ACMEManager) obtainWildcard(ctx context.Context) (*tls.Certificate, error) {
+	// Certificates are issued in the background of a handshake, so don't let
+	// a visitor closing their connection abort the order
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Minute)
+	defer cancel()
+
+	base := strings.ToLower(m.config.BaseDomain)
+	m.logger.WithField("domain", "*."+base).Info("Obtaining wildcard certificate through DNS-01")
+
+	client, err := m.accountClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("*."+base, base))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order: %w", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.solveDNS01(ctx, client, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{"*." + base, base},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	cert, err := newCertificate(der, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.storeCertificate(ctx, m.wildcardCacheKey(), cert); err != nil {
+		m.logger.WithError(err).Error("Failed to store wildcard certificate")
+	}
+
+	m.logger.WithFields(logrus.Fields{
+		"domain":    "*." + base,
+		"not_after": cert.Leaf.NotAfter,
+	}).Info("Obtained wildcard certificate")
+	return cert, nil
+}
+
+// solveDNS01 completes the DNS-01 challenge of one authorization
+func (m *ACMEManager) solveDNS01(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return fmt.Errorf("failed to compute challenge record: %w", err)
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+
+	if err := m.config.DNSProvider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", fqdn, err)
+	}
+	defer func() {
+		if err := m.config.DNSProvider.CleanUp(ctx, fqdn, value); err != nil {
+			m.logger.WithError(err).WithField("record", fqdn).Warn("Failed to remove challenge record")
+		}
+	}()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization of %s failed: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// accountClient returns an ACME client registered with the account key
+// stored in the cache, creating the key on first use. It must be called
+// with orderMu held.
+func (m *ACMEManager) accountClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	const keyName = "dns01_account+key"
+	var key crypto.Signer
+	data, err := m.cache.Get(ctx, keyName)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid account key in cache")
+		}
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse account key: %w", err)
+		}
+	case errors.Is(err, autocert.ErrCacheMiss):
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate account key: %w", err)
+		}
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode account key: %w", err)
+		}
+		if err := m.cache.Put(ctx, keyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, fmt.Errorf("failed to store account key: %w", err)
+		}
+		key = ecKey
+	default:
+		return nil, fmt.Errorf("failed to read account key: %w", err)
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.config.DirectoryURL,
+		HTTPClient:   m.config.HTTPClient,
+	}
+
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	m.client = client
+	return client, nil
+}
+
+// loadCertificate reads a certificate and key stored with storeCertificate
+func (m *ACMEManager) loadCertificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := m.cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cached certificate %s: %w", name, err)
+	}
+	return &cert, nil
+}
+
+// storeCertificate writes the key and certificate chain as one PEM file
+func (m *ACMEManager) storeCertificate(ctx context.Context, name string, cert *tls.Certificate) error {
+	data, err := encodePEM(cert)
+	if err != nil {
+		return err
+	}
+	return m.cache.Put(ctx, name, data)
+}
+
+// RenewLoop renews the wildcard certificate in the background until ctx is
+// done; per-host certificates are renewed by autocert itself
+func (m *ACMEManager) RenewLoop(ctx context.Context) {
+	if m.config.DNSProvider == nil {
+		return
+	}
+
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if _, err := m.wildcardCertificate(ctx); err != nil {
+			m.logger.WithError(err).Error("Failed to obtain wildcard certificate")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+func TestNewACMEManager_RequiresDomainAndCache(t *testing.T) {
+	logger := logrus.New()
+
+	if _, err := NewACMEManager(ACMEConfig{CacheDir: t.TempDir()}, logger); err == nil {
+		t.Error("expected error without base domain")
+	}
+	if _, err := NewACMEManager(ACMEConfig{BaseDomain: "tunnel.example.com"}, logger); err == nil {
+		t.Error("expected error without cache directory")
+	}
+}
+
+func TestACMEManager_HostPolicy(t *testing.T) {
+	m, err := NewACMEManager(ACMEConfig{
+		BaseDomain: "tunnel.example.com",
+		CacheDir:   t.TempDir(),
+		Domains:    []string{"app.example.org"},
+		HostPolicy: func(_ context.Context, host string) error {
+			if host == "myapp.tunnel.example.com" {
+				return nil
+			}
+			return errors.New("not allowed")
+		},
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %v", err)
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"tunnel.example.com", true},
+		{"app.example.org", true},
+		{"myapp.tunnel.example.com", true},
+		{"other.tunnel.example.com", false},
+		{"example.com", false},
+	}
+
+	for _, tt := range tests {
+		err := m.hostPolicy(context.Background(), tt.host)
+		if (err == nil) != tt.allowed {
+			t.Errorf("hostPolicy(%q) error = %v, want allowed %v", tt.host, err, tt.allowed)
+		}
+	}
+}
+
+func TestACMEManager_CoveredByWildcard(t *testing.T) {
+	m := &ACMEManager{config: ACMEConfig{BaseDomain: "tunnel.example.com"}}
+
+	tests := []struct {
+		name    string
+		covered bool
+	}{
+		{"tunnel.example.com", true},
+		{"myapp.tunnel.example.com", true},
+		{"MyApp.Tunnel.Example.com.", true},
+		{"a.b.tunnel.example.com", false},
+		{"eviltunnel.example.com", false},
+		{"app.example.org", false},
+	}
+
+	for _, tt := range tests {
+		if got := m.coveredByWildcard(tt.name); got != tt.covered {
+			t.Errorf("coveredByWildcard(%q) = %v, want %v", tt.name, got, tt.covered)
+		}
+	}
+}
+
+func TestExecDNSProvider(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "calls")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$1 $2 $3\" >> " + out + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0700); err != nil {
+		t.Fatalf("failed to write hook: %v", err)
+	}
+
+	p := &ExecDNSProvider{Command: hook}
+	if err := p.Present(context.Background(), "_acme-challenge.example.com", "abc"); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	if err := p.CleanUp(context.Background(), "_acme-challenge.example.com", "abc"); err != nil {
+		t.Fatalf("CleanUp failed: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook was not called: %v", err)
+	}
+	want := "present _acme-challenge.example.com abc\ncleanup _acme-challenge.example.com abc\n"
+	if string(data) != want {
+		t.Errorf("hook calls = %q, want %q", data, want)
+	}
+
+	failing := &ExecDNSProvider{Command: filepath.Join(dir, "missing")}
+	if err := failing.Present(context.Background(), "x", "y"); err == nil || !strings.Contains(err.Error(), "present") {
+		t.Errorf("expected present error, got %v", err)
+	}
+}
+
+// fakeDNS records the TXT records presented for DNS-01 challenges
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func (d *fakeDNS) Present(_ context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.records == nil {
+		d.records = make(map[string][]string)
+	}
+	d.records[fqdn] = append(d.records[fqdn], value)
+	return nil
+}
+
+func (d *fakeDNS) CleanUp(_ context.Context, fqdn, value string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	values := d.records[fqdn][:0]
+	for _, v := range d.records[fqdn] {
+		if v != value {
+			values = append(values, v)
+		}
+	}
+	d.records[fqdn] = values
+	return nil
+}
+
+func (d *fakeDNS) has(fqdn, value string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, v := range d.records[fqdn] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// acmeStub is a minimal ACME server. It validates DNS-01 challenges against
+// a fakeDNS and signs certificate requests with its own CA.
+type acmeStub struct {
+	t      *testing.T
+	dns    *fakeDNS
+	server *httptest.Server
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu            sync.Mutex
+	nonce         int
+	accountKey    *ecdsa.PublicKey
+	registrations int
+	orders        int
+	identifiers   []acme.AuthzID
+	authzs        []*stubAuthz
+	certificate   []byte
+}
+
+type stubAuthz struct {
+	Token  string
+	Status string
+}
+
+func newACMEStub(t *testing.T, dns *fakeDNS) *acmeStub {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME Stub CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &acmeStub{t: t, dns: dns, caKey: caKey, caCert: caCert}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handleDirectory)
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) { s.setNonce(w) })
+	mux.HandleFunc("POST /account", s.handleAccount)
+	mux.HandleFunc("POST /order", s.handleNewOrder)
+	mux.HandleFunc("POST /order/1", s.handleOrder)
+	mux.HandleFunc("POST /authz/{id}", s.handleAuthz)
+	mux.HandleFunc("POST /challenge/{id}", s.handleChallenge)
+	mux.HandleFunc("POST /finalize/1", s.handleFinalize)
+	mux.HandleFunc("POST /certificate/1", s.handleCertificate)
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *acmeStub) url(path string) string {
+	return s.server.URL + path
+}
+
+func (s *acmeStub) setNonce(w http.ResponseWriter) {
+	s.mu.Lock()
+	s.nonce++
+	nonce := fmt.Sprintf("nonce-%d", s.nonce)
+	s.mu.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (s *acmeStub) reply(w http.ResponseWriter, status int, v interface{}) {
+	s.setNonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJWS decodes the payload of a JWS request into v, if given, and
+// returns the protected header
+func (s *acmeStub) readJWS(r *http.Request, v interface{}) map[string]json.RawMessage {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		s.t.Errorf("invalid JWS: %v", err)
+		return nil
+	}
+	var header map[string]json.RawMessage
+	if data, err := base64.RawURLEncoding.DecodeString(jws.Protected); err != nil || json.Unmarshal(data, &header) != nil {
+		s.t.Errorf("invalid JWS header %q", jws.Protected)
+	}
+	if v != nil {
+		if data, err := base64.RawURLEncoding.DecodeString(jws.Payload); err != nil || json.Unmarshal(data, v) != nil {
+			s.t.Errorf("invalid JWS payload %q", jws.Payload)
+		}
+	}
+	return header
+}
+
+func (s *acmeStub) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	s.reply(w, http.StatusOK, map[string]interface{}{
+		"newNonce":   s.url("/nonce"),
+		"newAccount": s.url("/account"),
+		"newOrder":   s.url("/order"),
+		"revokeCert": s.url("/revoke"),
+		"keyChange":  s.url("/key-change"),
+		"meta":       map[string]string{"termsOfService": s.url("/terms")},
+	})
+}
+
+func (s *acmeStub) handleAccount(w http.ResponseWriter, r *http.Request) {
+	var account struct {
+		TermsAgreed bool     `json:"termsOfServiceAgreed"`
+		Contact     []string `json:"contact"`
+	}
+	header := s.readJWS(r, &account)
+	var jwk struct {
+		X string `json:"x"`
+		Y string `json:"y"`
+	}
+	if err := json.Unmarshal(header["jwk"], &jwk); err != nil {
+		s.t.Errorf("account request without JWK: %v", err)
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if !account.TermsAgreed {
+		s.t.Error("expected the terms of service to be agreed to")
+	}
+
+	s.mu.Lock()
+	s.registrations++
+	s.accountKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.url("/account/1"))
+	s.reply(w, http.StatusCreated, map[string]interface{}{"status": "valid", "contact": account.Contact})
+}
+
+func (s *acmeStub) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	s.readJWS(r, &req)
+
+	s.mu.Lock()
+	s.orders++
+	s.identifiers = nil
+	s.authzs = nil
+	s.certificate = nil
+	for i, id := range req.Identifiers {
+		s.identifiers = append(s.identifiers, acme.AuthzID{Type: id.Type, Value: id.Value})
+		s.authzs = append(s.authzs, &stubAuthz{Token: fmt.Sprintf("token-%d", i), Status: "pending"})
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.url("/order/1"))
+	s.reply(w, http.StatusCreated, s.order())
+}
+
+func (s *acmeStub) handleOrder(w http.ResponseWriter, r *http.Request) {
+	s.readJWS(r, nil)
+	w.Header().Set("Location", s.url("/order/1"))
+	s.reply(w, http.StatusOK, s.order())
+}
+
+// order returns the JSON representation of the current order
+func (s *acmeStub) order() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := "ready"
+	var authzURLs []string
+	for i, authz := range s.authzs {
+		authzURLs = append(authzURLs, s.url(fmt.Sprintf("/authz/%d", i)))
+		if authz.Status != "valid" {
+			status = authz.Status
+		}
+	}
+	order := map[string]interface{}{
+		"status":         status,
+		"identifiers":    s.identifiers,
+		"authorizations": authzURLs,
+		"finalize":       s.url("/finalize/1"),
+	}
+	if s.certificate != nil {
+		order["status"] = "valid"
+		order["certificate"] = s.url("/certificate/1")
+	}
+	return order
+}
+
+// authzByID returns the authorization with the id in the request path
+func (s *acmeStub) authzByID(r *http.Request) (int, *stubAuthz) {
+	var id int
+	if _, err := fmt.Sscan(r.PathValue("id"), &id); err != nil || id >= len(s.authzs) {
+		return 0, nil
+	}
+	return id, s.authzs[id]
+}
+
+func (s *acmeStub) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	s.readJWS(r, nil)
+	s.mu.Lock()
+	id, authz := s.authzByID(r)
+	if authz == nil {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	identifier := s.identifiers[id]
+	status := authz.Status
+	s.mu.Unlock()
+
+	s.reply(w, http.StatusOK, map[string]interface{}{
+		"status": status,
+		"identifier": map[string]string{
+			"type":  identifier.Type,
+			"value": strings.TrimPrefix(identifier.Value, "*."),
+		},
+		"wildcard": strings.HasPrefix(identifier.Value, "*."),
+		"challenges": []map[string]string{
+			{"type": "http-01", "url": s.url("/challenge/unused"), "token": "unused", "status": "pending"},
+			{"type": "dns-01", "url": s.url(fmt.Sprintf("/challenge/%d", id)), "token": authz.Token, "status": status},
+		},
+	})
+}
+
+// handleChallenge validates a DNS-01 challenge by looking up the record
+// the client should have presented
+func (s *acmeStub) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	s.readJWS(r, nil)
+	s.mu.Lock()
+	id, authz := s.authzByID(r)
+	if authz == nil {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	thumbprint, err := acme.JWKThumbprint(s.accountKey)
+	if err != nil {
+		s.t.Errorf("failed to compute thumbprint: %v", err)
+	}
+	digest := sha256.Sum256([]byte(authz.Token + "." + thumbprint))
+	fqdn := "_acme-challenge." + strings.TrimPrefix(s.identifiers[id].Value, "*.")
+	authz.Status = "invalid"
+	if s.dns.has(fqdn, base64.RawURLEncoding.EncodeToString(digest[:])) {
+		authz.Status = "valid"
+	}
+	status := authz.Status
+	s.mu.Unlock()
+
+	s.reply(w, http.StatusOK, map[string]string{"type": "dns-01", "url": s.url(r.URL.Path), "token": authz.Token, "status": status})
+}
+
+func (s *acmeStub) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	s.readJWS(r, &req)
+	data, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		s.t.Errorf("invalid CSR encoding: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		s.t.Fatalf("invalid CSR: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		DNSNames:     csr.DNSNames,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		s.t.Fatalf("failed to sign certificate: %v", err)
+	}
+
+	s.mu.Lock()
+	s.certificate = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.url("/order/1"))
+	s.reply(w, http.StatusOK, s.order())
+}
+
+func (s *acmeStub) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	s.readJWS(r, nil)
+	s.mu.Lock()
+	certificate := s.certificate
+	s.mu.Unlock()
+
+	s.setNonce(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(certificate)
+}
+
+func (s *acmeStub) counts() (registrations, orders int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registrations, s.orders
+}
+
+func TestACMEManager_WildcardThroughDNS01(t *testing.T) {
+	dns := &fakeDNS{}
+	stub := newACMEStub(t, dns)
+	cacheDir := t.TempDir()
+	config := ACMEConfig{
+		Email:        "admin@example.com",
+		DirectoryURL: stub.url("/directory"),
+		CacheDir:     cacheDir,
+		BaseDomain:   "tunnel.example.com",
+		DNSProvider:  dns,
+	}
+	m, err := NewACMEManager(config, logrus.New())
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %v", err)
+	}
+
+	// Concurrent handshakes without a certificate wait for a single order
+	var wg sync.WaitGroup
+	certs := make([]*tls.Certificate, 4)
+	errs := make([]error, len(certs))
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			certs[i], errs[i] = m.wildcardCertificate(context.Background())
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("wildcardCertificate failed: %v", err)
+		}
+		if certs[i] != certs[0] {
+			t.Error("expected all handshakes to get the same certificate")
+		}
+	}
+	if registrations, orders := stub.counts(); registrations != 1 || orders != 1 {
+		t.Errorf("expected 1 registration and 1 order, got %d and %d", registrations, orders)
+	}
+
+	leaf := certs[0].Leaf
+	if err := leaf.VerifyHostname("myapp.tunnel.example.com"); err != nil {
+		t.Errorf("wildcard certificate doesn't cover a subdomain: %v", err)
+	}
+	if err := leaf.VerifyHostname("tunnel.example.com"); err != nil {
+		t.Errorf("wildcard certificate doesn't cover the base domain: %v", err)
+	}
+	if len(certs[0].Certificate) != 2 {
+		t.Errorf("expected the chain to be kept, got %d certificates", len(certs[0].Certificate))
+	}
+	if len(dns.records["_acme-challenge.tunnel.example.com"]) != 0 {
+		t.Error("expected challenge records to be cleaned up")
+	}
+
+	// Another manager loads the certificate from the cache instead of ordering
+	m, err = NewACMEManager(config, logrus.New())
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %v", err)
+	}
+	cert, err := m.wildcardCertificate(context.Background())
+	if err != nil {
+		t.Fatalf("wildcardCertificate failed: %v", err)
+	}
+	if !cert.Leaf.Equal(leaf) {
+		t.Error("expected the cached certificate")
+	}
+	if _, orders := stub.counts(); orders != 1 {
+		t.Errorf("expected no further order, got %d", orders)
+	}
+}
+
+func TestACMEManager_WildcardFailsWithoutRecords(t *testing.T) {
+	stub := newACMEStub(t, &fakeDNS{})
+	m, err := NewACMEManager(ACMEConfig{
+		DirectoryURL: stub.url("/directory"),
+		CacheDir:     t.TempDir(),
+		BaseDomain:   "tunnel.example.com",
+		// Records presented here never reach the stub's DNS
+		DNSProvider: &fakeDNS{},
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %v", err)
+	}
+
+	if _, err := m.wildcardCertificate(context.Background()); err == nil {
+		t.Fatal("expected the order to fail when the challenge records are missing")
+	}
+}
+
+func TestACMEManager_WildcardServedDuringRenewal(t *testing.T) {
+	m, err := NewACMEManager(ACMEConfig{
+		CacheDir:    t.TempDir(),
+		BaseDomain:  "tunnel.example.com",
+		DNSProvider: &fakeDNS{},
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("NewACMEManager failed: %v", err)
+	}
+
+	// A certificate due for renewal, but still valid
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"*.tunnel.example.com", "tunnel.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(renewBefore / 2),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := newCertificate([][]byte{der}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setWildcard(current)
+
+	// With an order in flight, handshakes don't wait for it
+	m.orderMu.Lock()
+	defer m.orderMu.Unlock()
+	cert, err := m.wildcardCertificate(context.Background())
+	if err != nil || cert != current {
+		t.Fatalf("expected the current certificate during renewal, got %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	devCACertFile = "ca.crt"
+	devCAKeyFile  = "ca.key"
+
+	// devCAValidity is how long the generated root CA is valid
+	devCAValidity = 10 * 365 * 24 * time.Hour
+	// devLeafValidity stays below the 398 day limit browsers enforce
+	devLeafValidity = 397 * 24 * time.Hour
+)
+
+// DevCA is a local root CA for development that issues certificates on the
+// fly. Its key is kept on disk so the root only has to be trusted once.
+type DevCA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *ecdsa.PrivateKey
+	domain  string
+	names   map[string]bool
+
+	mu     sync.Mutex
+	issued map[string]*tls.Certificate
+}
+
+// LoadOrCreateDevCA loads the development CA stored in dir, creating a new
+// one when dir holds none yet. Certificates for domain and its subdomains
+// are covered by a single wildcard certificate. Besides those and
+// localhost, certificates are only issued for the given names.
+func LoadOrCreateDevCA(dir, domain string, names ...string) (*DevCA, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, devCACertFile))
+	if errors.Is(err, os.ErrNotExist) {
+		certPEM, err = createDevCA(dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read development CA: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(dir, devCAKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read development CA key: %w", err)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid development CA: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("development CA key must be an ECDSA key")
+	}
+
+	ca := &DevCA{
+		cert:    pair.Leaf,
+		certPEM: certPEM,
+		key:     key,
+		domain:  strings.ToLower(domain),
+		names:   make(map[string]bool),
+		issued:  make(map[string]*tls.Certificate),
+	}
+	for _, name := range names {
+		ca.names[strings.ToLower(strings.TrimSuffix(name, "."))] = true
+	}
+	return ca, nil
+}
+
+// createDevCA generates a new root CA in dir and returns its certificate
+func createDevCA(dir string) ([]byte, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"gotunnel development CA"},
+			CommonName:   "gotunnel development CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, devCAKeyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, devCACertFile), certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return certPEM, nil
+}
+
+// CertificatePEM returns the PEM encoded root certificate
+func (ca *DevCA) CertificatePEM() []byte {
+	return ca.certPEM
+}
+
+// GetCertificate issues a certificate for the SNI of the handshake. Names
+// below the base domain share a wildcard certificate; localhost and the
+// configured names get one of their own.
+func (ca *DevCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		name = ca.domain
+	}
+	if name == "" {
+		name = "localhost"
+	}
+
+	names := []string{name}
+	if ca.domain != "" && (name == ca.domain || isDirectSubdomain(name, ca.domain)) {
+		names = []string{ca.domain, "*." + ca.domain}
+	}
+	return ca.Issue(names...)
+}
+
+// Issue returns a certificate for names signed by the CA, reusing earlier
+// certificates until they are close to expiry. Names the CA doesn't serve
+// are rejected, so handshakes can't fill the cache with arbitrary names.
+func (ca *DevCA) Issue(names ...string) (*tls.Certificate, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("dev CA: no names to issue a certificate for")
+	}
+	for _, name := range names {
+		if !ca.allowed(name) {
+			return nil, fmt.Errorf("dev CA: host %q is not allowed", name)
+		}
+	}
+	cacheKey := strings.Join(names, ",")
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if cert, ok := ca.issued[cacheKey]; ok && time.Until(cert.Leaf.NotAfter) > renewBefore {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"gotunnel development certificate"},
+			CommonName:   names[0],
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(devLeafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+
+	cert, err := newCertificate([][]byte{der, ca.cert.Raw}, key)
+	if err != nil {
+		return nil, err
+	}
+	ca.issued[cacheKey] = cert
+	return cert, nil
+}
+
+// TLSConfig returns a TLS configuration serving certificates issued by the CA
+func (ca *DevCA) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: ca.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// allowed reports whether the CA issues certificates for name: the base
+// domain, its wildcard and direct subdomains, localhost and the configured
+// names
+func (ca *DevCA) allowed(name string) bool {
+	if name == "localhost" || ca.names[name] {
+		return true
+	}
+	if ca.domain == "" {
+		return false
+	}
+	return name == ca.domain || name == "*."+ca.domain || isDirectSubdomain(name, ca.domain)
+}
+
+// isDirectSubdomain reports whether name is a single label below domain
+func isDirectSubdomain(name, domain string) bool {
+	label := strings.TrimSuffix(name, "."+domain)
+	return label != name && label != "" && !strings.Contains(label, ".")
+}
+
+// randomSerial returns a random 128 bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,88 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestDevCA_IssuesTrustedWildcard(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateDevCA(dir, "tunnel.test")
+	if err != nil {
+		t.Fatalf("LoadOrCreateDevCA failed: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca.CertificatePEM()) {
+		t.Fatal("failed to parse CA certificate")
+	}
+
+	cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "myapp.tunnel.test"})
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+
+	for _, name := range []string{"myapp.tunnel.test", "other.tunnel.test", "tunnel.test"} {
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("certificate not valid for %s: %v", name, err)
+		}
+	}
+
+	again, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.tunnel.test"})
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	if again != cert {
+		t.Error("expected the wildcard certificate to be reused")
+	}
+
+	local, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	if _, err := local.Leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: roots}); err != nil {
+		t.Errorf("certificate not valid for localhost: %v", err)
+	}
+}
+
+func TestDevCA_Persistent(t *testing.T) {
+	dir := t.TempDir()
+	first, err := LoadOrCreateDevCA(dir, "tunnel.test")
+	if err != nil {
+		t.Fatalf("LoadOrCreateDevCA failed: %v", err)
+	}
+	second, err := LoadOrCreateDevCA(dir, "tunnel.test")
+	if err != nil {
+		t.Fatalf("LoadOrCreateDevCA failed: %v", err)
+	}
+
+	if !bytes.Equal(first.CertificatePEM(), second.CertificatePEM()) {
+		t.Error("expected the stored CA to be reused")
+	}
+}
+
+func TestDevCA_RejectsOtherNames(t *testing.T) {
+	ca, err := LoadOrCreateDevCA(t.TempDir(), "tunnel.test", "app.example.org")
+	if err != nil {
+		t.Fatalf("LoadOrCreateDevCA failed: %v", err)
+	}
+
+	for _, name := range []string{"tunnel.test", "myapp.tunnel.test", "localhost", "App.Example.org."} {
+		if _, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err != nil {
+			t.Errorf("expected a certificate for %s, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"example.com", "a.b.tunnel.test", "eviltunnel.test", "other.example.org"} {
+		if _, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+	if _, err := ca.Issue("tunnel.test", "example.com"); err == nil {
+		t.Error("expected Issue to reject names outside the domain")
+	}
+	if len(ca.issued) != 3 {
+		t.Errorf("expected only allowed names to be cached, got %d certificates", len(ca.issued))
+	}
+}
@@ -0,0 +1,42 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DNSProvider publishes the TXT records answering ACME DNS-01 challenges
+type DNSProvider interface {
+	// Present creates a TXT record fqdn with the given value
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// ExecDNSProvider runs an external hook to manage challenge records, so any
+// DNS API can be used without built-in support. The hook is called as
+// `<command> present|cleanup <fqdn> <value>` and must not return before the
+// record has propagated.
+type ExecDNSProvider struct {
+	Command string
+}
+
+// Present runs the hook with the "present" action
+func (p *ExecDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+// CleanUp runs the hook with the "cleanup" action
+func (p *ExecDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *ExecDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	output, err := exec.CommandContext(ctx, p.Command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns hook %s failed: %w: %s", action, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNoCertificate is returned when no certificate matches a hostname
+var ErrNoCertificate = errors.New("no certificate for host")
+
+// KeyPair names the files of a certificate and its private key
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseKeyPair parses a "cert.pem=key.pem" flag value
+func ParseKeyPair(value string) (KeyPair, error) {
+	idx := strings.LastIndex(value, "=")
+	if idx <= 0 || idx == len(value)-1 {
+		return KeyPair{}, fmt.Errorf("invalid key pair %q, expected cert=key", value)
+	}
+	return KeyPair{CertFile: value[:idx], KeyFile: value[idx+1:]}, nil
+}
+
+// Store holds certificates keyed by the hostnames they cover and reloads
+// them when their files change, so certificates can be rotated without
+// restarting the server
+type Store struct {
+	pairs  []KeyPair
+	logger *logrus.Logger
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// NewStore loads the given key pairs. The first pair is served to clients
+// that send no SNI or ask for a name no certificate covers.
+func NewStore(pairs []KeyPair, logger *logrus.Logger) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("at least one certificate is required")
+	}
+
+	s := &Store{
+		pairs:  pairs,
+		logger: logger,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads all key pairs from disk. When any pair fails to load the
+// previously loaded certificates are kept and the error is returned.
+func (s *Store) Reload() error {
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	var fallback *tls.Certificate
+
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", pair.CertFile, err)
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// The first pair listed wins when several cover the same name
+			if _, exists := byName[name]; !exists {
+				byName[name] = &cert
+			}
+		}
+
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if info, err := os.Stat(file); err == nil {
+				modTimes[file] = info.ModTime()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.byName = byName
+	s.fallback = fallback
+	s.modTimes = modTimes
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the certificate covering name, trying an exact match
+// before a wildcard one
+func (s *Store) Lookup(name string) (*tls.Certificate, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.byName[name]; ok {
+		return cert, true
+	}
+	if idx := strings.Index(name, "."); idx > 0 {
+		if cert, ok := s.byName["*"+name[idx:]]; ok {
+			return cert, true
+		}
+	}
+	return nil, false
+}
+
+// GetCertificate selects a certificate based on the SNI of the handshake,
+// falling back to the first configured certificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := s.Lookup(hello.ServerName); ok {
+		return cert, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.fallback == nil {
+		return nil, fmt.Errorf("%w %q", ErrNoCertificate, hello.ServerName)
+	}
+	return s.fallback, nil
+}
+
+// TLSConfig returns a TLS configuration serving certificates from the store
+func (s *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// changed reports whether any certificate or key file was modified since
+// the last reload
+func (s *Store) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, pair := range s.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().Equal(s.modTimes[file]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificates whenever their files change until ctx is
+// done. Files are polled, which also works for the symlink swaps used by
+// Kubernetes secrets and certbot.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				// Files are often written one after the other, so retry on
+				// the next tick before giving up on the new certificate
+				s.logger.WithError(err).Warn("Failed to reload certificates, keeping previous ones")
+				continue
+			}
+			s.logger.Info("Reloaded TLS certificates")
+		}
+	}
+}
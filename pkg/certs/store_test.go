@@ -0,0 +1,147 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeKeyPair writes a self-signed certificate for names into dir
+func writeKeyPair(t *testing.T, dir, prefix string, names ...string) KeyPair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+
+	pair := KeyPair{
+		CertFile: filepath.Join(dir, prefix+".crt"),
+		KeyFile:  filepath.Join(dir, prefix+".key"),
+	}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return pair
+}
+
+func TestParseKeyPair(t *testing.T) {
+	pair, err := ParseKeyPair("/etc/certs/a.crt=/etc/certs/a.key")
+	if err != nil {
+		t.Fatalf("ParseKeyPair failed: %v", err)
+	}
+	if pair.CertFile != "/etc/certs/a.crt" || pair.KeyFile != "/etc/certs/a.key" {
+		t.Errorf("unexpected pair %+v", pair)
+	}
+
+	for _, value := range []string{"a.crt", "=a.key", "a.crt="} {
+		if _, err := ParseKeyPair(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestStore_GetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	base := writeKeyPair(t, dir, "base", "tunnel.example.com", "*.tunnel.example.com")
+	custom := writeKeyPair(t, dir, "custom", "app.example.org")
+
+	store, err := NewStore([]KeyPair{base, custom}, logrus.New())
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"myapp.tunnel.example.com", "tunnel.example.com"},
+		{"tunnel.example.com", "tunnel.example.com"},
+		{"APP.example.org", "app.example.org"},
+		{"unknown.example.net", "tunnel.example.com"},
+		{"", "tunnel.example.com"},
+	}
+
+	for _, tt := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatalf("GetCertificate(%q) failed: %v", tt.serverName, err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != tt.want {
+			t.Errorf("GetCertificate(%q) = %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+
+	if _, ok := store.Lookup("a.b.tunnel.example.com"); ok {
+		t.Error("wildcard should not match nested subdomains")
+	}
+}
+
+func TestStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "site", "old.example.com")
+
+	store, err := NewStore([]KeyPair{pair}, logrus.New())
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if store.changed() {
+		t.Error("store should not report changes right after loading")
+	}
+
+	writeKeyPair(t, dir, "site", "new.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, future, future)
+	if !store.changed() {
+		t.Error("store should report changed files")
+	}
+
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, ok := store.Lookup("new.example.com"); !ok {
+		t.Error("expected reloaded certificate")
+	}
+	if _, ok := store.Lookup("old.example.com"); ok {
+		t.Error("old certificate should be gone")
+	}
+
+	// A broken file keeps the previous certificates
+	os.WriteFile(pair.KeyFile, []byte("garbage"), 0600)
+	if err := store.Reload(); err == nil {
+		t.Error("expected reload error")
+	}
+	if _, ok := store.Lookup("new.example.com"); !ok {
+		t.Error("previous certificate should be kept after a failed reload")
+	}
+}
@@ -0,0 +1,229 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTunnelNotFound is returned when no tunnel is registered for a subdomain
+	ErrTunnelNotFound = errors.New("tunnel not found")
+
+	// ErrLocalServiceUnavailable is returned when the client cannot reach its local service
+	ErrLocalServiceUnavailable = errors.New("local service unavailable")
+
+	// ErrOverQuota is returned when a tunnel exceeded one of its limits
+	ErrOverQuota = errors.New("tunnel is over quota")
+)
+
+// ErrorPageKind identifies one of the error pages shown to visitors
+type ErrorPageKind string
+
+const (
+	// ErrorPageUnknownTunnel is shown for hosts that never had a tunnel
+	ErrorPageUnknownTunnel ErrorPageKind = "unknown_tunnel"
+	// ErrorPageTunnelOffline is shown for known subdomains whose client is disconnected
+	ErrorPageTunnelOffline ErrorPageKind = "tunnel_offline"
+	// ErrorPageTunnelTimeout is shown when the client did not answer in time
+	ErrorPageTunnelTimeout ErrorPageKind = "tunnel_timeout"
+	// ErrorPageLocalRefused is shown when the client could not reach its local service
+	ErrorPageLocalRefused ErrorPageKind = "local_refused"
+	// ErrorPageOverQuota is shown when the tunnel exceeded one of its limits
+	ErrorPageOverQuota ErrorPageKind = "over_quota"
+	// ErrorPageNoRoute is shown when none of the client's routes matches the path
+	ErrorPageNoRoute ErrorPageKind = "no_route"
+	// ErrorPageClientCertRequired is shown when a tunnel requires a visitor
+	// certificate and none was verified
+	ErrorPageClientCertRequired ErrorPageKind = "client_cert_required"
+)
+
+// errorPageDefaults holds the status code, title and message of each page
+var errorPageDefaults = map[ErrorPageKind]struct {
+	status  int
+	title   string
+	message string
+}{
+	ErrorPageUnknownTunnel:      {http.StatusNotFound, "Tunnel not found", "There is no tunnel at this address. Check the link you were given."},
+	ErrorPageTunnelOffline:      {http.StatusBadGateway, "Tunnel offline", "The tunnel at this address exists but its client is not connected right now."},
+	ErrorPageTunnelTimeout:      {http.StatusGatewayTimeout, "Tunnel not responding", "The tunnel client did not respond in time. Please try again shortly."},
+	ErrorPageLocalRefused:       {http.StatusBadGateway, "Local service unavailable", "The tunnel is connected but the application behind it refused the connection."},
+	ErrorPageOverQuota:          {http.StatusTooManyRequests, "Tunnel over quota", "This tunnel has exceeded its usage limits. Please try again later."},
+	ErrorPageNoRoute:            {http.StatusNotFound, "No route", "The tunnel is connected but does not serve this path."},
+	ErrorPageClientCertRequired: {http.StatusForbidden, "Client certificate required", "This tunnel only accepts visitors presenting a trusted client certificate."},
+}
+
+// defaultErrorTemplate renders every error page unless an operator template overrides it
+const defaultErrorTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Status}} - {{.Title}}</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; margin: 0; background: #0f172a; color: #e2e8f0; }
+        .container { max-width: 560px; margin: 15vh auto 0; padding: 32px; background: #1e293b; border-radius: 12px; }
+        h1 { margin: 0 0 8px; font-size: 24px; }
+        .status { color: #38bdf8; font-weight: 600; letter-spacing: 0.05em; }
+        .meta { margin-top: 24px; font-size: 13px; color: #94a3b8; }
+        code { background: #0f172a; padding: 2px 6px; border-radius: 4px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="status">{{.Status}}</div>
+        <h1>{{.Title}}</h1>
+        <p>{{.Message}}</p>
+        <div class="meta">
+            {{if .Host}}<div>Host: <code>{{.Host}}</code></div>{{end}}
+            {{if .LastSeen}}<div>Last seen: {{.LastSeen.UTC.Format "2006-01-02 15:04:05 MST"}}</div>{{end}}
+            <div>Served by GoTunnel</div>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// ErrorPageData is passed to error page templates
+type ErrorPageData struct {
+	Kind      ErrorPageKind `json:"error"`
+	Status    int           `json:"status"`
+	Title     string        `json:"title"`
+	Message   string        `json:"message"`
+	Host      string        `json:"host,omitempty"`
+	Subdomain string        `json:"subdomain,omitempty"`
+	LastSeen  *time.Time    `json:"last_seen,omitempty"`
+}
+
+// ErrorPages renders branded error responses for visitors as HTML, or as
+// JSON for API clients
+type ErrorPages struct {
+	templates map[ErrorPageKind]*template.Template
+}
+
+// DefaultErrorPages returns error pages using the built-in template
+func DefaultErrorPages() *ErrorPages {
+	tmpl := template.Must(template.New("error").Parse(defaultErrorTemplate))
+	p := &ErrorPages{templates: make(map[ErrorPageKind]*template.Template)}
+	for kind := range errorPageDefaults {
+		p.templates[kind] = tmpl
+	}
+	return p
+}
+
+// LoadErrorPages returns error pages where every <kind>.html file found in
+// dir (e.g. tunnel_offline.html) replaces the built-in template
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	p := DefaultErrorPages()
+	for kind := range errorPageDefaults {
+		path := filepath.Join(dir, string(kind)+".html")
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read error page %s: %w", path, err)
+		}
+
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse error page %s: %w", path, err)
+		}
+		p.templates[kind] = tmpl
+	}
+	return p, nil
+}
+
+// NewErrorPageData fills in the default status, title and message of kind
+func NewErrorPageData(kind ErrorPageKind, host, subdomain string) ErrorPageData {
+	defaults := errorPageDefaults[kind]
+	return ErrorPageData{
+		Kind:      kind,
+		Status:    defaults.status,
+		Title:     defaults.title,
+		Message:   defaults.message,
+		Host:      host,
+		Subdomain: subdomain,
+	}
+}
+
+// Render writes the error page to w, as JSON when the request prefers it
+func (p *ErrorPages) Render(w http.ResponseWriter, r *http.Request, data ErrorPageData) {
+	body, contentType := p.render(data, wantsJSON(r))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(data.Status)
+	w.Write(body)
+}
+
+// Response builds a complete HTTP response for the error page, for code
+// that writes raw responses to a connection instead of a ResponseWriter
+func (p *ErrorPages) Response(r *http.Request, data ErrorPageData) *http.Response {
+	body, contentType := p.render(data, wantsJSON(r))
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", "no-store")
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", data.Status, http.StatusText(data.Status)),
+		StatusCode:    data.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// render executes the template of data.Kind, falling back to a plain text
+// body if an operator template fails
+func (p *ErrorPages) render(data ErrorPageData, asJSON bool) ([]byte, string) {
+	if asJSON {
+		body, err := json.Marshal(data)
+		if err == nil {
+			return body, "application/json; charset=utf-8"
+		}
+	}
+
+	tmpl, ok := p.templates[data.Kind]
+	if ok {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err == nil {
+			return buf.Bytes(), "text/html; charset=utf-8"
+		}
+	}
+
+	return []byte(fmt.Sprintf("%d %s: %s\n", data.Status, data.Title, data.Message)), "text/plain; charset=utf-8"
+}
+
+// wantsJSON reports whether the client asked for JSON rather than HTML
+func wantsJSON(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == "text/html":
+			return false
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			return true
+		}
+	}
+	return false
+}
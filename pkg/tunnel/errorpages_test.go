@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorPages_Render(t *testing.T) {
+	pages := DefaultErrorPages()
+	lastSeen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := NewErrorPageData(ErrorPageTunnelOffline, "myapp.example.com", "myapp")
+	data.LastSeen = &lastSeen
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := httptest.NewRecorder()
+	pages.Render(rec, req, data)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("Expected status 502, got %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected HTML, got %s", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "2024-01-02 03:04:05") {
+		t.Fatal("Expected the page to show when the tunnel was last seen")
+	}
+
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	pages.Render(rec, req, NewErrorPageData(ErrorPageOverQuota, "myapp.example.com", "myapp"))
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", rec.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON body: %v", err)
+	}
+	if body["error"] != string(ErrorPageOverQuota) {
+		t.Fatalf("Unexpected error kind %v", body["error"])
+	}
+}
+
+func TestLoadErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := `<h1>Custom {{.Status}} for {{.Subdomain}}</h1>`
+	if err := os.WriteFile(filepath.Join(dir, "unknown_tunnel.html"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatalf("LoadErrorPages failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	pages.Render(rec, httptest.NewRequest(http.MethodGet, "/", nil), NewErrorPageData(ErrorPageUnknownTunnel, "", "nope"))
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "<h1>Custom 404 for nope</h1>" {
+		t.Fatalf("Unexpected custom page %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Pages without an override keep the built-in template
+	rec = httptest.NewRecorder()
+	pages.Render(rec, httptest.NewRequest(http.MethodGet, "/", nil), NewErrorPageData(ErrorPageLocalRefused, "", "myapp"))
+	if !strings.Contains(rec.Body.String(), "Local service unavailable") {
+		t.Fatal("Expected the built-in page for local_refused")
+	}
+}
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientCertSubjectHeader carries the subject of the client certificate a
+// visitor presented to tunnels that require one
+const ClientCertSubjectHeader = "X-Client-Cert-Subject"
+
+// ForwardedHeaders adds the standard proxy headers (X-Forwarded-For,
+// X-Forwarded-Proto, X-Forwarded-Host, X-Real-IP and RFC 7239 Forwarded)
+// to requests sent through a tunnel
+type ForwardedHeaders struct {
+	trustedProxies []*net.IPNet
+}
+
+// NewForwardedHeaders creates a ForwardedHeaders that keeps and appends to
+// forwarding headers sent by peers in trustedProxies (CIDRs or single IPs)
+// and strips them from everyone else
+func NewForwardedHeaders(trustedProxies []string) (*ForwardedHeaders, error) {
+	fh := &ForwardedHeaders{}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		fh.trustedProxies = append(fh.trustedProxies, network)
+	}
+	return fh, nil
+}
+
+// trusted reports whether ip belongs to a trusted proxy
+func (fh *ForwardedHeaders) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range fh.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the forwarding headers on req based on the connection it
+// arrived on. Headers from a trusted proxy are appended to, or kept when
+// they describe the original visitor; headers from anyone else are
+// replaced so visitors cannot spoof their address.
+func (fh *ForwardedHeaders) Apply(req *http.Request) {
+	remoteIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	// Only the server may vouch for visitor certificates
+	req.Header.Del(ClientCertSubjectHeader)
+
+	trusted := fh.trusted(net.ParseIP(remoteIP))
+	if !trusted {
+		for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP"} {
+			req.Header.Del(name)
+		}
+	}
+
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		req.Header.Set("X-Forwarded-For", prior+", "+remoteIP)
+	} else {
+		req.Header.Set("X-Forwarded-For", remoteIP)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Real-IP") == "" {
+		req.Header.Set("X-Real-IP", remoteIP)
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(remoteIP), quoteForwarded(req.Host), proto)
+	if prior := req.Header.Get("Forwarded"); prior != "" {
+		element = prior + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// forwardedNode formats an address as an RFC 7239 node, quoting IPv6
+// addresses in brackets
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return quoteForwarded(ip)
+}
+
+// quoteForwarded quotes a Forwarded value when it is not a plain token
+func quoteForwarded(value string) string {
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+// EncodeRequest serializes a request into its HTTP/1.1 wire format without
+// adding headers of its own, so it can be sent through a tunnel
+func EncodeRequest(req *http.Request) ([]byte, error) {
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// An empty value stops Request.Write from adding Go's user agent
+		req.Header.Set("User-Agent", "")
+	}
+
+	var buf bytes.Buffer
+	if err := req.Write(&buf); err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	return buf.Bytes(), nil
+}
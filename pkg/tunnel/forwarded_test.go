@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders_Untrusted(t *testing.T) {
+	fh, err := NewForwardedHeaders([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewForwardedHeaders failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+	req.Header.Set(ClientCertSubjectHeader, "CN=admin")
+	fh.Apply(req)
+
+	if got := req.Header.Get(ClientCertSubjectHeader); got != "" {
+		t.Errorf("spoofed %s should be removed, got %q", ClientCertSubjectHeader, got)
+	}
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "myapp.example.com",
+		"X-Real-IP":         "203.0.113.7",
+		"Forwarded":         "for=203.0.113.7;host=myapp.example.com;proto=https",
+	}
+	for name, value := range expected {
+		if got := req.Header.Get(name); got != value {
+			t.Errorf("%s: expected %q, got %q", name, value, got)
+		}
+	}
+}
+
+func TestForwardedHeaders_Trusted(t *testing.T) {
+	fh, err := NewForwardedHeaders([]string{"10.1.2.3", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("NewForwardedHeaders failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil)
+	req.RemoteAddr = "[2001:db8::1]:443"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+	req.Header.Set("Forwarded", "for=198.51.100.1")
+	fh.Apply(req)
+
+	if got := req.Header.Get("X-Forwarded-For"); got != "198.51.100.1, 2001:db8::1" {
+		t.Errorf("Unexpected X-Forwarded-For %q", got)
+	}
+	if got := req.Header.Get("X-Real-IP"); got != "198.51.100.1" {
+		t.Errorf("Unexpected X-Real-IP %q", got)
+	}
+	if got := req.Header.Get("Forwarded"); got != `for=198.51.100.1, for="[2001:db8::1]";host=myapp.example.com;proto=http` {
+		t.Errorf("Unexpected Forwarded %q", got)
+	}
+
+	if _, err := NewForwardedHeaders([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected an error for an invalid trusted proxy")
+	}
+}
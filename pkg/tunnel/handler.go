@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
 	"time"
 
@@ -27,17 +29,30 @@ func NewHandler(tunnelManager *TunnelManager, logger *logrus.Logger) *Handler {
 	}
 }
 
-// HandleTunnel handles a new tunnel connection from a client
-func (h *Handler) HandleTunnel(ctx context.Context, tunnel *Tunnel) error {
+// TunnelManager returns the manager holding the handler's tunnels
+func (h *Handler) TunnelManager() *TunnelManager {
+	return h.tunnelManager
+}
+
+// RegisterTunnel adds a tunnel to the manager so it starts receiving traffic.
+// It fails if another owner already has a live tunnel on the subdomain.
+func (h *Handler) RegisterTunnel(tunnel *Tunnel) error {
+	if err := h.tunnelManager.AddTunnel(tunnel); err != nil {
+		return err
+	}
+
 	h.logger.WithFields(logrus.Fields{
 		"subdomain": tunnel.Subdomain,
 		"id":        tunnel.ID,
+		"owner":     tunnel.Owner,
 	}).Info("New tunnel connection established")
+	return nil
+}
 
-	// Add tunnel to manager
-	h.tunnelManager.AddTunnel(tunnel)
+// HandleTunnel handles a tunnel connection previously added with RegisterTunnel
+func (h *Handler) HandleTunnel(ctx context.Context, tunnel *Tunnel) error {
 	defer func() {
-		h.tunnelManager.RemoveTunnel(tunnel.Subdomain)
+		h.tunnelManager.DetachTunnel(tunnel)
 		tunnel.Close()
 		h.logger.WithField("subdomain", tunnel.Subdomain).Info("Tunnel connection closed")
 	}()
@@ -83,7 +98,7 @@ func (h *Handler) HandleHTTPRequest(ctx context.Context, subdomain string, conn
 	tunnel, exists := h.tunnelManager.GetTunnel(subdomain)
 	if !exists {
 		h.logger.WithField("subdomain", subdomain).Warn("Tunnel not found")
-		return fmt.Errorf("tunnel not found for subdomain: %s", subdomain)
+		return fmt.Errorf("%w for subdomain: %s", ErrTunnelNotFound, subdomain)
 	}
 
 	// Create a connection to handle the request
@@ -152,7 +167,7 @@ func (h *Handler) HandleRawTCP(ctx context.Context, subdomain string, conn net.C
 	tunnel, exists := h.tunnelManager.GetTunnel(subdomain)
 	if !exists {
 		h.logger.WithField("subdomain", subdomain).Warn("Tunnel not found")
-		return fmt.Errorf("tunnel not found for subdomain: %s", subdomain)
+		return fmt.Errorf("%w for subdomain: %s", ErrTunnelNotFound, subdomain)
 	}
 
 	// Create a connection to handle the request
@@ -262,4 +277,68 @@ func CreateClientTLSConfig(skipVerify bool) *tls.Config {
 		InsecureSkipVerify: skipVerify,
 		MinVersion:         tls.VersionTLS12,
 	}
+}
+
+// ClientTLSOptions configures how a tunnel client connects to the server
+type ClientTLSOptions struct {
+	// SkipVerify disables verification of the server certificate
+	SkipVerify bool
+	// CAFile is a PEM bundle trusted instead of the system roots
+	CAFile string
+	// Pins are SHA-256 fingerprints of the server certificate, or
+	// "sha256/<base64>" pins of its public key. When set, a server is
+	// trusted if and only if its chain contains a pinned certificate.
+	Pins []string
+	// CertFile and KeyFile hold a client certificate presented to servers
+	// that authenticate clients through mutual TLS
+	CertFile string
+	KeyFile  string
+}
+
+// NewClientTLSConfig creates a TLS configuration for client connections
+// from opts, loading the CA bundle and client certificate it references
+func NewClientTLSConfig(opts ClientTLSOptions) (*tls.Config, error) {
+	config := CreateClientTLSConfig(opts.SkipVerify)
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(opts.Pins) > 0 {
+		if opts.SkipVerify {
+			return nil, fmt.Errorf("pinned fingerprints cannot be combined with skipping verification")
+		}
+		pins, err := parsePins(opts.Pins)
+		if err != nil {
+			return nil, err
+		}
+		// The pin check replaces chain verification, unless a CA file was
+		// given as well, in which case both have to pass
+		config.InsecureSkipVerify = true
+		roots := config.RootCAs
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return pins.verifyConnection(state, roots)
+		}
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("both a client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
 } 
\ No newline at end of file
@@ -1,7 +1,6 @@
 package tunnel
 
 import (
-	"context"
 	"testing"
 	"time"
 
@@ -55,6 +54,29 @@ func TestTunnelManager_RemoveTunnel(t *testing.T) {
 	}
 }
 
+func TestTunnelManager_LastSeenExpires(t *testing.T) {
+	tm := NewTunnelManager()
+	for _, subdomain := range []string{"recent", "stale"} {
+		tm.AddTunnel(&Tunnel{ID: subdomain, Subdomain: subdomain})
+	}
+
+	tm.tunnels["stale"].LastSeen = time.Now().Add(-offlineWindow - time.Minute)
+	tm.RemoveTunnel("stale")
+	if _, seen := tm.LastSeen("stale"); seen {
+		t.Error("Expected a subdomain offline for longer than the window to be forgotten")
+	}
+
+	tm.tunnels["recent"].LastSeen = time.Now()
+	tm.lastPrune = time.Time{}
+	tm.RemoveTunnel("recent")
+	if _, seen := tm.LastSeen("recent"); !seen {
+		t.Error("Expected a recently disconnected subdomain to be remembered")
+	}
+	if _, ok := tm.lastSeen["stale"]; ok {
+		t.Error("Expected the stale entry to be pruned")
+	}
+}
+
 func TestTunnelManager_ListTunnels(t *testing.T) {
 	tm := NewTunnelManager()
 	tunnel1 := &Tunnel{
@@ -185,4 +207,49 @@ func TestCreateClientTLSConfig(t *testing.T) {
 	if !config.InsecureSkipVerify {
 		t.Fatal("InsecureSkipVerify should be true when skipVerify is true")
 	}
-} 
\ No newline at end of file
+}
+
+func TestNewClientTLSConfig(t *testing.T) {
+	config, err := NewClientTLSConfig(ClientTLSOptions{})
+	if err != nil {
+		t.Fatalf("NewClientTLSConfig failed: %v", err)
+	}
+	if config.InsecureSkipVerify || config.RootCAs != nil || len(config.Certificates) != 0 {
+		t.Fatal("empty options should use the system defaults")
+	}
+
+	if _, err := NewClientTLSConfig(ClientTLSOptions{CertFile: "client.crt"}); err == nil {
+		t.Fatal("expected error for certificate without key")
+	}
+	if _, err := NewClientTLSConfig(ClientTLSOptions{CAFile: "/nonexistent/ca.crt"}); err == nil {
+		t.Fatal("expected error for missing CA file")
+	}
+}
+
+func TestTunnelManager_AddTunnelOwnership(t *testing.T) {
+	tm := NewTunnelManager()
+	first := &Tunnel{ID: "first", Subdomain: "test", Owner: "token:a"}
+	if err := tm.AddTunnel(first); err != nil {
+		t.Fatalf("Expected first tunnel to be added, got %v", err)
+	}
+
+	// Another owner must not take over a live tunnel
+	if err := tm.AddTunnel(&Tunnel{ID: "other", Subdomain: "test", Owner: "token:b"}); err != ErrSubdomainInUse {
+		t.Fatalf("Expected ErrSubdomainInUse, got %v", err)
+	}
+
+	// The same owner may replace its own tunnel
+	second := &Tunnel{ID: "second", Subdomain: "test", Owner: "token:a"}
+	if err := tm.AddTunnel(second); err != nil {
+		t.Fatalf("Expected owner to replace its tunnel, got %v", err)
+	}
+	if !first.IsClosed() {
+		t.Fatal("Replaced tunnel should be closed")
+	}
+
+	// Detaching the replaced tunnel must not remove its successor
+	tm.DetachTunnel(first)
+	if retrieved, exists := tm.GetTunnel("test"); !exists || retrieved.ID != "second" {
+		t.Fatal("Successor tunnel should still be registered")
+	}
+}
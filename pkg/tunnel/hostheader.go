@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HostHeaderRewrite is the HostHeader value that rewrites the Host header
+// to the address of the local service the request is sent to
+const HostHeaderRewrite = "rewrite"
+
+// RewriteHost points req at host and records the host the visitor used in
+// X-Forwarded-Host, unless the server already set it. It returns the
+// original host.
+func RewriteHost(req *http.Request, host string) string {
+	original := req.Host
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", original)
+	}
+	req.Host = host
+	return original
+}
+
+// RewriteLocation makes an absolute Location header that points at
+// localHost point at the public scheme and host instead, so redirects
+// issued by the local service keep visitors on the tunnel
+func RewriteLocation(header http.Header, localHost, publicScheme, publicHost string) {
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() || !strings.EqualFold(u.Host, localHost) {
+		return
+	}
+
+	u.Scheme = publicScheme
+	u.Host = publicHost
+	header.Set("Location", u.String())
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewriteHost(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+	original := RewriteHost(req, "localhost:3000")
+
+	if original != "myapp.tunnel.example.com" {
+		t.Fatalf("Unexpected original host %q", original)
+	}
+	if req.Host != "localhost:3000" {
+		t.Fatalf("Expected Host to be rewritten, got %q", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Host") != "myapp.tunnel.example.com" {
+		t.Fatalf("Expected X-Forwarded-Host to carry the original host, got %q", req.Header.Get("X-Forwarded-Host"))
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{"http://localhost:3000/login?next=%2F", "https://myapp.tunnel.example.com/login?next=%2F"},
+		{"http://LOCALHOST:3000/", "https://myapp.tunnel.example.com/"},
+		{"/relative", "/relative"},
+		{"https://accounts.example.org/oauth", "https://accounts.example.org/oauth"},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("Location", tt.location)
+		RewriteLocation(header, "localhost:3000", "https", "myapp.tunnel.example.com")
+		if got := header.Get("Location"); got != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.location, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+// Word lists used to build human-friendly subdomains such as "brave-otter-3f9a"
+var (
+	subdomainAdjectives = []string{
+		"amber", "ancient", "autumn", "bold", "brave", "bright", "calm", "clever",
+		"cosmic", "crimson", "crisp", "dapper", "daring", "eager", "fancy", "fuzzy",
+		"gentle", "glad", "golden", "happy", "hidden", "humble", "icy", "jolly",
+		"keen", "lively", "lucky", "mellow", "misty", "noble", "polite", "proud",
+		"quick", "quiet", "rapid", "rustic", "shiny", "silent", "silver", "snowy",
+		"solid", "sunny", "swift", "tidy", "vivid", "wild", "wise", "witty",
+	}
+	subdomainNouns = []string{
+		"badger", "beacon", "breeze", "brook", "canyon", "cedar", "comet", "coral",
+		"crane", "dune", "falcon", "fern", "finch", "fjord", "forest", "fox",
+		"glacier", "harbor", "hawk", "heron", "island", "lagoon", "lark", "lynx",
+		"maple", "meadow", "meteor", "moose", "nebula", "oasis", "orbit", "otter",
+		"panda", "pebble", "pine", "planet", "prairie", "raven", "reef", "river",
+		"robin", "summit", "thunder", "tiger", "tundra", "valley", "willow", "wolf",
+	}
+)
+
+// maxSubdomainAttempts bounds how many random names are tried before giving up
+const maxSubdomainAttempts = 20
+
+// GenerateSubdomain returns a random human-friendly subdomain made of an
+// adjective, a noun and a short hex suffix, using crypto/rand
+func GenerateSubdomain() (string, error) {
+	adjective, err := randomWord(subdomainAdjectives)
+	if err != nil {
+		return "", err
+	}
+	noun, err := randomWord(subdomainNouns)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 2)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+
+	return fmt.Sprintf("%s-%s-%s", adjective, noun, hex.EncodeToString(suffix)), nil
+}
+
+// GenerateAvailableSubdomain generates random subdomains until available
+// reports one as free
+func GenerateAvailableSubdomain(available func(subdomain string) bool) (string, error) {
+	for i := 0; i < maxSubdomainAttempts; i++ {
+		subdomain, err := GenerateSubdomain()
+		if err != nil {
+			return "", err
+		}
+		if available(subdomain) {
+			return subdomain, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find a free subdomain after %d attempts", maxSubdomainAttempts)
+}
+
+// randomWord picks a uniformly random entry from words
+func randomWord(words []string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random index: %w", err)
+	}
+	return words[n.Int64()], nil
+}
@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGenerateSubdomain(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z]+-[a-z]+-[0-9a-f]{4}$`)
+	for i := 0; i < 50; i++ {
+		subdomain, err := GenerateSubdomain()
+		if err != nil {
+			t.Fatalf("GenerateSubdomain failed: %v", err)
+		}
+		if !pattern.MatchString(subdomain) {
+			t.Fatalf("Unexpected subdomain format %q", subdomain)
+		}
+	}
+}
+
+func TestGenerateAvailableSubdomain(t *testing.T) {
+	taken := make(map[string]bool)
+	calls := 0
+	subdomain, err := GenerateAvailableSubdomain(func(s string) bool {
+		calls++
+		if calls < 3 {
+			taken[s] = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("GenerateAvailableSubdomain failed: %v", err)
+	}
+	if taken[subdomain] {
+		t.Fatalf("Returned subdomain %q was reported as taken", subdomain)
+	}
+
+	if _, err := GenerateAvailableSubdomain(func(string) bool { return false }); err == nil {
+		t.Fatal("Expected an error when no subdomain is available")
+	}
+}
@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the server certificate matches none of
+// the pinned fingerprints
+var ErrPinMismatch = errors.New("server certificate does not match any pinned fingerprint")
+
+// spkiPinPrefix marks pins of the certificate's public key rather than the
+// whole certificate, which survive renewals that keep the key
+const spkiPinPrefix = "sha256/"
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the certificate
+// as colon separated hex, as printed by `openssl x509 -fingerprint -sha256`
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// PublicKeyPin returns the "sha256/<base64>" pin of the certificate's
+// public key, in the format used by HPKP and curl's --pinnedpubkey
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// pinSet holds parsed certificate and public key pins
+type pinSet struct {
+	certificates map[[sha256.Size]byte]bool
+	publicKeys   map[[sha256.Size]byte]bool
+}
+
+// parsePins parses certificate fingerprints in hex, with or without
+// colons, and public key pins in "sha256/<base64>" form
+func parsePins(pins []string) (*pinSet, error) {
+	set := &pinSet{
+		certificates: make(map[[sha256.Size]byte]bool),
+		publicKeys:   make(map[[sha256.Size]byte]bool),
+	}
+
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		var sum [sha256.Size]byte
+
+		if strings.HasPrefix(pin, spkiPinPrefix) {
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+			if err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid public key pin %q", pin)
+			}
+			copy(sum[:], raw)
+			set.publicKeys[sum] = true
+			continue
+		}
+
+		raw, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate fingerprint %q, expected a SHA-256 hex digest or sha256/<base64>", pin)
+		}
+		copy(sum[:], raw)
+		set.certificates[sum] = true
+	}
+	return set, nil
+}
+
+// matches reports whether cert matches one of the pins
+func (ps *pinSet) matches(cert *x509.Certificate) bool {
+	return ps.certificates[sha256.Sum256(cert.Raw)] || ps.publicKeys[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]
+}
+
+// verifyConnection accepts servers whose certificate chain contains a
+// pinned certificate or public key. With roots, the chain has to verify
+// against them and only certificates of the verified chains count.
+// Without roots, pins replace CA verification so self-signed certificates
+// can be used: either the leaf is pinned, or the leaf has to verify up to
+// a pinned certificate the server presented.
+func (ps *pinSet) verifyConnection(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no certificate presented", ErrPinMismatch)
+	}
+
+	leaf := state.PeerCertificates[0]
+	if roots != nil {
+		chains, err := verifyChain(state, roots)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if ps.matches(cert) {
+					return nil
+				}
+			}
+		}
+	} else if ps.matches(leaf) || ps.verifiesToPin(state) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s presented certificate %s (public key %s)",
+		ErrPinMismatch, state.ServerName, CertificateFingerprint(leaf), PublicKeyPin(leaf))
+}
+
+// verifiesToPin reports whether the leaf verifies up to a pinned
+// certificate among the ones the server presented
+func (ps *pinSet) verifiesToPin(state tls.ConnectionState) bool {
+	pinned := x509.NewCertPool()
+	found := false
+	for _, cert := range state.PeerCertificates[1:] {
+		if ps.matches(cert) {
+			pinned.AddCert(cert)
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	_, err := verifyChain(state, pinned)
+	return err == nil
+}
+
+// verifyChain verifies the server chain against roots, as the TLS stack does
+// when InsecureSkipVerify is not set, and returns the verified chains
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("server presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	return state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewClientTLSConfig_Pins(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	cert := server.Certificate()
+
+	dial := func(pins []string) error {
+		config, err := NewClientTLSConfig(ClientTLSOptions{Pins: pins})
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// Self-signed certificates are accepted by fingerprint or public key
+	if err := dial([]string{CertificateFingerprint(cert)}); err != nil {
+		t.Errorf("certificate pin rejected: %v", err)
+	}
+	if err := dial([]string{strings.ToLower(strings.ReplaceAll(CertificateFingerprint(cert), ":", ""))}); err != nil {
+		t.Errorf("plain hex pin rejected: %v", err)
+	}
+	if err := dial([]string{PublicKeyPin(cert)}); err != nil {
+		t.Errorf("public key pin rejected: %v", err)
+	}
+
+	wrong := strings.Repeat("AB", 32)
+	err := dial([]string{wrong})
+	if !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("expected ErrPinMismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), CertificateFingerprint(cert)) {
+		t.Errorf("mismatch error should name the presented fingerprint: %v", err)
+	}
+}
+
+func TestParsePins_Invalid(t *testing.T) {
+	for _, pin := range []string{"abc", "sha256/not-base64!", "sha256/" + strings.Repeat("A", 8)} {
+		if _, err := parsePins([]string{pin}); err == nil {
+			t.Errorf("expected error for %q", pin)
+		}
+	}
+
+	if _, err := NewClientTLSConfig(ClientTLSOptions{SkipVerify: true, Pins: []string{strings.Repeat("00", 32)}}); err == nil {
+		t.Error("expected error combining pins with skip verify")
+	}
+}
+
+// newTestCertificate creates a certificate for 127.0.0.1 signed by parent,
+// or a self-signed CA certificate when parent is nil
+func newTestCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestNewClientTLSConfig_PinnedIssuer(t *testing.T) {
+	ca, caKey := newTestCertificate(t, nil, nil)
+	leaf, leafKey := newTestCertificate(t, ca, caKey)
+	attacker, attackerKey := newTestCertificate(t, nil, nil)
+
+	dial := func(chain []*x509.Certificate, key *ecdsa.PrivateKey, pins []string) error {
+		served := tls.Certificate{PrivateKey: key}
+		for _, cert := range chain {
+			served.Certificate = append(served.Certificate, cert.Raw)
+		}
+		server := httptest.NewUnstartedServer(http.NotFoundHandler())
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{served}}
+		server.StartTLS()
+		defer server.Close()
+
+		config, err := NewClientTLSConfig(ClientTLSOptions{Pins: pins})
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// A leaf signed by the pinned issuer is accepted
+	for _, pin := range []string{CertificateFingerprint(ca), PublicKeyPin(ca)} {
+		if err := dial([]*x509.Certificate{leaf, ca}, leafKey, []string{pin}); err != nil {
+			t.Errorf("leaf issued by pinned certificate rejected: %v", err)
+		}
+	}
+
+	// Appending the pinned certificate to a leaf it didn't sign isn't enough
+	for _, pin := range []string{CertificateFingerprint(ca), PublicKeyPin(ca)} {
+		err := dial([]*x509.Certificate{attacker, ca}, attackerKey, []string{pin})
+		if !errors.Is(err, ErrPinMismatch) {
+			t.Errorf("expected ErrPinMismatch for an attacker leaf followed by the pinned certificate, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"net/url"
+	"time"
+)
+
+// HandshakeResponse is the first message the server sends on a tunnel
+// connection, telling the client whether its tunnel was registered
+type HandshakeResponse struct {
+	Success   bool   `json:"success"`
+	TunnelID  string `json:"tunnel_id,omitempty"`
+	Subdomain string `json:"subdomain,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// MessageTypeChallenge marks an AuthChallenge
+const MessageTypeChallenge = "challenge"
+
+// MessageTypeTokenRotated marks a TokenRotated control message
+const MessageTypeTokenRotated = "token_rotated"
+
+// AuthChallenge is sent by the server before the handshake response when
+// the client asked to authenticate by challenge instead of sending its
+// token. The client answers with an AuthResponse.
+type AuthChallenge struct {
+	Type  string `json:"type"`
+	Nonce string `json:"nonce"`
+}
+
+// AuthResponse proves the client holds the key identified by KeyID by
+// signing the challenge nonce and the session parameters of the connection.
+// KeyID is the ID of the key derived from the token for the token-ed25519
+// method and the SHA-256 fingerprint of the identity key for ed25519.
+type AuthResponse struct {
+	Method    string `json:"method"`
+	KeyID     string `json:"key_id"`
+	Signature string `json:"signature"`
+}
+
+// ChallengeParams returns the session parameters a challenge response
+// covers: the query of the tunnel URL without credentials, and the host the
+// client connected to
+func ChallengeParams(host string, query url.Values) url.Values {
+	params := url.Values{}
+	for name, values := range query {
+		if name == "token" {
+			continue
+		}
+		params[name] = values
+	}
+	params.Set("host", host)
+	return params
+}
+
+// TokenRotated is sent by the server as a text message over an open tunnel
+// connection, next to the binary tunnel traffic, when the token the tunnel
+// was opened with is rotated. The client should authenticate with Token
+// from then on; the previous token stops working at PreviousExpiresAt.
+type TokenRotated struct {
+	Type              string    `json:"type"`
+	Token             string    `json:"token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	PreviousExpiresAt time.Time `json:"previous_expires_at"`
+}
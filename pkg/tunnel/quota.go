@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidthWindow is the period bandwidth limits are averaged over
+const bandwidthWindow = time.Minute
+
+// BandwidthMeter counts the traffic of one or more tunnels and reports when
+// it exceeds a limit in bytes per second, averaged over a minute
+type BandwidthMeter struct {
+	limit int64
+
+	mu      sync.Mutex
+	start   time.Time
+	used    int64
+	current int64
+}
+
+// NewBandwidthMeter creates a meter allowing limit bytes per second
+func NewBandwidthMeter(limit int64) *BandwidthMeter {
+	return &BandwidthMeter{limit: limit, start: time.Now()}
+}
+
+// roll starts a new window when the current one is over. The traffic of
+// the previous window carries over proportionally so bursts at a window
+// boundary can't double the limit.
+func (m *BandwidthMeter) roll(now time.Time) {
+	elapsed := now.Sub(m.start)
+	if elapsed < bandwidthWindow {
+		return
+	}
+	if elapsed >= 2*bandwidthWindow {
+		m.used = 0
+	} else {
+		m.used = m.current
+	}
+	m.current = 0
+	m.start = now
+}
+
+// Add records n bytes of traffic
+func (m *BandwidthMeter) Add(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roll(time.Now())
+	m.current += int64(n)
+}
+
+// Exceeded reports whether the traffic of the last minute is over the limit
+func (m *BandwidthMeter) Exceeded() bool {
+	if m == nil || m.limit <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.roll(now)
+
+	// Weight the previous window by how much of it still overlaps the last minute
+	overlap := 1 - float64(now.Sub(m.start))/float64(bandwidthWindow)
+	total := float64(m.current) + float64(m.used)*overlap
+	return total > float64(m.limit)*bandwidthWindow.Seconds()
+}
@@ -0,0 +1,30 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthMeter(t *testing.T) {
+	m := NewBandwidthMeter(10)
+	m.Add(500)
+	if m.Exceeded() {
+		t.Fatal("500 bytes in a minute should be under 10 B/s")
+	}
+	m.Add(200)
+	if !m.Exceeded() {
+		t.Fatal("700 bytes in a minute should exceed 10 B/s")
+	}
+
+	// Traffic from long ago no longer counts
+	m.start = time.Now().Add(-3 * bandwidthWindow)
+	if m.Exceeded() {
+		t.Fatal("old traffic should expire")
+	}
+
+	var unlimited *BandwidthMeter
+	unlimited.Add(1 << 30)
+	if unlimited.Exceeded() {
+		t.Fatal("a nil meter never exceeds")
+	}
+}
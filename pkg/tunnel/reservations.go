@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ogrok/gotunnel/internal/fsutil"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrSubdomainReserved is returned when a subdomain is reserved by another owner
+	ErrSubdomainReserved = errors.New("subdomain is reserved by another owner")
+
+	// ErrSubdomainInUse is returned when another owner already has a live tunnel on the subdomain
+	ErrSubdomainInUse = errors.New("subdomain is already in use")
+
+	// ErrReservationNotFound is returned when a subdomain has no reservation
+	ErrReservationNotFound = errors.New("subdomain is not reserved")
+)
+
+// Reservation binds a subdomain to an owner (a user or a token)
+type Reservation struct {
+	Subdomain string    `json:"subdomain"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReservationStore holds subdomain reservations, persisting them to a
+// JSON file when a path is configured
+type ReservationStore struct {
+	path         string
+	modTime      time.Time
+	reservations map[string]*Reservation
+	mu           sync.Mutex
+}
+
+// NewReservationStore creates an in-memory reservation store
+func NewReservationStore() *ReservationStore {
+	return &ReservationStore{
+		reservations: make(map[string]*Reservation),
+	}
+}
+
+// LoadReservationStore loads reservations from path, starting empty if the
+// file does not exist yet. Every change is written back to the same file.
+func LoadReservationStore(path string) (*ReservationStore, error) {
+	rs := NewReservationStore()
+	rs.path = path
+	if err := rs.refresh(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// refresh reloads the file when it was changed by another process, such as
+// the admin commands editing reservations of a running server; callers must
+// hold the lock
+func (rs *ReservationStore) refresh() error {
+	if rs.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(rs.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat reservations file: %w", err)
+	}
+	if info.ModTime().Equal(rs.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(rs.path)
+	if err != nil {
+		return fmt.Errorf("failed to read reservations file: %w", err)
+	}
+
+	var reservations []*Reservation
+	if err := json.Unmarshal(data, &reservations); err != nil {
+		return fmt.Errorf("failed to parse reservations file: %w", err)
+	}
+
+	rs.reservations = make(map[string]*Reservation, len(reservations))
+	for _, r := range reservations {
+		rs.reservations[r.Subdomain] = r
+	}
+	rs.modTime = info.ModTime()
+	return nil
+}
+
+// Get returns the reservation for a subdomain
+func (rs *ReservationStore) Get(subdomain string) (*Reservation, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := rs.refresh(); err != nil {
+		logrus.WithError(err).Warn("Using cached subdomain reservations")
+	}
+	r, exists := rs.reservations[subdomain]
+	return r, exists
+}
+
+// List returns all reservations sorted by subdomain
+func (rs *ReservationStore) List() []*Reservation {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := rs.refresh(); err != nil {
+		logrus.WithError(err).Warn("Using cached subdomain reservations")
+	}
+	reservations := make([]*Reservation, 0, len(rs.reservations))
+	for _, r := range rs.reservations {
+		reservations = append(reservations, r)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Subdomain < reservations[j].Subdomain
+	})
+	return reservations
+}
+
+// CheckClaim returns ErrSubdomainReserved if the subdomain is reserved by
+// someone other than owner
+func (rs *ReservationStore) CheckClaim(subdomain, owner string) error {
+	if r, exists := rs.Get(subdomain); exists && r.Owner != owner {
+		return ErrSubdomainReserved
+	}
+	return nil
+}
+
+// Reserve binds a subdomain to owner. Reserving a subdomain the owner
+// already holds is a no-op.
+func (rs *ReservationStore) Reserve(subdomain, owner string) error {
+	if subdomain == "" || owner == "" {
+		return fmt.Errorf("subdomain and owner are required")
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := rs.refresh(); err != nil {
+		return err
+	}
+
+	if r, exists := rs.reservations[subdomain]; exists {
+		if r.Owner != owner {
+			return ErrSubdomainReserved
+		}
+		return nil
+	}
+
+	rs.reservations[subdomain] = &Reservation{
+		Subdomain: subdomain,
+		Owner:     owner,
+		CreatedAt: time.Now(),
+	}
+	return rs.save()
+}
+
+// Release removes the reservation for a subdomain
+func (rs *ReservationStore) Release(subdomain string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := rs.refresh(); err != nil {
+		return err
+	}
+
+	if _, exists := rs.reservations[subdomain]; !exists {
+		return ErrReservationNotFound
+	}
+	delete(rs.reservations, subdomain)
+	return rs.save()
+}
+
+// Transfer moves an existing reservation to a new owner
+func (rs *ReservationStore) Transfer(subdomain, newOwner string) error {
+	if newOwner == "" {
+		return fmt.Errorf("new owner is required")
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err := rs.refresh(); err != nil {
+		return err
+	}
+
+	r, exists := rs.reservations[subdomain]
+	if !exists {
+		return ErrReservationNotFound
+	}
+	r.Owner = newOwner
+	return rs.save()
+}
+
+// save writes the reservations to disk atomically; callers must hold the lock
+func (rs *ReservationStore) save() error {
+	if rs.path == "" {
+		return nil
+	}
+
+	reservations := make([]*Reservation, 0, len(rs.reservations))
+	for _, r := range rs.reservations {
+		reservations = append(reservations, r)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Subdomain < reservations[j].Subdomain
+	})
+
+	data, err := json.MarshalIndent(reservations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode reservations: %w", err)
+	}
+
+	if err := fsutil.WriteFileAtomic(rs.path, data, 0600); err != nil {
+		return err
+	}
+	if info, err := os.Stat(rs.path); err == nil {
+		rs.modTime = info.ModTime()
+	}
+	return nil
+}
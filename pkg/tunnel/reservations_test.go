@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReservationStore_CheckClaim(t *testing.T) {
+	rs := NewReservationStore()
+	if err := rs.Reserve("myapp", "token:a"); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	if err := rs.CheckClaim("myapp", "token:a"); err != nil {
+		t.Fatalf("Owner should be allowed to claim, got %v", err)
+	}
+	if err := rs.CheckClaim("myapp", "token:b"); err != ErrSubdomainReserved {
+		t.Fatalf("Expected ErrSubdomainReserved, got %v", err)
+	}
+	if err := rs.CheckClaim("other", "token:b"); err != nil {
+		t.Fatalf("Unreserved subdomain should be claimable, got %v", err)
+	}
+	if err := rs.Reserve("myapp", "token:b"); err != ErrSubdomainReserved {
+		t.Fatalf("Expected ErrSubdomainReserved, got %v", err)
+	}
+}
+
+func TestReservationStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reservations.json")
+
+	rs, err := LoadReservationStore(path)
+	if err != nil {
+		t.Fatalf("LoadReservationStore failed: %v", err)
+	}
+	if err := rs.Reserve("myapp", "token:a"); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := rs.Reserve("api", "token:a"); err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if err := rs.Transfer("myapp", "token:b"); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+	if err := rs.Release("api"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := rs.Release("api"); err != ErrReservationNotFound {
+		t.Fatalf("Expected ErrReservationNotFound, got %v", err)
+	}
+
+	reloaded, err := LoadReservationStore(path)
+	if err != nil {
+		t.Fatalf("LoadReservationStore failed: %v", err)
+	}
+	reservations := reloaded.List()
+	if len(reservations) != 1 {
+		t.Fatalf("Expected 1 reservation, got %d", len(reservations))
+	}
+	if reservations[0].Subdomain != "myapp" || reservations[0].Owner != "token:b" {
+		t.Fatalf("Unexpected reservation %+v", reservations[0])
+	}
+}
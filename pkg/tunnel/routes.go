@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Route sends HTTP requests whose path matches Path to Upstream, given as
+// host:port or as https://host:port for local services that speak TLS.
+// A Path ending in "/*" matches the prefix and everything below it;
+// any other Path must match exactly.
+type Route struct {
+	Path        string `yaml:"path" json:"path"`
+	Upstream    string `yaml:"upstream" json:"upstream"`
+	StripPrefix bool   `yaml:"strip_prefix" json:"strip_prefix"`
+}
+
+// ParseRoute parses a route given on the command line as
+// "/api/*=localhost:8080", optionally followed by ",strip" to remove the
+// matched prefix before the request reaches the upstream
+func ParseRoute(s string) (Route, error) {
+	idx := strings.Index(s, "=")
+	if idx <= 0 {
+		return Route{}, fmt.Errorf("invalid route %q, expected path=upstream", s)
+	}
+
+	route := Route{Path: s[:idx]}
+	options := strings.Split(s[idx+1:], ",")
+	route.Upstream = options[0]
+	for _, option := range options[1:] {
+		switch option {
+		case "strip":
+			route.StripPrefix = true
+		default:
+			return Route{}, fmt.Errorf("invalid route option %q in %q", option, s)
+		}
+	}
+
+	return route, route.validate()
+}
+
+// validate checks the path and upstream of a route
+func (r Route) validate() error {
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("route path %q must start with /", r.Path)
+	}
+	if strings.Contains(strings.TrimSuffix(r.Path, "/*"), "*") {
+		return fmt.Errorf("route path %q may only contain a trailing /*", r.Path)
+	}
+	addr, _ := SplitUpstream(r.Upstream)
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid upstream %q for route %s: %w", r.Upstream, r.Path, err)
+	}
+	return nil
+}
+
+// SplitUpstream splits an upstream into its host:port address and whether
+// it is reached over TLS. An "http://" scheme is accepted and ignored.
+func SplitUpstream(upstream string) (string, bool) {
+	if addr, ok := strings.CutPrefix(upstream, "https://"); ok {
+		return strings.TrimSuffix(addr, "/"), true
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(upstream, "http://"), "/"), false
+}
+
+// prefix returns the path prefix of a wildcard route, or "" for exact routes
+func (r Route) prefix() (string, bool) {
+	if !strings.HasSuffix(r.Path, "/*") {
+		return "", false
+	}
+	return strings.TrimSuffix(r.Path, "/*"), true
+}
+
+// RouteTable picks the upstream of an HTTP request by its path. Exact
+// routes win over wildcard routes, and longer prefixes over shorter ones.
+type RouteTable struct {
+	routes []Route
+}
+
+// NewRouteTable validates routes and orders them by specificity
+func NewRouteTable(routes []Route) (*RouteTable, error) {
+	sorted := make([]Route, len(routes))
+	copy(sorted, routes)
+	for _, r := range sorted {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, wi := sorted[i].prefix()
+		pj, wj := sorted[j].prefix()
+		if wi != wj {
+			return !wi
+		}
+		if wi {
+			return len(pi) > len(pj)
+		}
+		return false
+	})
+
+	return &RouteTable{routes: sorted}, nil
+}
+
+// Match returns the route for path and the path to send upstream, which
+// has the matched prefix removed when the route strips it
+func (rt *RouteTable) Match(path string) (Route, string, bool) {
+	for _, r := range rt.routes {
+		prefix, wildcard := r.prefix()
+		if !wildcard {
+			if path == r.Path {
+				return r, path, true
+			}
+			continue
+		}
+
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		if !r.StripPrefix {
+			return r, path, true
+		}
+
+		stripped := strings.TrimPrefix(path, prefix)
+		if stripped == "" {
+			stripped = "/"
+		}
+		return r, stripped, true
+	}
+
+	return Route{}, "", false
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import "testing"
+
+func TestParseRoute(t *testing.T) {
+	route, err := ParseRoute("/api/*=localhost:8080,strip")
+	if err != nil {
+		t.Fatalf("ParseRoute failed: %v", err)
+	}
+	if route.Path != "/api/*" || route.Upstream != "localhost:8080" || !route.StripPrefix {
+		t.Fatalf("Unexpected route %+v", route)
+	}
+
+	for _, spec := range []string{"api=localhost:8080", "/api/*=localhost", "/a*b=localhost:80", "/api=localhost:80,bogus", "=localhost:80"} {
+		if _, err := ParseRoute(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestSplitUpstream(t *testing.T) {
+	tests := []struct {
+		upstream string
+		addr     string
+		useTLS   bool
+	}{
+		{"localhost:8080", "localhost:8080", false},
+		{"http://localhost:8080", "localhost:8080", false},
+		{"https://localhost:8443", "localhost:8443", true},
+		{"https://127.0.0.1:8443/", "127.0.0.1:8443", true},
+	}
+
+	for _, tt := range tests {
+		addr, useTLS := SplitUpstream(tt.upstream)
+		if addr != tt.addr || useTLS != tt.useTLS {
+			t.Errorf("SplitUpstream(%q) = %q, %v; want %q, %v", tt.upstream, addr, useTLS, tt.addr, tt.useTLS)
+		}
+	}
+
+	if _, err := ParseRoute("/secure/*=https://localhost:8443"); err != nil {
+		t.Errorf("Expected https upstream to be accepted: %v", err)
+	}
+}
+
+func TestRouteTable_Match(t *testing.T) {
+	table, err := NewRouteTable([]Route{
+		{Path: "/*", Upstream: "localhost:3000"},
+		{Path: "/api/*", Upstream: "localhost:8080", StripPrefix: true},
+		{Path: "/api/v2/*", Upstream: "localhost:8082"},
+		{Path: "/health", Upstream: "localhost:9000"},
+	})
+	if err != nil {
+		t.Fatalf("NewRouteTable failed: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		upstream string
+		rewrite  string
+	}{
+		{"/", "localhost:3000", "/"},
+		{"/index.html", "localhost:3000", "/index.html"},
+		{"/api", "localhost:8080", "/"},
+		{"/api/users", "localhost:8080", "/users"},
+		{"/apiary", "localhost:3000", "/apiary"},
+		{"/api/v2/users", "localhost:8082", "/api/v2/users"},
+		{"/health", "localhost:9000", "/health"},
+		{"/health/deep", "localhost:3000", "/health/deep"},
+	}
+	for _, tt := range tests {
+		route, path, ok := table.Match(tt.path)
+		if !ok {
+			t.Errorf("Expected a route for %s", tt.path)
+			continue
+		}
+		if route.Upstream != tt.upstream || path != tt.rewrite {
+			t.Errorf("%s: expected %s%s, got %s%s", tt.path, tt.upstream, tt.rewrite, route.Upstream, path)
+		}
+	}
+
+	table, _ = NewRouteTable([]Route{{Path: "/api/*", Upstream: "localhost:8080"}})
+	if _, _, ok := table.Match("/other"); ok {
+		t.Error("Expected no route for /other")
+	}
+}
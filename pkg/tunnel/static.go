@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NewStaticHandler serves the files below dir with correct MIME types and
+// range request support. Directories without an index.html are listed only
+// when listings is true and answer 404 otherwise. Dotfiles such as .git and
+// .env, and symlinks leading out of dir, are never served.
+func NewStaticHandler(dir string, listings bool) (http.Handler, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+
+	var files http.FileSystem = rootFileSystem{root: root}
+	if !listings {
+		files = noListingFileSystem{files}
+	}
+	return http.FileServer(files), nil
+}
+
+// ServeStatic serves dir on a random loopback port and returns the
+// listener's address, which can be used as an upstream like any local
+// service. The server stops when the returned listener is closed.
+func ServeStatic(dir string, listings bool) (net.Listener, error) {
+	handler, err := NewStaticHandler(dir, listings)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for static files: %w", err)
+	}
+
+	go http.Serve(listener, handler)
+	return listener, nil
+}
+
+// rootFileSystem serves the files below root, which must be a cleaned
+// absolute path without symlinks. Names with a segment starting with a dot
+// and files whose real path is outside root don't exist.
+type rootFileSystem struct {
+	root string
+}
+
+func (rfs rootFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	real, err := filepath.EvalSymlinks(filepath.Join(rfs.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	if real != rfs.root && !strings.HasPrefix(real, rfs.root+string(filepath.Separator)) {
+		return nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(real)
+	if err != nil {
+		return nil, err
+	}
+	return hiddenFilteringFile{f}, nil
+}
+
+// hiddenFilteringFile leaves dotfiles out of directory listings
+type hiddenFilteringFile struct {
+	*os.File
+}
+
+func (f hiddenFilteringFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func (f hiddenFilteringFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	entries, err := f.File.ReadDir(count)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+// noListingFileSystem hides directories that have no index.html
+type noListingFileSystem struct {
+	fs http.FileSystem
+}
+
+func (nfs noListingFileSystem) Open(name string) (http.File, error) {
+	f, err := nfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() {
+		return f, nil
+	}
+
+	index, err := nfs.fs.Open(path.Join(name, "index.html"))
+	if err != nil {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	index.Close()
+	return f, nil
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "style.css"), []byte("body { color: red; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "logs", "app.log"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewStaticHandler(dir, false)
+	if err != nil {
+		t.Fatalf("NewStaticHandler failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/style.css", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/css") {
+		t.Fatalf("Expected CSS file, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/style.css", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "body" {
+		t.Fatalf("Expected partial content, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logs/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected listing to be hidden, got %d", rec.Code)
+	}
+
+	handler, err = NewStaticHandler(dir, true)
+	if err != nil {
+		t.Fatalf("NewStaticHandler failed: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/logs/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "app.log") {
+		t.Fatalf("Expected directory listing, got %d", rec.Code)
+	}
+
+	if _, err := NewStaticHandler(filepath.Join(dir, "style.css"), false); err == nil {
+		t.Fatal("Expected an error for a file instead of a directory")
+	}
+}
+
+func TestNewStaticHandler_HidesDotfiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":  "<h1>Hello</h1>",
+		".env":        "SECRET=1",
+		".git/config": "[core]",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler, err := NewStaticHandler(dir, true)
+	if err != nil {
+		t.Fatalf("NewStaticHandler failed: %v", err)
+	}
+
+	for _, target := range []string{"/.env", "/.git/config", "/.git/", "/%2egit/config"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", target, rec.Code)
+		}
+	}
+
+	// Listings leave dotfiles out
+	if err := os.Remove(filepath.Join(dir, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), ".env") || strings.Contains(rec.Body.String(), ".git") {
+		t.Fatalf("Expected listing without dotfiles, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNewStaticHandler_RejectsSymlinksOutsideRoot(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.txt"), []byte("page"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"secret.txt": secret,
+		"escape":     outside,
+		"alias.txt":  filepath.Join(dir, "page.txt"),
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	handler, err := NewStaticHandler(dir, true)
+	if err != nil {
+		t.Fatalf("NewStaticHandler failed: %v", err)
+	}
+
+	for _, target := range []string{"/secret.txt", "/escape/secret.txt", "/escape/"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", target, rec.Code)
+		}
+	}
+
+	// Symlinks staying inside the directory are served
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/alias.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "page" {
+		t.Fatalf("Expected symlink inside the directory to be served, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxLabelLength is the longest DNS label allowed by RFC 1035
+const maxLabelLength = 63
+
+var (
+	// ErrInvalidSubdomain is returned for names that are not valid DNS labels
+	ErrInvalidSubdomain = errors.New("invalid subdomain")
+
+	// ErrSubdomainNotAllowed is returned for reserved or blocklisted names
+	ErrSubdomainNotAllowed = errors.New("subdomain is not allowed")
+)
+
+// DefaultReservedSubdomains are never handed out to tunnels because they
+// clash with infrastructure or invite phishing
+var DefaultReservedSubdomains = []string{
+	"account", "accounts", "admin", "administrator", "api", "app", "assets",
+	"auth", "bank", "billing", "blog", "cdn", "dashboard", "dns", "docs",
+	"email", "ftp", "help", "imap", "localhost", "login", "logout", "mail",
+	"ns1", "ns2", "oauth", "password", "pay", "payment", "payments", "pop",
+	"portal", "register", "reset", "root", "secure", "security", "signin",
+	"signup", "smtp", "sso", "static", "status", "support", "tunnel",
+	"verify", "wallet", "webmail", "www",
+}
+
+// labelPattern matches an RFC 1123 host label in lowercase
+var labelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// ValidateSubdomain checks that name is a single lowercase RFC 1123 label
+func ValidateSubdomain(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: name is empty", ErrInvalidSubdomain)
+	}
+	if len(name) > maxLabelLength {
+		return fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidSubdomain, name, maxLabelLength)
+	}
+	if !labelPattern.MatchString(name) {
+		return fmt.Errorf("%w: %q may only contain a-z, 0-9 and inner hyphens", ErrInvalidSubdomain, name)
+	}
+	return nil
+}
+
+// SubdomainPolicy decides which subdomains tunnels may use
+type SubdomainPolicy struct {
+	reserved   map[string]bool
+	blocklist  []*regexp.Regexp
+	namespaces map[string]string
+}
+
+// NewSubdomainPolicy creates a policy from a reserved name list, blocklist
+// regular expressions and a map of owners to their namespace prefix
+func NewSubdomainPolicy(reserved, blocklist []string, namespaces map[string]string) (*SubdomainPolicy, error) {
+	p := &SubdomainPolicy{
+		reserved:   make(map[string]bool, len(reserved)),
+		namespaces: make(map[string]string, len(namespaces)),
+	}
+
+	for _, name := range reserved {
+		p.reserved[strings.ToLower(name)] = true
+	}
+
+	for _, expr := range blocklist {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist pattern %q: %w", expr, err)
+		}
+		p.blocklist = append(p.blocklist, re)
+	}
+
+	for owner, prefix := range namespaces {
+		prefix = strings.ToLower(prefix)
+		if err := ValidateSubdomain(prefix); err != nil {
+			return nil, fmt.Errorf("invalid namespace for %s: %w", owner, err)
+		}
+		p.namespaces[owner] = prefix
+	}
+
+	return p, nil
+}
+
+// DefaultSubdomainPolicy returns a policy that only rejects the default reserved names
+func DefaultSubdomainPolicy() *SubdomainPolicy {
+	p, _ := NewSubdomainPolicy(DefaultReservedSubdomains, nil, nil)
+	return p
+}
+
+// Normalize lowercases name, places it in the owner's namespace and
+// validates the result as a DNS label. Names inside the namespace of
+// another owner are rejected with ErrSubdomainNotAllowed. It does not apply
+// the reserved list or blocklist; see Allowed.
+func (p *SubdomainPolicy) Normalize(name, owner string) (string, error) {
+	name = strings.ToLower(name)
+
+	if prefix, ok := p.namespaces[owner]; ok && !inNamespace(name, prefix) {
+		name = prefix + "-" + name
+	}
+
+	if err := ValidateSubdomain(name); err != nil {
+		return "", err
+	}
+	for other, prefix := range p.namespaces {
+		if other != owner && inNamespace(name, prefix) {
+			return "", fmt.Errorf("%w: %q is in the namespace of another owner", ErrSubdomainNotAllowed, name)
+		}
+	}
+	return name, nil
+}
+
+// inNamespace reports whether name is a namespace prefix or starts with it
+func inNamespace(name, prefix string) bool {
+	return name == prefix || strings.HasPrefix(name, prefix+"-")
+}
+
+// Allowed returns ErrSubdomainNotAllowed if name is reserved or blocklisted
+func (p *SubdomainPolicy) Allowed(name string) error {
+	if p.reserved[name] {
+		return fmt.Errorf("%w: %q is reserved", ErrSubdomainNotAllowed, name)
+	}
+	for _, re := range p.blocklist {
+		if re.MatchString(name) {
+			return fmt.Errorf("%w: %q is blocked", ErrSubdomainNotAllowed, name)
+		}
+	}
+	return nil
+}
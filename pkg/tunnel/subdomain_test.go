@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateSubdomain(t *testing.T) {
+	valid := []string{"myapp", "my-app", "a", "app1", "1app", strings.Repeat("a", 63)}
+	for _, name := range valid {
+		if err := ValidateSubdomain(name); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "MyApp", "my.app", "-app", "app-", "my_app", "app!", strings.Repeat("a", 64)}
+	for _, name := range invalid {
+		if err := ValidateSubdomain(name); !errors.Is(err, ErrInvalidSubdomain) {
+			t.Errorf("Expected %q to be invalid, got %v", name, err)
+		}
+	}
+}
+
+func TestSubdomainPolicy(t *testing.T) {
+	policy, err := NewSubdomainPolicy([]string{"www", "Admin"}, []string{`^paypal`, `login`}, map[string]string{
+		"token:alice": "alice",
+	})
+	if err != nil {
+		t.Fatalf("NewSubdomainPolicy failed: %v", err)
+	}
+
+	name, err := policy.Normalize("MyApp", "token:bob")
+	if err != nil || name != "myapp" {
+		t.Fatalf("Expected myapp, got %q (%v)", name, err)
+	}
+
+	for requested, expected := range map[string]string{
+		"myapp":       "alice-myapp",
+		"alice-myapp": "alice-myapp",
+		"alice":       "alice",
+	} {
+		name, err := policy.Normalize(requested, "token:alice")
+		if err != nil || name != expected {
+			t.Errorf("Expected %q to normalize to %q, got %q (%v)", requested, expected, name, err)
+		}
+	}
+
+	// Other owners can't squat in a namespace
+	for _, requested := range []string{"alice", "alice-x", "ALICE-app"} {
+		if _, err := policy.Normalize(requested, "token:bob"); !errors.Is(err, ErrSubdomainNotAllowed) {
+			t.Errorf("Expected %q to be rejected for bob, got %v", requested, err)
+		}
+	}
+	if name, err := policy.Normalize("alicex", "token:bob"); err != nil || name != "alicex" {
+		t.Errorf("Expected alicex to be allowed for bob, got %q (%v)", name, err)
+	}
+
+	for _, name := range []string{"www", "admin", "paypal-secure", "my-login-page"} {
+		if err := policy.Allowed(name); !errors.Is(err, ErrSubdomainNotAllowed) {
+			t.Errorf("Expected %q to be rejected, got %v", name, err)
+		}
+	}
+	if err := policy.Allowed("myapp"); err != nil {
+		t.Errorf("Expected myapp to be allowed, got %v", err)
+	}
+
+	if _, err := NewSubdomainPolicy(nil, []string{"("}, nil); err == nil {
+		t.Error("Expected an error for an invalid blocklist pattern")
+	}
+}
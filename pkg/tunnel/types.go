@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -11,31 +12,63 @@ import (
 type Tunnel struct {
 	ID          string
 	Subdomain   string
+	Owner       string
 	ClientConn  net.Conn
 	CreatedAt   time.Time
 	LastSeen    time.Time
+	// AllowHTTP serves the tunnel on the plain HTTP listener instead of
+	// redirecting visitors to HTTPS
+	AllowHTTP   bool
+	// HSTS adds a Strict-Transport-Security header to HTTPS responses
+	HSTS        bool
+	// Type is the tunnel type requested by the client: http, tcp or udp
+	Type        string
+	// TokenID identifies the token the tunnel was opened with, if any
+	TokenID     string
+	// Bandwidth meters the traffic of the tunnel when its token limits it
+	Bandwidth   *BandwidthMeter
+	// UserID is the ID of the account the tunnel was opened with, zero
+	// when it wasn't opened with a user credential
+	UserID      int
 	mu          sync.RWMutex
 	closed      bool
 }
 
+// offlineWindow is how long visitors of a disconnected subdomain are told
+// the tunnel is offline; after that it is treated as unknown
+const offlineWindow = 24 * time.Hour
+
 // TunnelManager handles multiple tunnel connections
 type TunnelManager struct {
-	tunnels map[string]*Tunnel
-	mu      sync.RWMutex
+	tunnels  map[string]*Tunnel
+	lastSeen map[string]time.Time
+	// lastPrune is when expired lastSeen entries were last removed
+	lastPrune time.Time
+	mu        sync.RWMutex
 }
 
 // NewTunnelManager creates a new tunnel manager
 func NewTunnelManager() *TunnelManager {
 	return &TunnelManager{
-		tunnels: make(map[string]*Tunnel),
+		tunnels:  make(map[string]*Tunnel),
+		lastSeen: make(map[string]time.Time),
 	}
 }
 
-// AddTunnel adds a new tunnel to the manager
-func (tm *TunnelManager) AddTunnel(tunnel *Tunnel) {
+// AddTunnel adds a new tunnel to the manager. A live tunnel on the same
+// subdomain can only be replaced by its own owner, e.g. when a client
+// reconnects before the old connection timed out.
+func (tm *TunnelManager) AddTunnel(tunnel *Tunnel) error {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	if existing, exists := tm.tunnels[tunnel.Subdomain]; exists && !existing.IsClosed() {
+		if existing.Owner != tunnel.Owner {
+			return ErrSubdomainInUse
+		}
+		existing.Close()
+	}
 	tm.tunnels[tunnel.Subdomain] = tunnel
+	return nil
 }
 
 // GetTunnel retrieves a tunnel by subdomain
@@ -50,9 +83,54 @@ func (tm *TunnelManager) GetTunnel(subdomain string) (*Tunnel, bool) {
 func (tm *TunnelManager) RemoveTunnel(subdomain string) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
+	if tunnel, exists := tm.tunnels[subdomain]; exists {
+		tm.recordLastSeen(subdomain, tunnel.LastSeenAt())
+	}
 	delete(tm.tunnels, subdomain)
 }
 
+// DetachTunnel removes the tunnel only if it is still the one registered
+// for its subdomain, so a replaced tunnel cannot remove its successor
+func (tm *TunnelManager) DetachTunnel(tunnel *Tunnel) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if current, exists := tm.tunnels[tunnel.Subdomain]; exists && current == tunnel {
+		tm.recordLastSeen(tunnel.Subdomain, tunnel.LastSeenAt())
+		delete(tm.tunnels, tunnel.Subdomain)
+	}
+}
+
+// recordLastSeen remembers when the client of a subdomain was last seen and
+// forgets subdomains offline for longer than offlineWindow, at most once a
+// minute. The caller must hold tm.mu.
+func (tm *TunnelManager) recordLastSeen(subdomain string, lastSeen time.Time) {
+	tm.lastSeen[subdomain] = lastSeen
+
+	now := time.Now()
+	if now.Sub(tm.lastPrune) < time.Minute {
+		return
+	}
+	tm.lastPrune = now
+	for name, seen := range tm.lastSeen {
+		if now.Sub(seen) > offlineWindow {
+			delete(tm.lastSeen, name)
+		}
+	}
+}
+
+// LastSeen returns when the client of a disconnected subdomain was last
+// seen, so visitors can be told the tunnel is offline rather than unknown.
+// Subdomains are forgotten after offlineWindow.
+func (tm *TunnelManager) LastSeen(subdomain string) (time.Time, bool) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	lastSeen, exists := tm.lastSeen[subdomain]
+	if !exists || time.Since(lastSeen) > offlineWindow {
+		return time.Time{}, false
+	}
+	return lastSeen, true
+}
+
 // ListTunnels returns all active tunnels
 func (tm *TunnelManager) ListTunnels() []*Tunnel {
 	tm.mu.RLock()
@@ -72,6 +150,9 @@ func (t *Tunnel) Close() error {
 		return nil
 	}
 	t.closed = true
+	if t.ClientConn == nil {
+		return nil
+	}
 	return t.ClientConn.Close()
 }
 
@@ -82,6 +163,13 @@ func (t *Tunnel) IsClosed() bool {
 	return t.closed
 }
 
+// LastSeenAt returns the last seen timestamp
+func (t *Tunnel) LastSeenAt() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.LastSeen
+}
+
 // UpdateLastSeen updates the last seen timestamp
 func (t *Tunnel) UpdateLastSeen() {
 	t.mu.Lock()
@@ -89,6 +177,36 @@ func (t *Tunnel) UpdateLastSeen() {
 	t.LastSeen = time.Now()
 }
 
+// CurrentTokenID returns the ID of the token the tunnel is bound to
+func (t *Tunnel) CurrentTokenID() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.TokenID
+}
+
+// UpdateTokenID binds the tunnel to another token, after its client was
+// given the successor of a rotated token
+func (t *Tunnel) UpdateTokenID(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.TokenID = id
+}
+
+// ControlConn is a client connection that can carry control messages next
+// to the tunnel traffic
+type ControlConn interface {
+	SendControl(msg interface{}) error
+}
+
+// SendControl sends a control message to the client of the tunnel
+func (t *Tunnel) SendControl(msg interface{}) error {
+	conn, ok := t.ClientConn.(ControlConn)
+	if !ok {
+		return fmt.Errorf("tunnel connection can't carry control messages")
+	}
+	return conn.SendControl(msg)
+}
+
 // TunnelConfig holds configuration for tunnel connections
 type TunnelConfig struct {
 	ServerAddr    string
@@ -118,10 +236,106 @@ type ServerConfig struct {
 	Port           int
 	TLSCertFile    string
 	TLSKeyFile     string
+	// TLSCertPairs are additional "cert=key" files selected by SNI
+	TLSCertPairs   []string
 	UseTLS         bool
 	AllowedOrigins []string
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
+
+	// Domain is the base domain tunnels are served under, e.g. tunnel.example.com
+	Domain string
+
+	// ReservationsFile persists subdomain reservations; empty keeps them in memory
+	ReservationsFile string
+	// ReserveOnClaim reserves a subdomain for the first owner that opens a tunnel on it
+	ReserveOnClaim bool
+
+	// ReservedSubdomains are never handed out to tunnels
+	ReservedSubdomains []string
+	// SubdomainBlocklist holds regular expressions of rejected subdomains
+	SubdomainBlocklist []string
+	// SubdomainNamespaces maps owners to the prefix their subdomains must carry
+	SubdomainNamespaces map[string]string
+
+	// TrustedProxies are CIDRs whose forwarding headers are kept and appended to
+	TrustedProxies []string
+
+	// UseACME obtains certificates automatically instead of loading TLSCertFile
+	UseACME bool
+	// ACMEEmail is the contact address of the ACME account
+	ACMEEmail string
+	// ACMEDirectory is the ACME directory URL; empty uses Let's Encrypt
+	ACMEDirectory string
+	// ACMECacheDir stores ACME account keys and issued certificates
+	ACMECacheDir string
+	// ACMEDomains are custom domains certificates may be issued for
+	ACMEDomains []string
+	// ACMEDNSHook is a command publishing DNS-01 records, enabling a wildcard certificate
+	ACMEDNSHook string
+	// ACMECAFile is a PEM bundle trusted when talking to the ACME directory
+	ACMECAFile string
+	// HTTPPort serves ACME HTTP-01 challenges and redirects to HTTPS; 0
+	// disables the plain HTTP listener
+	HTTPPort int
+
+	// UseDevCA issues certificates from a local development CA
+	UseDevCA bool
+	// DevCADir stores the development CA certificate and key
+	DevCADir string
+	// DevCANames are names besides the domain and localhost the
+	// development CA issues certificates for
+	DevCANames []string
+
+	// ClientCAFile verifies client certificates of tunnel clients
+	ClientCAFile string
+	// RequireClientCert rejects tunnel clients without a verified certificate
+	RequireClientCert bool
+	// ClientCertMapFile maps client certificates to identities and subdomains
+	ClientCertMapFile string
+
+	// VisitorCAs maps subdomains to CA bundles their visitors must present
+	// a client certificate from
+	VisitorCAs map[string]string
+
+	// RequireChallengeAuth rejects clients sending their token in the URL
+	// or the Authorization header instead of answering an auth challenge.
+	// Credentials that can't be proven by challenge are still accepted in
+	// the header: htpasswd passwords, user API keys and JWTs.
+	RequireChallengeAuth bool
+
+	// StaticTokensFile lists accepted tokens with their scopes
+	StaticTokensFile string
+	// HtpasswdFile holds usernames and password hashes clients may use
+	HtpasswdFile string
+	// AuthWebhookURL is an HTTP service deciding whether to accept credentials
+	AuthWebhookURL string
+	// AuthWebhookSecret is sent to the webhook as a bearer token
+	AuthWebhookSecret string
+	// AuthorizedKeysFile lists identity keys clients may authenticate with,
+	// with the users and subdomains they map to
+	AuthorizedKeysFile string
+
+	// IPLockoutThreshold and IdentityLockoutThreshold are the numbers of
+	// consecutive failed authentication attempts that lock out an IP
+	// address or a username sent with a password; zero disables the lockout
+	IPLockoutThreshold       int
+	IdentityLockoutThreshold int
+	// LockoutDuration is the first lockout of a source; further lockouts
+	// double up to LockoutMaxDuration
+	LockoutDuration    time.Duration
+	LockoutMaxDuration time.Duration
+
+	// UsersDatabase is the PostgreSQL URL of user accounts, whose API keys
+	// and JWTs authenticate tunnels; empty disables user accounts
+	UsersDatabase string
+	// JWTSecret verifies user JWTs
+	JWTSecret string
+
+	// AdminAddr is the address of the admin API; empty disables it
+	AdminAddr string
+	// AdminToken is the bearer token the admin API requires
+	AdminToken string
 }
 
 // DefaultServerConfig returns default server configuration
@@ -131,7 +345,29 @@ func DefaultServerConfig() *ServerConfig {
 		UseTLS:      true,
 		ReadTimeout: 30 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		ReservedSubdomains: DefaultReservedSubdomains,
+	}
+}
+
+// PublicURL returns the public URL of a subdomain, or an empty string when
+// no base domain is configured
+func (c *ServerConfig) PublicURL(subdomain string) string {
+	if c.Domain == "" {
+		return ""
+	}
+
+	scheme := "https"
+	defaultPort := 443
+	if !c.UseTLS {
+		scheme = "http"
+		defaultPort = 80
+	}
+
+	host := subdomain + "." + c.Domain
+	if c.Port != defaultPort {
+		host = fmt.Sprintf("%s:%d", host, c.Port)
 	}
+	return scheme + "://" + host
 }
 
 // TunnelHandler defines the interface for handling tunnel connections
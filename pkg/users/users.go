@@ -3,10 +3,9 @@ package users
 import (
 	"crypto/rand"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +17,15 @@ import (
 	"sync"
 )
 
+// APIKeyPrefix starts every API key generated for a user
+const APIKeyPrefix = "gt_"
+
+// ErrUserInactive is returned when a suspended or deleted user authenticates
+var ErrUserInactive = errors.New("user account is not active")
+
+// ErrTooManyTunnels is returned when a user already has MaxTunnels tunnels open
+var ErrTooManyTunnels = errors.New("user has too many tunnels open")
+
 // User represents a GoTunnel user
 type User struct {
 	ID          int       `json:"id"`
@@ -187,6 +195,46 @@ func (um *UserManager) GetUserByAPIKey(apiKey string) (*User, error) {
 	return &user, nil
 }
 
+// AuthenticateCredential resolves the user of an API key or JWT and checks
+// the account is active
+func (um *UserManager) AuthenticateCredential(credential string) (*User, error) {
+	var user *User
+	var err error
+	switch {
+	case IsAPIKey(credential):
+		user, err = um.GetUserByAPIKey(credential)
+	case len(um.jwtSecret) == 0:
+		// An empty secret would accept JWTs signed by anyone
+		return nil, fmt.Errorf("JWTs are not accepted without a JWT secret")
+	default:
+		user, err = um.ValidateToken(credential)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Status != "active" {
+		return nil, fmt.Errorf("%w: %s", ErrUserInactive, user.Status)
+	}
+	return user, nil
+}
+
+// IsAPIKey reports whether credential has the format of a user API key
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// IsUserCredential reports whether credential is a user API key or looks
+// like a JWT, as opposed to a tunnel token
+func IsUserCredential(credential string) bool {
+	return IsAPIKey(credential) || strings.Count(credential, ".") == 2
+}
+
+// Owner returns the owner name binding tunnels and reservations to the user
+func (u *User) Owner() string {
+	return "user:" + u.Username
+}
+
 // UpdateUser updates a user
 func (um *UserManager) UpdateUser(id int, updates map[string]interface{}) error {
 	// Build dynamic query
@@ -258,7 +306,7 @@ func (um *UserManager) generateAPIKey() (string, error) {
 	if _, err := rand.Read(bytes); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("gt_%x", bytes), nil
+	return fmt.Sprintf("%s%x", APIKeyPrefix, bytes), nil
 }
 
 // RateLimiter handles rate limiting